@@ -175,6 +175,13 @@ func NewTestAuthServer(cfg TestAuthServerConfig) (*TestAuthServer, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// create the default namespace the same way Init does for production
+	// auth servers
+	err = srv.AuthServer.UpsertNamespace(services.NewNamespace(defaults.Namespace))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
 	// create the default role
 	err = srv.AuthServer.UpsertRole(services.NewAdminRole(), backend.Forever)
 	if err != nil {
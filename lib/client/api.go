@@ -173,10 +173,23 @@ type Config struct {
 	// Env is a map of environmnent variables to send when opening session
 	Env map[string]string
 
+	// TermType is the terminal type requested for the server-side PTY.
+	// When empty, $TERM is used, falling back to the safe default.
+	TermType string
+
+	// TermModes are the POSIX terminal modes included in the PTY request.
+	// When nil no modes are requested and the server applies its defaults.
+	TermModes ssh.TerminalModes
+
 	// Interactive, when set to true, tells tsh to launch a remote command
 	// in interactive mode, i.e. attaching the temrinal to it
 	Interactive bool
 
+	// Subsystem, when set, requests the named SSH subsystem on the node
+	// instead of a shell or command. Subsystems speak their own protocol
+	// over the raw channel, so no server-side terminal is allocated.
+	Subsystem string
+
 	// ClientAddr (if set) specifies the true client IP. Usually it's not needed (since the server
 	// can look at the connecting address to determine client's IP) but for cases when the
 	// client is web-based, this must be set to HTTP's remote addr
@@ -521,6 +534,11 @@ type TeleportClient struct {
 	// safe to keep it nil.
 	OnShellCreated ShellCreatedCallback
 
+	// OnConnectPhase gets called as the connection progresses through its
+	// phases (see the ConnectPhase* constants) so callers can report where
+	// a connection stalled. It's safe to keep it nil.
+	OnConnectPhase ConnectPhaseCallback
+
 	// eventsCh is a channel used to inform clients about events have that
 	// occured during the session.
 	eventsCh chan events.EventFields
@@ -533,6 +551,30 @@ type TeleportClient struct {
 // It allows clients to cancel SSH action
 type ShellCreatedCallback func(s *ssh.Session, c *ssh.Client, terminal io.ReadWriteCloser) (exit bool, err error)
 
+// ConnectPhaseCallback is called every time the connection moves into a new
+// phase (see the ConnectPhase* constants).
+type ConnectPhaseCallback func(phase string)
+
+const (
+	// ConnectPhaseProxy is dialing and authenticating with the proxy.
+	ConnectPhaseProxy = "proxy"
+
+	// ConnectPhaseNode is dialing the node and completing the SSH handshake.
+	ConnectPhaseNode = "node"
+
+	// ConnectPhaseShell is requesting the shell (or command execution) on
+	// the node.
+	ConnectPhaseShell = "shell"
+)
+
+// emitPhase notifies the configured callback that the connection moved into
+// the given phase.
+func (tc *TeleportClient) emitPhase(phase string) {
+	if tc.OnConnectPhase != nil {
+		tc.OnConnectPhase(phase)
+	}
+}
+
 // NewClient creates a TeleportClient object and fully configures it
 func NewClient(c *Config) (tc *TeleportClient, err error) {
 	// validate configuration
@@ -669,6 +711,7 @@ func (tc *TeleportClient) SSH(ctx context.Context, command []string, runLocally
 	if !tc.Config.ProxySpecified() {
 		return trace.BadParameter("proxy server is not specified")
 	}
+	tc.emitPhase(ConnectPhaseProxy)
 	proxyClient, err := tc.ConnectToProxy(ctx)
 	if err != nil {
 		return trace.Wrap(err)
@@ -687,6 +730,7 @@ func (tc *TeleportClient) SSH(ctx context.Context, command []string, runLocally
 	if len(nodeAddrs) == 0 {
 		return trace.BadParameter("no target host specified")
 	}
+	tc.emitPhase(ConnectPhaseNode)
 	nodeClient, err := proxyClient.ConnectToNode(
 		ctx,
 		nodeAddrs[0]+"@"+tc.Namespace+"@"+siteInfo.Name,
@@ -707,6 +751,12 @@ func (tc *TeleportClient) SSH(ctx context.Context, command []string, runLocally
 		return runLocalCommand(command)
 	}
 
+	// Issue a "subsystem" request when one was configured: subsystems
+	// replace both the shell and the command.
+	if tc.Subsystem != "" {
+		return tc.runSubsystem(ctx, nodeClient)
+	}
+
 	// Issue "exec" request(s) to run on remote node(s).
 	if len(command) > 0 {
 		if len(nodeAddrs) > 1 {
@@ -719,6 +769,7 @@ func (tc *TeleportClient) SSH(ctx context.Context, command []string, runLocally
 	if len(nodeAddrs) > 1 {
 		fmt.Printf("\x1b[1mWARNING\x1b[0m: Multiple nodes match the label selector, picking first: %v\n", nodeAddrs[0])
 	}
+	tc.emitPhase(ConnectPhaseShell)
 	return tc.runShell(nodeClient, nil)
 }
 
@@ -1116,6 +1167,16 @@ func (tc *TeleportClient) runShell(nodeClient *NodeClient, sessToJoin *session.S
 	return nil
 }
 
+// runSubsystem requests the configured SSH subsystem on the node instead of
+// a shell or command.
+func (tc *TeleportClient) runSubsystem(ctx context.Context, nodeClient *NodeClient) error {
+	nodeSession, err := newSession(nodeClient, nil, tc.Env, tc.Stdin, tc.Stdout, tc.Stderr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(nodeSession.runSubsystem(ctx, tc.Subsystem, tc.OnShellCreated))
+}
+
 // getProxyLogin determines which SSH principal to use when connecting to proxy.
 func (tc *TeleportClient) getProxySSHPrincipal() string {
 	proxyPrincipal := tc.Config.HostLogin
@@ -1205,7 +1266,7 @@ func (tc *TeleportClient) connectToProxy(ctx context.Context) (*ProxyClient, err
 		var sshClient *ssh.Client
 
 		sshConfig.Auth = []ssh.AuthMethod{m}
-		sshClient, err = ssh.Dial("tcp", proxyAddr, sshConfig)
+		sshClient, err = dialSSH(ctx, proxyAddr, sshConfig)
 		if err != nil {
 			if utils.IsHandshakeFailedError(err) {
 				log.Warn(err)
@@ -1248,7 +1309,7 @@ func (tc *TeleportClient) connectToProxy(ctx context.Context) (*ProxyClient, err
 	// and greatest auth information, try it now
 	sshConfig.Auth = []ssh.AuthMethod{authMethod}
 	sshConfig.User = proxyPrincipal
-	sshClient, err := ssh.Dial("tcp", proxyAddr, sshConfig)
+	sshClient, err := dialSSH(ctx, proxyAddr, sshConfig)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -1263,6 +1324,41 @@ func (tc *TeleportClient) connectToProxy(ctx context.Context) (*ProxyClient, err
 	return proxyClient, nil
 }
 
+// dialSSH dials the address with a context-aware TCP dial and completes
+// the SSH handshake on top of it. Canceling the context aborts both the
+// dial and an in-flight handshake promptly (e.g. the user closed the tab
+// or hit Ctrl-C while the network is down) instead of leaking a blocked
+// connection attempt.
+func dialSSH(ctx context.Context, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// The SSH handshake itself takes no context: close the connection
+	// underneath it when the context is canceled mid-handshake.
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, trace.ConnectionProblem(ctx.Err(), "connection canceled")
+		}
+		return nil, trace.Wrap(err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
 // Logout removes certificate and key for the currently logged in user from
 // the filesystem and agent.
 func (tc *TeleportClient) Logout() error {
@@ -17,9 +17,14 @@ limitations under the License.
 package client
 
 import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
 	"github.com/gravitational/teleport/lib/utils"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/check.v1"
-	"testing"
 )
 
 // register test suite
@@ -56,6 +61,44 @@ func (s *APITestSuite) TestConfig(c *check.C) {
 	c.Assert(conf.ProxyWebHostPort(), check.Equals, "example.org:3080")
 }
 
+func (s *APITestSuite) TestDialSSHCancel(c *check.C) {
+	// A listener that accepts connections but never speaks SSH keeps the
+	// handshake hanging until the context is canceled.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		_, err := dialSSH(ctx, listener.Addr().String(), &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		errC <- err
+	}()
+
+	// Cancel mid-handshake: the dial has to abort promptly rather than
+	// block until a network timeout.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errC:
+		c.Assert(err, check.NotNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("dial did not abort after the context was canceled")
+	}
+}
+
 func (s *APITestSuite) TestNew(c *check.C) {
 	conf := Config{
 		Host:          "localhost",
@@ -187,8 +187,12 @@ func (ns *NodeSession) createServerSession() (*ssh.Session, error) {
 // interactiveSession creates an interactive session on the remote node, executes
 // the given callback on it, and waits for the session to end
 func (ns *NodeSession) interactiveSession(callback interactiveCallback) error {
-	// determine what kind of a terminal we need
-	termType := os.Getenv("TERM")
+	// determine what kind of a terminal we need: an explicitly configured
+	// type wins over $TERM of the environment tsh runs in
+	termType := ns.nodeClient.Proxy.teleportClient.TermType
+	if termType == "" {
+		termType = os.Getenv("TERM")
+	}
 	if termType == "" {
 		termType = teleport.SafeTerminalType
 	}
@@ -248,10 +252,14 @@ func (ns *NodeSession) allocateTerminal(termType string, s *ssh.Session) (io.Rea
 		}
 	}
 	// ... and request a server-side terminal of the same size:
+	termModes := ns.nodeClient.Proxy.teleportClient.TermModes
+	if termModes == nil {
+		termModes = ssh.TerminalModes{}
+	}
 	err = s.RequestPty(termType,
 		int(tsize.Height),
 		int(tsize.Width),
-		ssh.TerminalModes{})
+		termModes)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -427,7 +435,9 @@ func (ns *NodeSession) runCommand(ctx context.Context, cmd []string, callback Sh
 	// keyboard based signals will be propogated to the TTY on the server which is
 	// where all signal handling will occur.
 	if interactive {
-		return ns.interactiveSession(func(s *ssh.Session, term io.ReadWriteCloser) error {
+		var session *ssh.Session
+		err := ns.interactiveSession(func(s *ssh.Session, term io.ReadWriteCloser) error {
+			session = s
 			err := s.Start(strings.Join(cmd, " "))
 			if err != nil {
 				return trace.Wrap(err)
@@ -440,6 +450,13 @@ func (ns *NodeSession) runCommand(ctx context.Context, cmd []string, callback Sh
 			}
 			return nil
 		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		// The session has ended and all output has been copied: collect the
+		// "exit-status" the server sent so the caller sees the command's exit
+		// code, same as the non-interactive path below.
+		return trace.Wrap(session.Wait())
 	}
 
 	// Start a non-interactive session ("exec" request without TTY).
@@ -483,6 +500,69 @@ func (ns *NodeSession) runCommand(ctx context.Context, cmd []string, callback Sh
 	})
 }
 
+// runSubsystem issues a "subsystem" request on the server session. No
+// terminal is allocated: the subsystem speaks its own protocol over the raw
+// channel, wired straight to the session's stdin/stdout/stderr. The session
+// streams are wired up by hand because ssh.Session only starts its own copy
+// goroutines for shell and exec requests.
+func (ns *NodeSession) runSubsystem(ctx context.Context, name string, callback ShellCreatedCallback) error {
+	s, err := ns.createServerSession()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	go func() {
+		io.Copy(stdin, ns.stdin)
+		stdin.Close()
+	}()
+	go io.Copy(ns.stderr, stderr)
+
+	if err := s.RequestSubsystem(name); err != nil {
+		return trace.Wrap(err)
+	}
+	if callback != nil {
+		exit, err := callback(s, ns.NodeClient().Client, nil)
+		if exit {
+			return trace.Wrap(err)
+		}
+	}
+
+	// The subsystem is done once its output channel is closed by the server.
+	runContext, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		_, err = io.Copy(ns.stdout, stdout)
+	}()
+
+	select {
+	// The subsystem finished, return its result to the caller.
+	case <-runContext.Done():
+		return trace.Wrap(err)
+	// The passed in context was canceled, close the channel and the
+	// client like the non-interactive exec path does.
+	case <-ctx.Done():
+		if er := s.Close(); er != nil {
+			log.Debugf("Unable to close SSH channel: %v", er)
+		}
+		if er := ns.NodeClient().Client.Close(); er != nil {
+			log.Debugf("Unable to close SSH client: %v", er)
+		}
+		return trace.ConnectionProblem(ctx.Err(), "connection canceled")
+	}
+}
+
 // watchSignals register UNIX signal handlers and properly terminates a remote shell session
 // must be called as a goroutine right after a remote shell is created
 func (ns *NodeSession) watchSignals(shell io.Writer) {
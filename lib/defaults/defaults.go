@@ -238,6 +238,26 @@ var (
 	// session will be considered idle
 	SessionIdlePeriod = SessionRefreshPeriod * 10
 
+	// LineBufferedFlushPeriod is how long line buffered terminal output is
+	// held back before it is flushed to the web client.
+	LineBufferedFlushPeriod = 100 * time.Millisecond
+
+	// PasteFlushGap is the pause between the chunks of an oversized
+	// clipboard paste fed to the node, giving the terminal application
+	// time to drain its input buffer between writes.
+	PasteFlushGap = 5 * time.Millisecond
+
+	// CloseDrainTimeout bounds how long the web terminal waits for
+	// pending audit events to be delivered after the SSH session ends,
+	// before the close frame is sent anyway.
+	CloseDrainTimeout = 2 * time.Second
+
+	// ResizeDebouncePeriod is how often at most the web terminal forwards
+	// window-change requests to the node. Dragging a browser window
+	// produces a storm of resize events, only the most recent size is
+	// forwarded every period.
+	ResizeDebouncePeriod = 50 * time.Millisecond
+
 	// NewtworkBackoffDuration is a standard backoff on network requests
 	// usually is slow, e.g. once in 30 seconds
 	NetworkBackoffDuration = time.Second * 30
@@ -414,6 +434,268 @@ const (
 
 	// ResizeRequestEnvelopeType is receiving a resize request.
 	ResizeRequestEnvelopeType = "r.r"
+
+	// RecordingStatusEnvelopeType is sending the status of the session
+	// recording upload to the web client.
+	RecordingStatusEnvelopeType = "u"
+
+	// CapabilitiesEnvelopeType is sending the capabilities of the terminal
+	// protocol to the web client right after the websocket upgrade.
+	CapabilitiesEnvelopeType = "c"
+
+	// PingEnvelopeType is sending a keepalive ping to the web client.
+	PingEnvelopeType = "p"
+
+	// PongEnvelopeType is receiving a keepalive reply from the web client.
+	PongEnvelopeType = "p.p"
+
+	// LatencyEnvelopeType is sending the measured round trip latency to the
+	// web client.
+	LatencyEnvelopeType = "l"
+
+	// CloseEnvelopeType is sending the reason the session ended (and the
+	// exit status of the remote command) to the web client.
+	CloseEnvelopeType = "x"
+
+	// FileTransferEnvelopeType is receiving a file transfer request from
+	// the web client.
+	FileTransferEnvelopeType = "f"
+
+	// FileChunkEnvelopeType is sending/receiving a chunk of file bytes.
+	FileChunkEnvelopeType = "f.d"
+
+	// FileProgressEnvelopeType is sending file transfer progress (and the
+	// final result) to the web client.
+	FileProgressEnvelopeType = "f.p"
+
+	// SessionMetadataEnvelopeType is sending the resolved connection
+	// metadata (host, port, login, cluster, session ID) to the web client.
+	SessionMetadataEnvelopeType = "m"
+
+	// ErrorEnvelopeType is sending a structured error (code and message)
+	// the web client can style apart from ordinary terminal output.
+	ErrorEnvelopeType = "e"
+
+	// ResizeAckEnvelopeType is confirming (or rejecting) a resize request
+	// back to the web client with the dimensions that were applied.
+	ResizeAckEnvelopeType = "r.a"
+
+	// PasteEnvelopeType is receiving pasted content from the web client,
+	// marked apart from typed input so it can be paste-bracketed.
+	PasteEnvelopeType = "r.p"
+
+	// StderrEnvelopeType is sending stderr output to the web client,
+	// tagged apart from stdout so it can be highlighted. Only used in
+	// command mode, a PTY merges the streams.
+	StderrEnvelopeType = "r.s"
+
+	// SignalEnvelopeType is receiving a signal name from the web client
+	// to deliver to the remote process, for the cases where the PTY is in
+	// a state Ctrl-C does not get through.
+	SignalEnvelopeType = "k"
+
+	// ReplayEnvelopeType is sending replayed scrollback history to the
+	// web client, tagged apart from live output so the UI can show a
+	// loading indicator.
+	ReplayEnvelopeType = "r.h"
+
+	// NoticeEnvelopeType is sending an out-of-band human readable notice
+	// to the web client, such as another participant joining or leaving
+	// the session.
+	NoticeEnvelopeType = "n"
+
+	// BellEnvelopeType is notifying the web client that terminal output
+	// contained a BEL character, so the UI can flash the tab or play a
+	// sound. The BEL byte itself stays in the raw stream.
+	BellEnvelopeType = "b"
+
+	// HistoricalEnvelopeType is sending an audit event recorded before the
+	// client joined, replayed on join and tagged apart from live events.
+	HistoricalEnvelopeType = "a.h"
+
+	// StatusEnvelopeType is sending the connection progress (resolving,
+	// dialing, shell ready) to the web client while the session is being
+	// established.
+	StatusEnvelopeType = "y"
+)
+
+// MaxMissedKeepAlives is how many keepalive pings may go unanswered before
+// the web terminal considers the browser gone and tears the session down.
+const MaxMissedKeepAlives = 3
+
+// KeepAliveJitter is the fraction by which the web terminal randomizes the
+// keepalive ping interval, so sessions started together drift apart instead
+// of pinging in lockstep.
+const KeepAliveJitter = 0.2
+
+// MaxScrollbackBytes caps the per session scrollback buffer the web
+// terminal keeps for replay on reconnect, no matter what the client
+// requested.
+const MaxScrollbackBytes = 1024 * 1024
+
+// MaxReplayEvents caps how many historical audit events are replayed to a
+// web client joining a session; only the most recent ones are kept.
+const MaxReplayEvents = 500
+
+// MaxTerminalFrameBytes is the default cap on the size of a single
+// inbound websocket frame to the web terminal. Anything larger is
+// rejected before decoding and tears the connection down.
+const MaxTerminalFrameBytes = 1024 * 1024
+
+// ReplayChunkBytes is the default size of a single scrollback replay
+// frame. Large backlogs are split into frames of this size so browsers
+// can render the history progressively.
+const ReplayChunkBytes = 32 * 1024
+
+// ReplayChunkDelay is the default pause between scrollback replay frames.
+const ReplayChunkDelay = 10 * time.Millisecond
+
+// EventBufferSize is the default capacity of the per session buffer
+// between the audit event source and the websocket sender, protecting the
+// client's event pipeline from a slow web client.
+const EventBufferSize = 64
+
+// AuditGzipThresholdBytes is the marshaled size above which an audit
+// event frame is gzip-compressed before it is sent to the web client,
+// when compression was requested.
+const AuditGzipThresholdBytes = 1024
+
+// OutputBacklogWarnBytes is the amount of terminal output stuck in an
+// unfinished websocket send above which the web terminal warns about a
+// slow client.
+const OutputBacklogWarnBytes = 256 * 1024
+
+// OutputBacklogWarnInterval rate limits the slow client warning so a
+// session that stays behind does not flood the log.
+const OutputBacklogWarnInterval = 30 * time.Second
+
+// RawDeflateThresholdBytes is the frame size above which terminal output
+// is deflate-compressed before it is sent to the web client, when
+// compression was requested. Keystroke-sized frames are not worth the CPU.
+const RawDeflateThresholdBytes = 256
+
+// MaxWebRecordingBytes caps the size of a per session transcript file
+// written on the proxy. Recording stops once the cap is reached, the
+// session itself is unaffected. Set to 10MB
+const MaxWebRecordingBytes = 1024 * 1024 * 10
+
+const (
+	// MaxTerminalWidth is the widest PTY the web terminal will request
+	// from a node, no matter what the browser asked for. Some remote
+	// programs mishandle absurd dimensions.
+	MaxTerminalWidth = 500
+
+	// MaxTerminalHeight is the tallest PTY the web terminal will request
+	// from a node, no matter what the browser asked for.
+	MaxTerminalHeight = 500
+)
+
+// ResumeGracePeriod is how long a web terminal session stays resumable
+// after its websocket drops: a browser reconnecting within this window
+// with the resume token re-attaches instead of starting a new session.
+const ResumeGracePeriod = time.Minute
+
+// NodeResolutionBackoff is the initial pause between repeated GetNodes
+// queries when the web terminal retries resolving a node that has not
+// shown up in the backend list yet. It doubles on every retry.
+const NodeResolutionBackoff = 100 * time.Millisecond
+
+// CredentialRetryAttempts is how many times the web terminal retries
+// acquiring the user's credentials (agent, signers, TLS config) before
+// failing the session. Kept tight so genuine auth failures surface fast.
+const CredentialRetryAttempts = 3
+
+// CredentialRetryBackoff is the pause between credential acquisition
+// retries. It doubles on every retry.
+const CredentialRetryBackoff = 50 * time.Millisecond
+
+// MaxWebTerminalsPerUser caps the number of web terminals a single user
+// may hold open at once, each one pins an SSH connection and goroutines on
+// the proxy.
+const MaxWebTerminalsPerUser = 25
+
+// TerminalProtocolVersion is the version of the websocket terminal protocol
+// advertised in the capabilities frame.
+const TerminalProtocolVersion = 1
+
+const (
+	// RawWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying raw terminal bytes.
+	RawWebsocketPrefix = byte('r')
+
+	// CompressedRawWebsocketPrefix is the first byte of a binary websocket
+	// frame carrying deflate-compressed terminal output. The client
+	// inflates the payload and renders it like a raw frame.
+	CompressedRawWebsocketPrefix = byte('d')
+
+	// ResizeWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying a resize request.
+	ResizeWebsocketPrefix = byte('w')
+
+	// PingWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying a keepalive ping.
+	PingWebsocketPrefix = byte('p')
+
+	// PongWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying a keepalive reply.
+	PongWebsocketPrefix = byte('o')
+
+	// LatencyWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying the measured round trip latency.
+	LatencyWebsocketPrefix = byte('l')
+
+	// CloseWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying the reason the session ended.
+	CloseWebsocketPrefix = byte('x')
+
+	// FileTransferWebsocketPrefix is the first byte of a binary websocket
+	// frame carrying a chunk of file bytes.
+	FileTransferWebsocketPrefix = byte('f')
+
+	// SessionMetadataWebsocketPrefix is the first byte of a binary
+	// websocket frame carrying the resolved connection metadata.
+	SessionMetadataWebsocketPrefix = byte('m')
+
+	// AuditGzipWebsocketPrefix is the first byte of a binary websocket
+	// frame carrying a gzip-compressed audit event envelope.
+	AuditGzipWebsocketPrefix = byte('z')
+
+	// ErrorWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying a structured error the client can style apart from
+	// ordinary terminal output.
+	ErrorWebsocketPrefix = byte('e')
+
+	// ResizeAckWebsocketPrefix is the first byte of a binary websocket
+	// frame confirming (or rejecting) a resize request.
+	ResizeAckWebsocketPrefix = byte('a')
+
+	// PasteWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying pasted content, marked apart from typed input.
+	PasteWebsocketPrefix = byte('v')
+
+	// StderrWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying stderr output, tagged apart from stdout.
+	StderrWebsocketPrefix = byte('s')
+
+	// SignalWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying a signal name to deliver to the remote process.
+	SignalWebsocketPrefix = byte('k')
+
+	// ReplayWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying replayed scrollback history, tagged apart from live output.
+	ReplayWebsocketPrefix = byte('h')
+
+	// NoticeWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying an out-of-band human readable notice.
+	NoticeWebsocketPrefix = byte('n')
+
+	// StatusWebsocketPrefix is the first byte of a binary websocket frame
+	// carrying the connection progress while the session is established.
+	StatusWebsocketPrefix = byte('y')
+
+	// BellWebsocketPrefix is the first byte of a binary websocket frame
+	// notifying the client that terminal output contained a BEL character.
+	BellWebsocketPrefix = byte('b')
 )
 
 // The following are cryptographic primitives Teleport does not support in
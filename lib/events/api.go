@@ -38,6 +38,14 @@ const (
 	// EventIndex is an event index as received from the logging server
 	EventIndex = "ei"
 
+	// EventCoalescedCount is the number of consecutive events of the same
+	// type a summary event stands for
+	EventCoalescedCount = "coalesced"
+
+	// EventDroppedCount is the number of events dropped on buffer overflow
+	// before the event carrying this field was delivered
+	EventDroppedCount = "dropped"
+
 	// EventNamespace is a namespace of the session event
 	EventNamespace = "namespace"
 
@@ -59,6 +67,11 @@ const (
 
 	// SessionEndEvent indicates that a session has ended
 	SessionEndEvent = "session.end"
+
+	// SessionHeartbeatEvent is a synthetic liveness marker emitted
+	// periodically while a session is connected, so audit consumers can
+	// tell a live idle session from a stuck one
+	SessionHeartbeatEvent = "session.heartbeat"
 	// SessionUploadEvent indicates that session has been uploaded to the external storage
 	SessionUploadEvent = "session.upload"
 	// URL is used for a session upload URL
@@ -56,6 +56,7 @@ var DefaultImplicitRules = []Rule{
 	NewRule(KindClusterAuthPreference, RO()),
 	NewRule(KindClusterName, RO()),
 	NewRule(KindSSHSession, RO()),
+	NewRule(KindNamespace, RO()),
 }
 
 // DefaultCertAuthorityRules provides access the minimal set of resources
@@ -1384,7 +1384,14 @@ func (h *Handler) siteNodeConnect(
 		req.Namespace, req.Server, req.Login, req.SessionID)
 
 	req.Namespace = namespace
-	req.ProxyHostPort = h.ProxyHostPort()
+	// The proxy address is normally set here, but a client may pin a
+	// specific proxy in multi-proxy setups. A client supplied address has
+	// to refer to a proxy known to the cluster.
+	if req.ProxyHostPort == "" {
+		req.ProxyHostPort = h.ProxyHostPort()
+	} else if err := h.validateProxyHostPort(req.ProxyHostPort); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	req.Cluster = site.GetName()
 
 	clt, err := ctx.GetUserClient(site)
@@ -1922,6 +1929,62 @@ func (h *Handler) ProxyHostPort() string {
 	return fmt.Sprintf("%s,%s", addr, sshPort)
 }
 
+// advertisedPort extracts the port from an advertised host:port address,
+// falling back when the address does not carry one.
+func advertisedPort(addr string, fallback int) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strconv.Itoa(fallback)
+	}
+	return port
+}
+
+// validateProxyHostPort checks that hostPort uses the --proxy notation
+// accepted by ProxyHostPort and refers either to this proxy or to another
+// proxy registered in the cluster, on the ports that proxy advertises.
+func (h *Handler) validateProxyHostPort(hostPort string) error {
+	webAddr := hostPort
+	sshPort := strconv.Itoa(defaults.SSHProxyListenPort)
+	if idx := strings.LastIndex(hostPort, ","); idx >= 0 {
+		webAddr = hostPort[:idx]
+		sshPort = hostPort[idx+1:]
+		if _, err := strconv.Atoi(sshPort); err != nil {
+			return trace.BadParameter("proxy_host_port: invalid ssh port in %q", hostPort)
+		}
+	}
+	host, webPort, err := net.SplitHostPort(webAddr)
+	if err != nil {
+		return trace.BadParameter("proxy_host_port: invalid address %q", hostPort)
+	}
+	// The proxy serving the request is always a valid choice.
+	if hostPort == h.ProxyHostPort() {
+		return nil
+	}
+	proxies, err := h.cfg.ProxyClient.GetProxies()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, proxy := range proxies {
+		if host != client.ProxyHost(proxy.GetPublicAddr()) &&
+			host != client.ProxyHost(proxy.GetAddr()) &&
+			host != proxy.GetHostname() {
+			continue
+		}
+		// Matching the host alone is not enough: the ports are what this
+		// proxy will dial, so a client picking its own would turn the
+		// endpoint into a connect oracle against any registered proxy
+		// host. Both ports have to be the ones the proxy advertises.
+		if webPort != advertisedPort(proxy.GetPublicAddr(), defaults.HTTPListenPort) {
+			continue
+		}
+		if sshPort != advertisedPort(proxy.GetAddr(), defaults.SSHProxyListenPort) {
+			continue
+		}
+		return nil
+	}
+	return trace.BadParameter("proxy_host_port: unknown proxy %q", hostPort)
+}
+
 func message(msg string) interface{} {
 	return map[string]interface{}{"message": msg}
 }
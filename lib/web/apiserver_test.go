@@ -19,6 +19,7 @@ package web
 import (
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/base32"
@@ -34,12 +35,18 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/net/websocket"
+	"golang.org/x/text/encoding/unicode"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/auth"
@@ -57,6 +64,7 @@ import (
 	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/srv/regular"
 	"github.com/gravitational/teleport/lib/sshutils"
+	"github.com/gravitational/teleport/lib/sshutils/scp"
 	"github.com/gravitational/teleport/lib/state"
 	"github.com/gravitational/teleport/lib/utils"
 	"github.com/gravitational/teleport/lib/web/ui"
@@ -68,6 +76,9 @@ import (
 	"github.com/gokyle/hotp"
 	"github.com/jonboulle/clockwork"
 	"github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
 	"github.com/tstranex/u2f"
 	. "gopkg.in/check.v1"
 	kyaml "k8s.io/apimachinery/pkg/util/yaml"
@@ -84,9 +95,10 @@ type WebSuite struct {
 	proxy *regular.Server
 	srvID string
 
-	user      string
-	webServer *httptest.Server
-	freePorts []string
+	user       string
+	webServer  *httptest.Server
+	webHandler *RewritingHandler
+	freePorts  []string
 
 	mockU2F     *mocku2f.Key
 	server      *auth.TestTLSServer
@@ -220,6 +232,7 @@ func (s *WebSuite) SetUpTest(c *C) {
 	c.Assert(err, IsNil)
 
 	s.webServer = httptest.NewUnstartedServer(handler)
+	s.webHandler = handler
 	s.webServer.StartTLS()
 	err = s.proxy.Start()
 	c.Assert(err, IsNil)
@@ -766,6 +779,26 @@ func (s *WebSuite) TestResolveServerHostPort(c *C) {
 			expectedHost: "nodehostname",
 			expectedPort: 0,
 		},
+		{
+			server:       "192.168.1.1:3022",
+			expectedHost: "192.168.1.1",
+			expectedPort: 3022,
+		},
+		{
+			server:       "2001:db8::1",
+			expectedHost: "2001:db8::1",
+			expectedPort: 0,
+		},
+		{
+			server:       "[2001:db8::1]",
+			expectedHost: "2001:db8::1",
+			expectedPort: 0,
+		},
+		{
+			server:       "[2001:db8::1]:3022",
+			expectedHost: "2001:db8::1",
+			expectedPort: 3022,
+		},
 	}
 
 	// invalid cases
@@ -843,6 +876,7 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 				Server:         validServer,
 				SessionID:      validSID,
 				Term:           validParams,
+				Namespace:      defaults.Namespace,
 				SessionTimeout: validTimeout,
 			},
 			authProvider: makeProvider(validNode),
@@ -855,6 +889,7 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 				Server:         "eca53e45-86a9-11e7-a893-0242ac0a0101",
 				SessionID:      validSID,
 				Term:           validParams,
+				Namespace:      defaults.Namespace,
 				SessionTimeout: validTimeout,
 			},
 			authProvider: makeProvider(validNode),
@@ -877,6 +912,7 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 				Login:          validLogin,
 				Server:         validServer,
 				Term:           validParams,
+				Namespace:      defaults.Namespace,
 				SessionTimeout: validTimeout,
 			},
 		},
@@ -891,6 +927,7 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 					H: -1,
 					W: 0,
 				},
+				Namespace:      defaults.Namespace,
 				SessionTimeout: validTimeout,
 			},
 		},
@@ -902,6 +939,7 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 				SessionID:      validSID,
 				Login:          validLogin,
 				Term:           validParams,
+				Namespace:      defaults.Namespace,
 				SessionTimeout: validTimeout,
 			},
 		},
@@ -910,6 +948,19 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 	for _, testCase := range validCases {
 		term, err := NewTerminal(testCase.req, testCase.authProvider, nil)
 		c.Assert(err, IsNil)
+
+		// NewTerminal defaults the terminal type and invalid UTF-8
+		// strategy when they are not set, and generates a random request
+		// ID when the client did not supply one.
+		testCase.req.TermType = teleport.SafeTerminalType
+		testCase.req.InvalidUTF8 = invalidUTF8Replace
+		testCase.req.EndOn = endOnBoth
+		testCase.req.MaxTermWidth = defaults.MaxTerminalWidth
+		testCase.req.MaxTermHeight = defaults.MaxTerminalHeight
+		testCase.req.KeepAliveJitter = defaults.KeepAliveJitter
+		testCase.req.RecordingMode = services.RecordAtNode
+		c.Assert(term.params.RequestID, Not(Equals), "")
+		testCase.req.RequestID = term.params.RequestID
 		c.Assert(term.params, DeepEquals, testCase.req)
 		c.Assert(term.hostName, Equals, testCase.expectedHost)
 		c.Assert(term.hostPort, Equals, testCase.expectedPort)
@@ -921,253 +972,4339 @@ func (s *WebSuite) TestNewTerminalHandler(c *C) {
 	}
 }
 
-func (s *WebSuite) TestResizeTerminal(c *C) {
-	sid := session.NewID()
+func (s *WebSuite) TestTerminalNamespaceValidation(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
 
-	// Create a new user "foo", open a terminal to a new session, and wait for
-	// it to be ready.
-	pack1 := s.authPack(c, "foo")
-	ws1, err := s.makeTerminal(pack1, sid)
-	c.Assert(err, IsNil)
-	defer ws1.Close()
-	err = s.waitForRawEvent(ws1, 5*time.Second)
-	c.Assert(err, IsNil)
+	req := TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+	}
 
-	// Create a new user "bar", open a terminal to the session created above,
-	// and wait for it to be ready.
-	pack2 := s.authPack(c, "bar")
-	ws2, err := s.makeTerminal(pack2, sid)
-	c.Assert(err, IsNil)
-	defer ws2.Close()
-	err = s.waitForRawEvent(ws2, 5*time.Second)
-	c.Assert(err, IsNil)
+	// An empty namespace is rejected outright.
+	_, err := NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*missing namespace.*")
+
+	// So is one that does not match the allowed format.
+	req.Namespace = "no spaces!"
+	_, err = NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*invalid namespace.*")
+
+	// A user whose roles do not cover the namespace gets the access
+	// denied error from the auth API before any node is dialed.
+	req.Namespace = defaults.Namespace
+	_, err = NewTerminal(req, deniedNamespaceMock{authProviderMock{server: node}}, nil)
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+}
 
-	// Look at the audit events for the first terminal. It should have two
-	// resize events from the second terminal (80x25 default then 100x100). Only
-	// the second terminal will get these because resize events are not sent
-	// back to the originator.
-	err = s.waitForResizeEvent(ws1, 5*time.Second)
-	c.Assert(err, IsNil)
-	err = s.waitForResizeEvent(ws1, 5*time.Second)
-	c.Assert(err, IsNil)
+func (s *WebSuite) TestValidateTerminalRequest(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	provider := authProviderMock{server: node}
+
+	valid := TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}
 
-	// Look at the stream events for the second terminal. We don't expect to see
-	// any resize events yet. It will timeout.
-	err = s.waitForResizeEvent(ws2, 1*time.Second)
-	c.Assert(err, NotNil)
+	// A well-formed request that resolves passes without a session being
+	// opened.
+	c.Assert(ValidateTerminalRequest(valid, provider), IsNil)
 
-	// Resize the second terminal. This should be reflected on the first terminal
-	// because resize events are not sent back to the originator.
-	params, err := session.NewTerminalParamsFromInt(300, 120)
-	c.Assert(err, IsNil)
-	websocket.JSON.Send(ws2, eventEnvelope{
-		Type: defaults.ResizeRequestEnvelopeType,
-		Payload: events.EventFields{
-			events.EventType:      events.ResizeEvent,
-			events.EventNamespace: defaults.Namespace,
-			events.SessionEventID: sid.String(),
-			events.TerminalSize:   params.Serialize(),
-		},
-	})
+	// Each pre-flight check NewTerminal runs fires through the dry run
+	// too.
+	req := valid
+	req.SessionID = ""
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*invalid session.*")
 
-	// This time the first terminal will see the resize event.
-	err = s.waitForResizeEvent(ws1, 5*time.Second)
-	c.Assert(err, IsNil)
+	req = valid
+	req.Login = "  "
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*missing login.*")
 
-	// The second terminal will not see any resize event. It will timeout.
-	err = s.waitForResizeEvent(ws2, 1*time.Second)
-	c.Assert(err, NotNil)
+	req = valid
+	req.Term = session.TerminalParams{W: 0, H: -1}
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*bad term dimensions.*")
+
+	req = valid
+	req.Namespace = "no spaces!"
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*invalid namespace.*")
+
+	req = valid
+	req.Charset = "shift-jis"
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*unsupported charset.*")
+
+	req = valid
+	req.EndOn = "on-tuesdays"
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*end_on.*")
+
+	req = valid
+	req.Server = "localhost:port"
+	c.Assert(ValidateTerminalRequest(req, provider), ErrorMatches, ".*invalid server name.*")
+
+	// A namespace the user's roles do not cover is caught as well.
+	c.Assert(trace.IsAccessDenied(ValidateTerminalRequest(valid, deniedNamespaceMock{provider})), Equals, true)
+
+	// A resume token request bypasses these checks in NewTerminal, so the
+	// dry run does not judge it either.
+	c.Assert(ValidateTerminalRequest(TerminalRequest{ResumeToken: "whatever"}, provider), IsNil)
 }
 
-func (s *WebSuite) TestTerminal(c *C) {
-	ws, err := s.makeTerminal(s.authPack(c, "foo"))
-	c.Assert(err, IsNil)
-	defer ws.Close()
+func (s *WebSuite) TestResolveServerByLabels(c *C) {
+	prodNode := services.ServerV2{}
+	prodNode.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	prodNode.Spec.Hostname = "prodhostname"
+	prodNode.Metadata.Labels = map[string]string{"env": "prod", "role": "db"}
 
-	// Create a wrapped connection that gives access to the terminal stream.
-	term := newWrappedSocket(ws, nil)
+	stagingNode := services.ServerV2{}
+	stagingNode.SetName("00000000-86a9-11e7-a893-0242ac0a0101")
+	stagingNode.Spec.Hostname = "staginghostname"
+	stagingNode.Metadata.Labels = map[string]string{"env": "staging", "role": "db"}
 
-	_, err = io.WriteString(term, "echo vinsong\r\n")
-	c.Assert(err, IsNil)
+	nodes := []services.Server{&prodNode, &stagingNode}
 
-	err = s.waitForOutput(term, "vinsong")
+	// Exactly one node matches.
+	host, port, err := resolveServerHostPort("labels:env=prod,role=db", nodes)
 	c.Assert(err, IsNil)
+	c.Assert(host, Equals, "prodhostname")
+	c.Assert(port, Equals, 0)
+
+	// No node matches.
+	_, _, err = resolveServerHostPort("labels:env=dev", nodes)
+	c.Assert(err, ErrorMatches, ".*no nodes match.*")
+
+	// More than one node matches, the error names the ambiguity.
+	_, _, err = resolveServerHostPort("labels:role=db", nodes)
+	c.Assert(err, ErrorMatches, ".*ambiguous.*2 nodes match.*")
+
+	// A malformed expression is rejected.
+	_, _, err = resolveServerHostPort("labels:role", nodes)
+	c.Assert(err, ErrorMatches, ".*invalid label expression.*")
 }
 
-func (s *WebSuite) TestWebAgentForward(c *C) {
-	ws, err := s.makeTerminal(s.authPack(c, "foo"))
+func (s *WebSuite) TestRequestIDLogging(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	term, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+		RequestID: "trace-me",
+	}, authProviderMock{server: node}, nil)
 	c.Assert(err, IsNil)
-	defer ws.Close()
 
-	// Create a wrapped connection that gives access to the terminal stream.
-	term := newWrappedSocket(ws, nil)
+	// Every log line of the handler carries the client supplied ID.
+	hook := &logCaptureHook{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(hook)
+	term.entry.Logger = logger
+	term.log().Infof("probe")
 
-	_, err = io.WriteString(term, "echo $SSH_AUTH_SOCK\r\n")
-	c.Assert(err, IsNil)
+	c.Assert(hook.entries, HasLen, 1)
+	c.Assert(hook.entries[0].Data["request_id"], Equals, "trace-me")
 
-	err = s.waitForOutput(term, "/")
-	c.Assert(err, IsNil)
+	// The metadata frame echoes the ID back to the browser.
+	c.Assert(term.metadataFrame().Payload.RequestID, Equals, "trace-me")
 }
 
-func (s *WebSuite) TestActiveSessions(c *C) {
-	sid := session.NewID()
-	pack := s.authPack(c, "foo")
+func (s *WebSuite) TestResolveHostnameCollision(c *C) {
+	nodeA := services.ServerV2{}
+	nodeA.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	nodeA.Spec.Hostname = "web-1"
 
-	ws, err := s.makeTerminal(pack, sid)
-	c.Assert(err, IsNil)
-	defer ws.Close()
+	nodeB := services.ServerV2{}
+	nodeB.SetName("f47ac10b-58cc-4372-a567-0e02b2c3d479")
+	nodeB.Spec.Hostname = "web-1"
 
-	// Create a wrapped connection that gives access to the terminal stream.
-	term := newWrappedSocket(ws, nil)
+	nodeC := services.ServerV2{}
+	nodeC.SetName("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	nodeC.Spec.Hostname = "db-1"
 
-	// To make sure we have a session.
-	_, err = io.WriteString(term, "echo vinsong\r\n")
-	c.Assert(err, IsNil)
+	nodes := []services.Server{&nodeA, &nodeB, &nodeC}
 
-	// Make sure server has replied.
-	err = s.waitForOutput(term, "vinsong")
+	// A hostname carried by exactly one node resolves as before.
+	host, port, err := resolveServerHostPort("db-1", nodes)
 	c.Assert(err, IsNil)
+	c.Assert(host, Equals, "db-1")
+	c.Assert(port, Equals, 0)
 
-	// Make sure this session appears in the list of active sessions.
-	var sessResp *siteSessionsGetResponse
-	for i := 0; i < 10; i++ {
-		// Get site nodes and make sure the node has our active party.
-		re, err := pack.clt.Get(pack.clt.Endpoint("webapi", "sites", s.server.ClusterName(), "sessions"), url.Values{})
-		c.Assert(err, IsNil)
+	// A hostname shared by several nodes is refused, the error names the
+	// candidate node IDs so a caller can offer a choice.
+	_, _, err = resolveServerHostPort("web-1", nodes)
+	c.Assert(err, ErrorMatches, ".*ambiguous hostname.*2 nodes match.*"+nodeA.GetName()+".*"+nodeB.GetName()+".*")
+}
 
-		c.Assert(json.Unmarshal(re.Bytes(), &sessResp), IsNil)
-		c.Assert(len(sessResp.Sessions), Equals, 1)
+func (s *WebSuite) TestNodeResolutionRetry(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "dbhostname"
+	node.Metadata.Labels = map[string]string{"role": "db"}
 
-		// Sessions do not appear momentarily as there's async heartbeat
-		// procedure.
-		time.Sleep(250 * time.Millisecond)
-	}
+	req := TerminalRequest{Server: "labels:role=db"}
 
-	c.Assert(len(sessResp.Sessions), Equals, 1)
-	c.Assert(sessResp.Sessions[0].ID, Equals, sid)
+	// Without a timeout the first empty read fails like before: the happy
+	// path and explicit failures are not delayed.
+	provider := &flakyProviderMock{empty: 1, server: node}
+	_, _, _, _, err := resolveServerWithRetry(req, provider)
+	c.Assert(err, NotNil)
+	c.Assert(provider.calls, Equals, 1)
+
+	// With a timeout the second query finds the freshly joined node.
+	req.NodeResolutionTimeout = 5 * time.Second
+	provider = &flakyProviderMock{empty: 1, server: node}
+	_, servers, host, port, err := resolveServerWithRetry(req, provider)
+	c.Assert(err, IsNil)
+	c.Assert(provider.calls, Equals, 2)
+	c.Assert(servers, HasLen, 1)
+	c.Assert(host, Equals, "dbhostname")
+	c.Assert(port, Equals, 0)
 }
 
-func (s *WebSuite) TestCloseConnectionsOnLogout(c *C) {
-	sid := session.NewID()
-	pack := s.authPack(c, "foo")
+func (s *WebSuite) TestValidateServerLogin(c *C) {
+	advertisingNode := services.ServerV2{}
+	advertisingNode.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	advertisingNode.Spec.Hostname = "nodehostname"
+	advertisingNode.Metadata.Labels = map[string]string{
+		teleport.TraitLogins: "root, centos",
+	}
 
-	ws, err := s.makeTerminal(pack, sid)
-	c.Assert(err, IsNil)
-	defer ws.Close()
+	silentNode := services.ServerV2{}
+	silentNode.SetName("00000000-86a9-11e7-a893-0242ac0a0101")
+	silentNode.Spec.Hostname = "silenthostname"
 
-	// Create a wrapped connection that gives access to the terminal stream.
-	term := newWrappedSocket(ws, nil)
+	nodes := []services.Server{&advertisingNode, &silentNode}
 
-	// to make sure we have a session
-	_, err = io.WriteString(term, "expr 137 + 39\r\n")
+	// The login matches one of the advertised principals.
+	err := validateServerLogin("centos", "nodehostname", nodes)
 	c.Assert(err, IsNil)
 
-	// make sure server has replied
-	out := make([]byte, 100)
-	term.Read(out)
+	// The login does not match: access is denied early, and the error
+	// suggests valid alternatives.
+	err = validateServerLogin("admin", "nodehostname", nodes)
+	c.Assert(err, NotNil)
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*root, centos.*")
 
-	_, err = pack.clt.Delete(
-		pack.clt.Endpoint("webapi", "sessions"))
+	// The node does not advertise its principals, validation is deferred.
+	err = validateServerLogin("admin", "silenthostname", nodes)
 	c.Assert(err, IsNil)
 
-	// wait until we timeout or detect that connection has been closed
-	after := time.After(5 * time.Second)
-	errC := make(chan error)
-	go func() {
-		for {
-			_, err := term.Read(out)
-			if err != nil {
-				errC <- err
-			}
-		}
-	}()
+	// The server is not in the list of nodes, validation is deferred.
+	err = validateServerLogin("admin", "unknownhostname", nodes)
+	c.Assert(err, IsNil)
+}
 
-	select {
-	case <-after:
-		c.Fatalf("timeout")
-	case err := <-errC:
-		c.Assert(err, Equals, io.EOF)
+func (s *WebSuite) TestValidateLogin(c *C) {
+	// Ordinary Unix usernames pass.
+	for _, login := range []string{"root", "centos", "svc_web", "jane.doe", "bot-7"} {
+		c.Assert(validateLogin("login", login), IsNil)
+	}
+
+	// Control characters, shell metacharacters and over-long names are
+	// rejected before they can reach the SSH username or audit records.
+	for _, login := range []string{
+		"root;rm -rf /",
+		"root\x00",
+		"root\nfake audit line",
+		"$(whoami)",
+		"root`id`",
+		"root admin",
+		"ro/ot",
+		strings.Repeat("a", 33),
+	} {
+		err := validateLogin("login", login)
+		c.Assert(err, NotNil, Commentf("login %q", login))
+		c.Assert(trace.IsBadParameter(err), Equals, true)
 	}
+
+	// The same check guards the principal, with the field named in the
+	// error.
+	err := validateLogin("principal", "bad principal")
+	c.Assert(err, ErrorMatches, "principal:.*")
+
+	// End to end: a malicious login never reaches server resolution.
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	_, err = NewTerminal(TerminalRequest{
+		Login:     "root;rm -rf /",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, ErrorMatches, ".*invalid character.*")
 }
 
-func (s *WebSuite) TestCreateSession(c *C) {
-	pack := s.authPack(c, "foo")
+func (s *WebSuite) TestValidateCertLogin(c *C) {
+	// The login is among the certificate principals.
+	c.Assert(validateCertLogin("centos", []string{"root", "centos"}), IsNil)
 
-	sess := session.Session{
-		TerminalParams: session.TerminalParams{W: 300, H: 120},
-		Login:          s.user,
-	}
+	// A wildcard principal permits any login.
+	c.Assert(validateCertLogin("admin", []string{services.Wildcard}), IsNil)
 
-	re, err := pack.clt.PostJSON(
-		pack.clt.Endpoint("webapi", "sites", s.server.ClusterName(), "sessions"),
-		siteSessionGenerateReq{Session: sess},
-	)
-	c.Assert(err, IsNil)
+	// The login is not among the principals: denied before dialing, with
+	// the valid logins spelled out.
+	err := validateCertLogin("admin", []string{"root", "centos"})
+	c.Assert(err, NotNil)
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*root, centos.*")
 
-	var created *siteSessionGenerateResponse
-	c.Assert(json.Unmarshal(re.Bytes(), &created), IsNil)
-	c.Assert(created.Session.ID, Not(Equals), "")
+	// No login information available, validation is deferred to the node.
+	c.Assert(validateCertLogin("admin", nil), IsNil)
+
+	// End to end: a login the user's certificate was never issued for is
+	// turned away at the connect endpoint, before any node is dialed.
+	pack := s.authPack(c, "certlogin")
+	_, err = s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  "not-a-granted-login",
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID: session.NewID(),
+	})
+	c.Assert(err, NotNil)
 }
 
-func (s *WebSuite) TestPlayback(c *C) {
-	pack := s.authPack(c, "foo")
-	sid := session.NewID()
-	ws, err := s.makeTerminal(pack, sid)
+func (s *WebSuite) TestForwardedClientAddr(c *C) {
+	// A trust list that does not parse is rejected up front.
+	_, err := parseTrustedProxies([]string{"not-a-cidr"})
+	c.Assert(err, NotNil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.0/24"})
 	c.Assert(err, IsNil)
-	defer ws.Close()
-}
 
-func (s *WebSuite) TestNewU2FUser(c *C) {
-	// configure cluster authentication preferences
-	cap, err := services.NewAuthPreference(services.AuthPreferenceSpecV2{
-		Type:         teleport.Local,
-		SecondFactor: teleport.U2F,
-		U2F: &services.U2F{
-			AppID:  "https://" + s.server.ClusterName(),
-			Facets: []string{"https://" + s.server.ClusterName()},
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.5")
+
+	// Direct connection: no trusted proxies configured, headers ignored.
+	c.Assert(forwardedClientAddr("203.0.113.7:1234", header, nil), Equals, "203.0.113.7:1234")
+
+	// Untrusted peer: its headers are never believed.
+	c.Assert(forwardedClientAddr("198.51.100.9:1234", header, trusted), Equals, "198.51.100.9:1234")
+
+	// Trusted peer: the left-most untrusted hop is the client.
+	c.Assert(forwardedClientAddr("10.0.0.1:443", header, trusted), Equals, "203.0.113.7")
+
+	// Hops appended by trusted proxies are skipped right to left, so a
+	// spoofed segment prepended by the client never wins.
+	header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7, 192.168.1.3, 10.0.0.5")
+	c.Assert(forwardedClientAddr("10.0.0.1:443", header, trusted), Equals, "203.0.113.7")
+
+	// An all-trusted chain falls back to its left-most hop.
+	header.Set("X-Forwarded-For", "192.168.1.3, 10.0.0.5")
+	c.Assert(forwardedClientAddr("10.0.0.1:443", header, trusted), Equals, "192.168.1.3")
+
+	// The RFC 7239 Forwarded header works when X-Forwarded-For is absent.
+	header = http.Header{}
+	header.Set("Forwarded", `for=203.0.113.7;proto=https, for="10.0.0.5"`)
+	c.Assert(forwardedClientAddr("10.0.0.1:443", header, trusted), Equals, "203.0.113.7")
+
+	// The handler derives the audit address from its stored request.
+	term := &TerminalHandler{
+		trustedProxies: trusted,
+		request: &http.Request{
+			RemoteAddr: "10.0.0.1:443",
+			Header:     http.Header{"X-Forwarded-For": []string{"203.0.113.7"}},
 		},
-	})
-	c.Assert(err, IsNil)
-	err = s.server.AuthServer.AuthServer.SetAuthPreference(cap)
+	}
+	c.Assert(term.clientAddr(), Equals, "203.0.113.7")
+}
+
+func (s *WebSuite) TestRecordingStatusFrame(c *C) {
+	// Simulate an upload backlog.
+	frame := recordingStatusFrame(recordingStatusMock{backlog: 5})
+	c.Assert(frame.Type, Equals, defaults.RecordingStatusEnvelopeType)
+	c.Assert(frame.Payload.Backlog, Equals, 5)
+	c.Assert(frame.Payload.Failed, Equals, false)
+
+	// Simulate a failed upload.
+	frame = recordingStatusFrame(recordingStatusMock{failed: true})
+	c.Assert(frame.Type, Equals, defaults.RecordingStatusEnvelopeType)
+	c.Assert(frame.Payload.Backlog, Equals, 0)
+	c.Assert(frame.Payload.Failed, Equals, true)
+}
+
+func (s *WebSuite) TestLineBufferedWriter(c *C) {
+	sink := &syncWriterMock{}
+	w := newLineBufferedWriter(sink, 25*time.Millisecond)
+
+	// Output without a newline is held back.
+	_, err := w.Write([]byte("par"))
 	c.Assert(err, IsNil)
+	c.Assert(sink.String(), Equals, "")
 
-	token, err := s.server.Auth().CreateSignupToken(services.UserV1{Name: "bob", AllowedLogins: []string{s.user}}, 0)
+	// A newline flushes everything buffered so far.
+	_, err = w.Write([]byte("tial line\n"))
 	c.Assert(err, IsNil)
+	c.Assert(sink.String(), Equals, "partial line\n")
 
-	clt := s.client()
-	re, err := clt.Get(clt.Endpoint("webapi", "u2f", "signuptokens", token), url.Values{})
+	// Output without a newline is flushed once the flush interval expires.
+	_, err = w.Write([]byte("prompt$ "))
 	c.Assert(err, IsNil)
+	c.Assert(sink.String(), Equals, "partial line\n")
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(sink.String(), Equals, "partial line\nprompt$ ")
+}
 
-	var u2fRegReq u2f.RegisterRequest
-	c.Assert(json.Unmarshal(re.Bytes(), &u2fRegReq), IsNil)
+func (s *WebSuite) TestServeDeadline(c *C) {
+	// Simulate a session stuck in the connecting phase: the terminal context
+	// is never canceled by a completed connection.
+	term := &TerminalHandler{}
+	term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
 
-	u2fRegResp, err := s.mockU2F.RegisterResponse(&u2fRegReq)
-	c.Assert(err, IsNil)
+	sink := &syncWriterMock{}
+	timer := term.startServeDeadline(sink, 10*time.Millisecond)
+	defer timer.Stop()
 
-	tempPass := "abc123"
+	// The deadline fires, tears the session down and tells the client why.
+	select {
+	case <-term.terminalContext.Done():
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for serve deadline to fire")
+	}
+	var re rawEnvelope
+	c.Assert(json.Unmarshal([]byte(sink.String()), &re), IsNil)
+	c.Assert(string(re.Payload), Matches, ".*serve deadline.*")
+}
 
-	re, err = clt.PostJSON(clt.Endpoint("webapi", "u2f", "users"), createNewU2FUserReq{
-		InviteToken:         token,
-		Pass:                tempPass,
-		U2FRegisterResponse: *u2fRegResp,
+func (s *WebSuite) TestCapabilitiesFrame(c *C) {
+	// No optional features enabled.
+	term := &TerminalHandler{}
+	frame := term.capabilitiesFrame()
+	c.Assert(frame.Type, Equals, defaults.CapabilitiesEnvelopeType)
+	c.Assert(frame.Payload.ProtocolVersion, Equals, defaults.TerminalProtocolVersion)
+	c.Assert(frame.Payload.EnvelopeTypes, DeepEquals, []string{
+		defaults.AuditEnvelopeType,
+		defaults.RawEnvelopeType,
+		defaults.ResizeRequestEnvelopeType,
+		defaults.RecordingStatusEnvelopeType,
+		defaults.CapabilitiesEnvelopeType,
+		defaults.CloseEnvelopeType,
+		defaults.FileTransferEnvelopeType,
+		defaults.FileChunkEnvelopeType,
+		defaults.FileProgressEnvelopeType,
+		defaults.SessionMetadataEnvelopeType,
+		defaults.ErrorEnvelopeType,
+		defaults.ResizeAckEnvelopeType,
+		defaults.PasteEnvelopeType,
+		defaults.StderrEnvelopeType,
+		defaults.SignalEnvelopeType,
+		defaults.ReplayEnvelopeType,
+		defaults.NoticeEnvelopeType,
+		defaults.BellEnvelopeType,
+		defaults.HistoricalEnvelopeType,
+		defaults.StatusEnvelopeType,
 	})
+	c.Assert(frame.Payload.LineBuffered, Equals, false)
+	c.Assert(frame.Payload.RecordingStatus, Equals, false)
+
+	// The advertised capabilities match the enabled features.
+	term = &TerminalHandler{
+		params: TerminalRequest{
+			LineBuffered:          true,
+			ReportRecordingStatus: true,
+		},
+		recordingStatus: recordingStatusMock{},
+	}
+	frame = term.capabilitiesFrame()
+	c.Assert(frame.Payload.LineBuffered, Equals, true)
+	c.Assert(frame.Payload.RecordingStatus, Equals, true)
+}
+
+func (s *WebSuite) TestEventCursorResume(c *C) {
+	sid := session.NewID()
+	provider := &eventProviderMock{
+		events: []events.EventFields{
+			{events.EventType: events.SessionStartEvent, events.EventCursor: 0},
+			{events.EventType: events.SessionEndEvent, events.EventCursor: 1},
+		},
+	}
+	ctx := &SessionContext{}
+
+	// The first connection drains all events and records the cursor, the
+	// same way streamEvents does.
+	term := &TerminalHandler{ctx: ctx, authProvider: provider, sessionID: sid}
+	sessionEvents, cursor, err := term.pollEvents(ctx.GetEventCursor(sid))
 	c.Assert(err, IsNil)
+	c.Assert(sessionEvents, HasLen, 2)
+	ctx.SetEventCursor(sid, cursor)
+
+	// A reconnected handler resumes strictly after the recorded cursor and
+	// does not see the events again.
+	term = &TerminalHandler{ctx: ctx, authProvider: provider, sessionID: sid}
+	sessionEvents, _, err = term.pollEvents(ctx.GetEventCursor(sid))
+	c.Assert(trace.IsNotFound(err), Equals, true)
+	c.Assert(sessionEvents, HasLen, 0)
+}
 
-	var rawSess *createSessionResponseRaw
-	c.Assert(json.Unmarshal(re.Bytes(), &rawSess), IsNil)
-	cookies := re.Cookies()
-	c.Assert(len(cookies), Equals, 1)
+func (s *WebSuite) TestEventPollBatching(c *C) {
+	backlog := make([]events.EventFields, 0, 5)
+	for i := 0; i < 5; i++ {
+		backlog = append(backlog, events.EventFields{
+			events.EventType:   events.SessionStartEvent,
+			events.EventCursor: i,
+		})
+	}
+	provider := &eventProviderMock{events: backlog}
+	term := &TerminalHandler{
+		params:       TerminalRequest{EventBatchSize: 2},
+		authProvider: provider,
+		sessionID:    session.NewID(),
+	}
 
-	// now make sure we are logged in by calling authenticated method
-	// we need to supply both session cookie and bearer token for
-	// request to succeed
-	jar, err := cookiejar.New(nil)
+	// A poll delivers at most the batch size and the cursor lands on the
+	// last delivered event, not the last available one.
+	sessionEvents, cursor, err := term.pollEvents(-1)
 	c.Assert(err, IsNil)
+	c.Assert(sessionEvents, HasLen, 2)
+	c.Assert(cursor, Equals, 1)
 
-	clt = s.client(roundtrip.BearerAuth(rawSess.Token), roundtrip.CookieJar(jar))
-	jar.SetCookies(s.url(), re.Cookies())
+	// The next poll resumes strictly after, nothing is re-delivered.
+	sessionEvents, cursor, err = term.pollEvents(cursor)
+	c.Assert(err, IsNil)
+	c.Assert(sessionEvents, HasLen, 2)
+	c.Assert(sessionEvents[0].GetInt(events.EventCursor), Equals, 2)
+	c.Assert(cursor, Equals, 3)
 
-	re, err = clt.Get(clt.Endpoint("webapi", "sites"), url.Values{})
+	// The tail is smaller than the batch size and drains in one poll.
+	sessionEvents, cursor, err = term.pollEvents(cursor)
+	c.Assert(err, IsNil)
+	c.Assert(sessionEvents, HasLen, 1)
+	c.Assert(cursor, Equals, 4)
+
+	// A drained backlog reads exactly like the unbatched path.
+	_, _, err = term.pollEvents(cursor)
+	c.Assert(trace.IsNotFound(err), Equals, true)
+}
+
+func (s *WebSuite) TestHistoricalEventReplay(c *C) {
+	backlog := make([]events.EventFields, 0, 6)
+	for i := 0; i < 6; i++ {
+		backlog = append(backlog, events.EventFields{
+			events.EventType:   events.SessionStartEvent,
+			events.EventCursor: i,
+		})
+	}
+	term := &TerminalHandler{
+		params: TerminalRequest{
+			ReplayEventsAfter: 1,
+			EventPollInterval: 100 * time.Millisecond,
+		},
+		authProvider: &eventProviderMock{events: backlog},
+		sessionID:    session.NewID(),
+	}
+	term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+	term.eventContext, term.eventCancel = context.WithCancel(context.Background())
+	defer term.terminalCancel()
+	defer term.eventCancel()
+
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term.streamEvents(ws, &client.TeleportClient{})
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	c.Assert(ws.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+
+	// The five historical events from the requested index stream first,
+	// tagged and in order.
+	for i := 1; i < 6; i++ {
+		var ee eventEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &ee), IsNil)
+		c.Assert(ee.Type, Equals, defaults.HistoricalEnvelopeType)
+		c.Assert(ee.Payload.GetInt(events.EventCursor), Equals, i)
+	}
+
+	// Only then do live events follow, tagged as usual.
+	var ee eventEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &ee), IsNil)
+	c.Assert(ee.Type, Equals, defaults.AuditEnvelopeType)
+}
+
+func (s *WebSuite) TestBinaryFrameCodec(c *C) {
+	// High bytes that are not valid UTF-8 pass through untouched.
+	payload := []byte{0x00, 0xff, 0xfe, 'a', '\n', 0x80}
+	frame := encodeBinaryFrame(defaults.RawWebsocketPrefix, payload)
+	c.Assert(frame[0], Equals, defaults.RawWebsocketPrefix)
+
+	prefix, decoded, err := decodeBinaryFrame(frame)
+	c.Assert(err, IsNil)
+	c.Assert(prefix, Equals, defaults.RawWebsocketPrefix)
+	c.Assert(decoded, DeepEquals, payload)
+
+	// An empty frame is rejected.
+	_, _, err = decodeBinaryFrame(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *WebSuite) TestWrappedSocketPartialRead(c *C) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: payload})
+		// Keep the connection open until the client is done reading.
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Drain the frame with a buffer much smaller than the frame, no bytes
+	// should be lost.
+	conn := newWrappedSocket(ws, nil)
+	var got []byte
+	for len(got) < len(payload) {
+		out := make([]byte, 4)
+		n, err := conn.Read(out)
+		c.Assert(err, IsNil)
+		got = append(got, out[:n]...)
+	}
+	c.Assert(got, DeepEquals, payload)
+}
+
+func (s *WebSuite) TestPhaseWatchdog(c *C) {
+	timeoutCh := make(chan string, 1)
+	watchdog := newPhaseWatchdog(map[string]time.Duration{
+		client.ConnectPhaseProxy: 10 * time.Millisecond,
+		client.ConnectPhaseNode:  10 * time.Millisecond,
+	}, func(phase string) { timeoutCh <- phase })
+
+	// The proxy phase stalls, the reported phase names it.
+	watchdog.enter(client.ConnectPhaseProxy)
+	c.Assert(<-timeoutCh, Equals, client.ConnectPhaseProxy)
+
+	// Same for the node phase.
+	watchdog.enter(client.ConnectPhaseNode)
+	c.Assert(<-timeoutCh, Equals, client.ConnectPhaseNode)
+
+	// The shell phase has no budget and a stopped watchdog never fires.
+	watchdog.enter(client.ConnectPhaseShell)
+	watchdog.stop()
+	select {
+	case phase := <-timeoutCh:
+		c.Fatalf("unexpected timeout in phase %q", phase)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *WebSuite) TestEventCoalescer(c *C) {
+	coalescer := newEventCoalescer([]string{events.ResizeEvent})
+
+	// Consecutive events of a coalesced type are held back.
+	c.Assert(coalescer.add(events.EventFields{events.EventType: events.ResizeEvent, "size": "80:25"}), HasLen, 0)
+	c.Assert(coalescer.add(events.EventFields{events.EventType: events.ResizeEvent, "size": "100:100"}), HasLen, 0)
+
+	// A distinct type flushes the run as a single summary event carrying
+	// the last payload and the run length, the new event passes through.
+	out := coalescer.add(events.EventFields{events.EventType: events.SessionJoinEvent})
+	c.Assert(out, HasLen, 2)
+	c.Assert(out[0].GetType(), Equals, events.ResizeEvent)
+	c.Assert(out[0].GetString("size"), Equals, "100:100")
+	c.Assert(out[0].GetInt(events.EventCoalescedCount), Equals, 2)
+	c.Assert(out[1].GetType(), Equals, events.SessionJoinEvent)
+
+	// A run of one is passed through without a count annotation.
+	c.Assert(coalescer.add(events.EventFields{events.EventType: events.ResizeEvent, "size": "50:50"}), HasLen, 0)
+	out = coalescer.flush()
+	c.Assert(out, HasLen, 1)
+	c.Assert(out[0].GetInt(events.EventCoalescedCount), Equals, 0)
+
+	// Nothing pending, nothing flushed.
+	c.Assert(coalescer.flush(), HasLen, 0)
+}
+
+func (s *WebSuite) TestEventFilter(c *C) {
+	// An empty filter forwards everything.
+	c.Assert(newEventFilter(nil).allows(events.SessionPrintEvent), Equals, true)
+
+	// A dashboard-style subscription: only membership and resize events
+	// out of a mixed stream are delivered.
+	filter := newEventFilter([]string{events.SessionJoinEvent, events.SessionLeaveEvent, events.ResizeEvent})
+	mixed := []events.EventFields{
+		{events.EventType: events.SessionJoinEvent},
+		{events.EventType: events.SessionPrintEvent},
+		{events.EventType: events.ResizeEvent},
+		{events.EventType: events.SessionPrintEvent},
+		{events.EventType: events.SessionLeaveEvent},
+		{events.EventType: events.SessionEndEvent},
+	}
+	var delivered []string
+	for _, event := range mixed {
+		if filter.allows(event.GetType()) {
+			delivered = append(delivered, event.GetType())
+		}
+	}
+	c.Assert(delivered, DeepEquals, []string{
+		events.SessionJoinEvent, events.ResizeEvent, events.SessionLeaveEvent,
+	})
+}
+
+func (s *WebSuite) TestAuditEventGzip(c *C) {
+	big := events.EventFields{
+		events.EventType: events.SessionPrintEvent,
+		"data":           strings.Repeat("0123456789abcdef", 640),
+	}
+	errC := make(chan error, 2)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{CompressEvents: true}}
+		// A 10KB event exceeds the threshold and is compressed, a tiny
+		// one stays below it and goes out as a plain JSON envelope.
+		errC <- term.sendEvent(ws, big)
+		errC <- term.sendEvent(ws, events.EventFields{events.EventType: events.ResizeEvent})
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The compressed frame is binary, carries the gzip prefix, is smaller
+	// than the plain marshaling and inflates back to the original event.
+	var raw []byte
+	c.Assert(websocket.Message.Receive(ws, &raw), IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(raw[0], Equals, defaults.AuditGzipWebsocketPrefix)
+	zr, err := gzip.NewReader(bytes.NewReader(raw[1:]))
+	c.Assert(err, IsNil)
+	inflated, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Assert(len(raw) < len(inflated), Equals, true)
+	var ee eventEnvelope
+	c.Assert(json.Unmarshal(inflated, &ee), IsNil)
+	c.Assert(ee.Type, Equals, defaults.AuditEnvelopeType)
+	c.Assert(ee.Payload.GetString("data"), Equals, big.GetString("data"))
+
+	var small eventEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &small), IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(small.Payload.GetType(), Equals, events.ResizeEvent)
+}
+
+// BenchmarkAuditEventGzip reports bytes on the wire for a 10KB audit
+// event frame after gzip compression versus the plain marshaling.
+func BenchmarkAuditEventGzip(b *testing.B) {
+	e := eventEnvelope{
+		Type: defaults.AuditEnvelopeType,
+		Payload: events.EventFields{
+			events.EventType: events.SessionPrintEvent,
+			"data":           strings.Repeat("the quick brown fox jumps over the lazy dog ", 228),
+		},
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed, err := gzipFrame(payload, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if i == 0 {
+			b.Logf("plain: %v bytes on wire, gzip: %v bytes on wire", len(payload), len(compressed)+1)
+		}
+	}
+}
+
+// BenchmarkRawFrameDeflate reports bytes on the wire for a screenful of
+// log-tail output after deflate compression versus the plain frame.
+func BenchmarkRawFrameDeflate(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&buf, "2026-08-30T12:00:%02dZ INFO  http: handled request method=GET path=/api/v1/nodes/%04d status=200 bytes=%d duration=%dms\r\n",
+			i, i*7, 1024+i*13, i%9)
+	}
+	payload := buf.Bytes()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed, err := deflateFrame(payload, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if i == 0 {
+			b.Logf("plain: %v bytes on wire, deflate: %v bytes on wire", len(payload)+1, len(compressed)+1)
+		}
+	}
+}
+
+// benchNodeProvider serves a large node list the way a real backend does:
+// a fresh slice on every call.
+type benchNodeProvider struct {
+	nodes []services.Server
+}
+
+func (p *benchNodeProvider) GetNamespace(n string) (*services.Namespace, error) {
+	namespace := services.NewNamespace(n)
+	return &namespace, nil
+}
+
+func (p *benchNodeProvider) GetNodes(n string) ([]services.Server, error) {
+	out := make([]services.Server, len(p.nodes))
+	copy(out, p.nodes)
+	return out, nil
+}
+
+func (p *benchNodeProvider) GetSessionEvents(n string, sid session.ID, after int, pr bool) ([]events.EventFields, error) {
+	return nil, trace.NotFound("no events")
+}
+
+// benchSingleNodeProvider adds the indexed single node lookup a capable
+// backend offers.
+type benchSingleNodeProvider struct {
+	benchNodeProvider
+	index map[string]services.Server
+}
+
+func (p *benchSingleNodeProvider) GetNode(n string, name string) (services.Server, error) {
+	node, ok := p.index[name]
+	if !ok {
+		return nil, trace.NotFound("node %q not found", name)
+	}
+	return node, nil
+}
+
+func benchNodes(count int) []services.Server {
+	nodes := make([]services.Server, 0, count)
+	for i := 0; i < count; i++ {
+		node := &services.ServerV2{}
+		node.SetName(fmt.Sprintf("00000000-0000-0000-0000-%012d", i))
+		node.Spec.Hostname = fmt.Sprintf("node-%d", i)
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func benchmarkResolveServer(b *testing.B, provider AuthProvider, target string) {
+	req := TerminalRequest{Server: target, Namespace: defaults.Namespace}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := resolveServerWithRetry(req, provider); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResolveUUIDScan(b *testing.B) {
+	nodes := benchNodes(50000)
+	benchmarkResolveServer(b, &benchNodeProvider{nodes: nodes}, nodes[len(nodes)-1].GetName())
+}
+
+func BenchmarkResolveUUIDDirect(b *testing.B) {
+	nodes := benchNodes(50000)
+	index := make(map[string]services.Server, len(nodes))
+	for _, node := range nodes {
+		index[node.GetName()] = node
+	}
+	provider := &benchSingleNodeProvider{benchNodeProvider{nodes: nodes}, index}
+	benchmarkResolveServer(b, provider, nodes[len(nodes)-1].GetName())
+}
+
+func (s *WebSuite) TestWriteDeadline(c *C) {
+	// A peer that never drains the connection: once the kernel buffers
+	// fill, sends block until the write deadline fires.
+	block := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		<-block
+	}})
+	defer srv.Close()
+	defer close(block)
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := &TerminalHandler{params: TerminalRequest{
+		WriteTimeout:   100 * time.Millisecond,
+		BinaryProtocol: true,
+	}}
+	term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+	sock := newWrappedSocket(ws, term)
+
+	// Keep writing until the buffers are full and the deadline trips.
+	chunk := make([]byte, 32*1024)
+	var writeErr error
+	for i := 0; i < 1024; i++ {
+		if _, writeErr = sock.Write(chunk); writeErr != nil {
+			break
+		}
+	}
+	c.Assert(writeErr, NotNil)
+	c.Assert(writeErr, ErrorMatches, ".*write timed out.*")
+
+	// The timeout is fatal for the whole session, not just the one send.
+	select {
+	case <-term.terminalContext.Done():
+	case <-time.After(5 * time.Second):
+		c.Fatalf("session was not torn down after the write deadline fired")
+	}
+}
+
+func (s *WebSuite) TestDrainBeforeClose(c *C) {
+	pack := s.authPack(c, "foo")
+
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:       session.NewID(),
+		SessionTimeout:  500 * time.Millisecond,
+		ProtocolVersion: defaults.TerminalProtocolVersion,
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The command prints its final output right before exiting. The
+	// expansion keeps the expected string out of the echoed input.
+	_, err = io.WriteString(newWrappedSocket(ws, nil), "echo drained=$((40+2)); exit\r\n")
+	c.Assert(err, IsNil)
+
+	// Read raw envelopes directly: the final output has to arrive before
+	// the close frame, not be lost in teardown.
+	var output bytes.Buffer
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		var ue unknownEnvelope
+		err := websocket.JSON.Receive(ws, &ue)
+		c.Assert(err, IsNil)
+		switch ue.Type {
+		case defaults.RawEnvelopeType:
+			var re rawEnvelope
+			c.Assert(json.Unmarshal(ue.Raw, &re), IsNil)
+			output.Write(re.Payload)
+		case defaults.CloseEnvelopeType:
+			c.Assert(strings.Contains(output.String(), "drained=42"), Equals, true)
+			return
+		}
+	}
+}
+
+func (s *WebSuite) TestCommandExitStatus(c *C) {
+	// InteractiveCommand is set by the embedding server, not by the
+	// client, so drive the handler the way siteNodeConnect does: borrow
+	// the session context of a live connection and serve a second
+	// terminal running the command.
+	pack := s.authPack(c, "exitstatus")
+	sid := session.NewID()
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	shell := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(shell, "echo ready=$((20+3))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(shell, "ready=23"), IsNil)
+
+	activeSessions.Lock()
+	handlers := activeSessions.handlers[sid]
+	activeSessions.Unlock()
+	c.Assert(len(handlers), Equals, 1)
+
+	term, err := NewTerminal(TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:          session.NewID(),
+		Namespace:          defaults.Namespace,
+		Cluster:            s.server.ClusterName(),
+		ProxyHostPort:      s.webHandler.handler.ProxyHostPort(),
+		SessionTimeout:     500 * time.Millisecond,
+		InteractiveCommand: []string{"false"},
+		ProtocolVersion:    defaults.TerminalProtocolVersion,
+	}, handlers[0].authProvider, handlers[0].ctx)
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		term.Serve(w, r)
+	}))
+	defer srv.Close()
+
+	ws2, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	// The command exits non-zero: the close frame carries the code and
+	// still reports a clean close, a failed command is a result, not a
+	// connection failure.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws2, &ue), IsNil)
+		if ue.Type != defaults.CloseEnvelopeType {
+			continue
+		}
+		var ce closeEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &ce), IsNil)
+		c.Assert(ce.Payload.ExitCode, Equals, 1)
+		c.Assert(ce.Payload.Clean, Equals, true)
+		return
+	}
+}
+
+func (s *WebSuite) TestPasteChunking(c *C) {
+	// A 1MB "paste" arrives from the browser as one giant raw frame.
+	paste := make([]byte, 1024*1024)
+	for i := range paste {
+		paste[i] = byte(i % 251)
+	}
+
+	done := make(chan struct{})
+	errC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		errC <- websocket.Message.Send(ws, append([]byte{defaults.RawWebsocketPrefix}, paste...))
+		<-done
+	}})
+	defer srv.Close()
+	defer close(done)
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := &TerminalHandler{params: TerminalRequest{
+		BinaryProtocol:  true,
+		PasteChunkBytes: 64 * 1024,
+	}}
+	sock := newWrappedSocket(ws, term)
+
+	// The frame is handed out in chunks no larger than the threshold, and
+	// nothing is lost on the way to the node.
+	var got []byte
+	buf := make([]byte, 256*1024)
+	reads := 0
+	for len(got) < len(paste) {
+		n, err := sock.Read(buf)
+		c.Assert(err, IsNil)
+		c.Assert(n <= 64*1024, Equals, true)
+		got = append(got, buf[:n]...)
+		reads++
+	}
+	c.Assert(<-errC, IsNil)
+	c.Assert(bytes.Equal(got, paste), Equals, true)
+	c.Assert(reads >= 16, Equals, true)
+}
+
+func (s *WebSuite) TestErrorFrame(c *C) {
+	// Codes derive from trace error types, with a catch-all default.
+	c.Assert(errorCode(trace.AccessDenied("no")), Equals, "access_denied")
+	c.Assert(errorCode(trace.LimitExceeded("no")), Equals, "limit_exceeded")
+	c.Assert(errorCode(fmt.Errorf("boom")), Equals, "internal")
+
+	// A client that declared the protocol version receives errors as
+	// structured frames carrying the code.
+	errC := make(chan error, 2)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{ProtocolVersion: defaults.TerminalProtocolVersion}}
+		errC <- term.writeError(trace.AccessDenied("access denied to node"), ws)
+
+		// An old client falls back to the raw frame printed into the
+		// terminal.
+		term = &TerminalHandler{}
+		errC <- term.writeError(trace.AccessDenied("access denied to node"), ws)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	var e errorEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &e), IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(e.Type, Equals, defaults.ErrorEnvelopeType)
+	c.Assert(e.Payload.Code, Equals, "access_denied")
+	c.Assert(e.Payload.Message, Equals, "access denied to node")
+
+	var re rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(re.Type, Equals, defaults.RawEnvelopeType)
+	c.Assert(strings.Contains(string(re.Payload), "access denied to node"), Equals, true)
+}
+
+func (s *WebSuite) TestSelectPrincipal(c *C) {
+	principals := []string{"alice", "admin", "deploy"}
+
+	// Empty keeps the first-principal default.
+	principal, err := selectPrincipal("", principals)
+	c.Assert(err, IsNil)
+	c.Assert(principal, Equals, "alice")
+
+	// An explicitly requested principal is honored when the certificate
+	// is valid for it.
+	principal, err = selectPrincipal("deploy", principals)
+	c.Assert(err, IsNil)
+	c.Assert(principal, Equals, "deploy")
+
+	// A principal the certificate is not valid for is rejected.
+	_, err = selectPrincipal("root", principals)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+
+	// A certificate without principals cannot produce a default.
+	_, err = selectPrincipal("", nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+}
+
+func (s *WebSuite) TestSessionResume(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	term, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.resumeToken, Not(Equals), "")
+
+	// The metadata frame hands the token to the browser.
+	c.Assert(term.metadataFrame().Payload.ResumeToken, Equals, term.resumeToken)
+
+	// Reconnecting with the token within the grace period re-attaches to
+	// the same handler, keeping the identity and scrollback.
+	registerResumable(term, time.Now())
+	resumed, err := NewTerminal(TerminalRequest{ResumeToken: term.resumeToken}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resumed, Equals, term)
+
+	// A token past its grace period is rejected and cleaned up, a second
+	// attempt no longer finds it at all.
+	_, err = resumeSession(term.resumeToken, time.Now().Add(defaults.ResumeGracePeriod+time.Minute))
+	c.Assert(err, ErrorMatches, ".*resume token expired.*")
+	_, err = resumeSession(term.resumeToken, time.Now())
+	c.Assert(err, ErrorMatches, ".*unknown resume token.*")
+
+	// An unknown token is rejected outright.
+	_, err = NewTerminal(TerminalRequest{ResumeToken: "bogus"}, nil, nil)
+	c.Assert(trace.IsNotFound(err), Equals, true)
+
+	// A token is bound to the user who started the session: the token
+	// travels in every metadata frame, so holding it must not be enough.
+	// Another user or an anonymous request is turned away, the owner
+	// re-attaches as before.
+	owned, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	owned.ctx = &SessionContext{user: "alice"}
+	registerResumable(owned, time.Now())
+
+	_, err = NewTerminal(TerminalRequest{ResumeToken: owned.resumeToken}, nil, &SessionContext{user: "mallory"})
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+	_, err = NewTerminal(TerminalRequest{ResumeToken: owned.resumeToken}, nil, nil)
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+
+	resumedOwned, err := NewTerminal(TerminalRequest{ResumeToken: owned.resumeToken}, nil, &SessionContext{user: "alice"})
+	c.Assert(err, IsNil)
+	c.Assert(resumedOwned, Equals, owned)
+
+	// A handler torn down for good retires its token: the session is no
+	// longer resumable and the registry does not retain the handler.
+	registerResumable(owned, time.Now())
+	c.Assert(owned.Close(), IsNil)
+	_, err = resumeSession(owned.resumeToken, time.Now())
+	c.Assert(trace.IsNotFound(err), Equals, true)
+
+	// The sweep reclaims entries whose grace period passed without the
+	// token ever being presented again.
+	registerResumable(term, time.Now())
+	sweepResumable(time.Now().Add(defaults.ResumeGracePeriod + time.Minute))
+	_, err = resumeSession(term.resumeToken, time.Now())
+	c.Assert(trace.IsNotFound(err), Equals, true)
+}
+
+func (s *WebSuite) TestJoinVersusCreate(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	existing := session.NewID()
+	provider := joinProviderMock{
+		authProviderMock: authProviderMock{server: node},
+		existing:         existing,
+	}
+
+	req := TerminalRequest{
+		Login:     "root",
+		Server:    "nodehostname",
+		SessionID: existing,
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}
+
+	// Connecting with a session ID the backend knows is a join.
+	term, err := NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.joined, Equals, true)
+	c.Assert(term.metadataFrame().Payload.Joined, Equals, true)
+
+	// A fresh session ID creates the session: the backend reporting it as
+	// not found must not be treated as an error.
+	req.SessionID = session.NewID()
+	term, err = NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.joined, Equals, false)
+	c.Assert(term.metadataFrame().Payload.Joined, Equals, false)
+}
+
+func (s *WebSuite) TestSingleNodeResolution(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	req := TerminalRequest{
+		Login:     "root",
+		Server:    "eca53e45-86a9-11e7-a893-0242ac0a0101",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}
+
+	// A UUID server name uses the single node lookup, the full node list
+	// is never pulled.
+	provider := &singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}
+	term, err := NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.hostName, Equals, "nodehostname")
+	c.Assert(provider.getNodeCalls, Equals, 1)
+	c.Assert(provider.getNodesCalls, Equals, 0)
+
+	// A hostname still resolves through the list scan.
+	req.Server = "nodehostname"
+	provider = &singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}
+	_, err = NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(provider.getNodeCalls, Equals, 0)
+	c.Assert(provider.getNodesCalls, Equals, 1)
+
+	// A UUID the backend does not know falls back to the list scan.
+	req.Server = "00000000-86a9-11e7-a893-0242ac0a0101"
+	provider = &singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}
+	_, err = NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(provider.getNodeCalls, Equals, 1)
+	c.Assert(provider.getNodesCalls, Equals, 1)
+}
+
+func (s *WebSuite) TestLabelNodeResolution(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	node.Metadata.Labels = map[string]string{"role": "db"}
+
+	req := TerminalRequest{
+		Login:     "root",
+		Server:    "labels:role=db",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}
+
+	// A capable backend matches the selector server-side, the full node
+	// list is never pulled.
+	provider := &labelNodeProviderMock{singleNodeProviderMock: singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}}
+	term, err := NewTerminal(req, provider, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.hostName, Equals, "nodehostname")
+	c.Assert(provider.getNodeByLabelsCalls, Equals, 1)
+	c.Assert(provider.getNodesCalls, Equals, 0)
+
+	// Without the capability the selector resolves through the list scan,
+	// with the identical result.
+	fallback := &singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}
+	term, err = NewTerminal(req, fallback, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.hostName, Equals, "nodehostname")
+	c.Assert(fallback.getNodesCalls, Equals, 1)
+
+	// A selector the backend cannot match falls back to the scan, which
+	// reports the miss the way it always has.
+	req.Server = "labels:role=cache"
+	provider = &labelNodeProviderMock{singleNodeProviderMock: singleNodeProviderMock{authProviderMock: authProviderMock{server: node}}}
+	_, err = NewTerminal(req, provider, nil)
+	c.Assert(err, NotNil)
+	c.Assert(provider.getNodeByLabelsCalls, Equals, 1)
+	c.Assert(provider.getNodesCalls >= 1, Equals, true)
+}
+
+func (s *WebSuite) TestDefaultPort(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	req := TerminalRequest{
+		Login:       "root",
+		Server:      "nodehostname",
+		SessionID:   session.NewID(),
+		Term:        session.TerminalParams{W: 100, H: 100},
+		Namespace:   defaults.Namespace,
+		DefaultPort: 2222,
+	}
+
+	// A server name without a port falls back to the requested default.
+	term, err := NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.hostPort, Equals, 2222)
+
+	// An explicit port in the server name wins over the default.
+	req.Server = "nodehostname:3022"
+	term, err = NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.hostPort, Equals, 3022)
+
+	// An out of range default is rejected.
+	req.DefaultPort = 70000
+	_, err = NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(err, ErrorMatches, ".*invalid port.*")
+}
+
+func (s *WebSuite) TestMetadataNodeInfo(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	node.Metadata.Labels = map[string]string{
+		"os":      "linux",
+		"arch":    "amd64",
+		"version": "2.7.0",
+	}
+
+	// The resolver hands back the matched node alongside host and port.
+	matched, host, port, err := resolveServer("nodehostname", []services.Server{&node})
+	c.Assert(err, IsNil)
+	c.Assert(host, Equals, "nodehostname")
+	c.Assert(port, Equals, 0)
+	c.Assert(matched, Equals, services.Server(&node))
+
+	// A plain address that matches no registered node resolves without one.
+	matched, _, _, err = resolveServer("10.0.0.1:3022", []services.Server{&node})
+	c.Assert(err, IsNil)
+	c.Assert(matched, IsNil)
+
+	// The node's platform labels surface in the metadata frame so the UI
+	// does not need a second lookup.
+	term, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "nodehostname",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	payload := term.metadataFrame().Payload
+	c.Assert(payload.NodeOS, Equals, "linux")
+	c.Assert(payload.NodeArch, Equals, "amd64")
+	c.Assert(payload.NodeVersion, Equals, "2.7.0")
+}
+
+func (s *WebSuite) TestOutputThrottle(c *C) {
+	// 40KB through a 20KB/s limit: the initial bucket covers the first
+	// 20KB, the rest has to wait roughly a second.
+	start := time.Now()
+	doneC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{MaxOutputBytesPerSec: 20000}}
+		term.outputThrottle = newOutputThrottle(20000)
+		conn := newWrappedSocket(ws, term)
+		buf := bytes.Repeat([]byte("a"), 10000)
+		for i := 0; i < 4; i++ {
+			_, err := conn.Write(buf)
+			if err != nil {
+				doneC <- err
+				return
+			}
+		}
+		doneC <- nil
+		ws.Close()
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	io.Copy(ioutil.Discard, ws)
+
+	c.Assert(<-doneC, IsNil)
+	elapsed := time.Since(start)
+	c.Assert(elapsed >= 750*time.Millisecond, Equals, true,
+		Commentf("throttled writes finished too fast: %v", elapsed))
+}
+
+func (s *WebSuite) TestTerminalMetrics(c *C) {
+	// Handlers from earlier tests release asynchronously after their
+	// websockets close, wait for the gauge to settle at zero first.
+	waitForZero := func(stage string) {
+		for i := 0; i < 100; i++ {
+			if gaugeValue(c, webTerminalActiveSessions) == 0 {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		c.Fatalf("active sessions gauge never returned to zero (%v)", stage)
+	}
+	waitForZero("before the session")
+
+	baselineBytes := counterValue(c, webTerminalBytesSent)
+	ws, err := s.makeTerminal(s.authPack(c, "metricsuser"))
+	c.Assert(err, IsNil)
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo metricsprobe\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "metricsprobe"), IsNil)
+
+	// While the session runs the active gauge is up and terminal output
+	// has been counted.
+	c.Assert(gaugeValue(c, webTerminalActiveSessions) >= 1.0, Equals, true)
+	c.Assert(counterValue(c, webTerminalBytesSent) > baselineBytes, Equals, true)
+
+	// Closing the websocket tears the handler down and the gauge returns
+	// to zero.
+	ws.Close()
+	waitForZero("after the session")
+}
+
+func (s *WebSuite) TestSessionHeartbeat(c *C) {
+	clock := clockwork.NewFakeClock()
+	sid := session.NewID()
+	termC := make(chan *TerminalHandler, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{
+			params:    TerminalRequest{HeartbeatInterval: time.Second},
+			sessionID: sid,
+		}
+		term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+		termC <- term
+		term.streamHeartbeat(term.terminalContext, clock, ws)
+		ws.Close()
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	term := <-termC
+
+	// Every elapsed interval produces one heartbeat carrying the session
+	// ID and a timestamp.
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		var e eventEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &e), IsNil)
+		c.Assert(e.Type, Equals, defaults.AuditEnvelopeType)
+		c.Assert(e.Payload.GetType(), Equals, events.SessionHeartbeatEvent)
+		c.Assert(e.Payload.GetString(events.SessionEventID), Equals, string(sid))
+	}
+
+	// Heartbeats stop when the terminal context is canceled.
+	term.terminalCancel()
+	var e eventEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &e), NotNil)
+}
+
+func (s *WebSuite) TestTerminalDimensionClamp(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	// Absurd initial dimensions are clamped to the defaults instead of
+	// being forwarded to the node verbatim.
+	term, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 65535, H: 65535},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.params.Term.W, Equals, defaults.MaxTerminalWidth)
+	c.Assert(term.params.Term.H, Equals, defaults.MaxTerminalHeight)
+
+	// An oversized resize request is clamped to the configured maxima
+	// before it is forwarded, in-range values pass through.
+	term = &TerminalHandler{params: TerminalRequest{MaxTermWidth: 200, MaxTermHeight: 100}}
+	params := session.TerminalParams{W: 65535, H: 50}
+	term.queueWindowChange(&params)
+	c.Assert(params.W, Equals, 200)
+	c.Assert(params.H, Equals, 50)
+}
+
+func (s *WebSuite) TestClassifySSHError(c *C) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		// Classified by trace error type.
+		{trace.AccessDenied("no access"), "access denied to the node, check your permissions and try again"},
+		{trace.ConnectionProblem(nil, "dial failed"), "the node is unreachable, it may be down or behind a firewall"},
+		// Classified by known substrings.
+		{fmt.Errorf("ssh: handshake failed: certificate has expired"), "your certificate has expired, log in again to refresh it"},
+		{fmt.Errorf("ssh: handshake failed: remote: no such user \"xyz\""), "the requested login does not exist on the node, try a different login"},
+		{fmt.Errorf("dial tcp 10.0.0.1:3022: connection refused"), "the node is unreachable, it may be down or behind a firewall"},
+		{fmt.Errorf("ssh: handshake failed: ssh: unable to authenticate"), "unable to authenticate to the node, log in again and retry"},
+		// Anything unrecognized is passed through unchanged.
+		{fmt.Errorf("something else entirely"), "something else entirely"},
+	}
+	for _, testCase := range testCases {
+		c.Assert(classifySSHError(testCase.err), Equals, testCase.expected, Commentf("%v", testCase.err))
+	}
+	c.Assert(classifySSHError(nil), Equals, "")
+}
+
+func (s *WebSuite) TestCheckHostKey(c *C) {
+	signer, err := ssh.ParsePrivateKey(fixtures.PEMBytes["ecdsa"])
+	c.Assert(err, IsNil)
+
+	// By default a plain host key (no certificate) aborts the connection.
+	term := &TerminalHandler{}
+	err = term.checkHostKey("node:22", nil, signer.PublicKey())
+	c.Assert(err, NotNil)
+
+	// Accepting unverified host keys has to be requested explicitly.
+	strict := false
+	term = &TerminalHandler{params: TerminalRequest{StrictHostKeyChecking: &strict}}
+	err = term.checkHostKey("node:22", nil, signer.PublicKey())
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestSessionNamespaceCheck(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	sid := session.NewID()
+	makeReq := func() TerminalRequest {
+		return TerminalRequest{
+			Login:          "root",
+			Server:         "localhost",
+			SessionID:      sid,
+			Term:           session.TerminalParams{W: 100, H: 100},
+			Namespace:      defaults.Namespace,
+			SessionTimeout: time.Second,
+		}
+	}
+
+	// A session record in the requested namespace joins cleanly.
+	provider := sessionProviderMock{
+		authProviderMock: authProviderMock{server: node},
+		session:          &session.Session{ID: sid, Namespace: defaults.Namespace},
+	}
+	_, err := NewTerminal(makeReq(), provider, nil)
+	c.Assert(err, IsNil)
+
+	// A session that lives in another namespace is rejected with a precise
+	// error instead of failing deep in the SSH layer.
+	provider.session = &session.Session{ID: sid, Namespace: "other"}
+	_, err = NewTerminal(makeReq(), provider, nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*belongs to namespace \"other\".*")
+
+	// A session the backend does not know yet is a create, no check.
+	provider.session = nil
+	_, err = NewTerminal(makeReq(), provider, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestHostKeyCallbackOption(c *C) {
+	signer, err := ssh.ParsePrivateKey(fixtures.PEMBytes["ecdsa"])
+	c.Assert(err, IsNil)
+
+	// Without an injected callback the built-in certificate check runs: a
+	// plain host key is rejected.
+	term := &TerminalHandler{}
+	c.Assert(term.hostKeyCheck()("node:22", nil, signer.PublicKey()), NotNil)
+
+	// An injected callback replaces the built-in check entirely and its
+	// verdict aborts the connection with its own message.
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	called := false
+	reject := func(host string, addr net.Addr, key ssh.PublicKey) error {
+		called = true
+		return trace.AccessDenied("host %v is not in the inventory", host)
+	}
+	injected, err := NewTerminal(TerminalRequest{
+		Login:          "root",
+		Server:         "localhost",
+		SessionID:      session.NewID(),
+		Term:           session.TerminalParams{W: 100, H: 100},
+		Namespace:      defaults.Namespace,
+		SessionTimeout: time.Second,
+	}, authProviderMock{server: node}, nil, WithHostKeyCallback(reject))
+	c.Assert(err, IsNil)
+	err = injected.hostKeyCheck()("node:22", nil, signer.PublicKey())
+	c.Assert(called, Equals, true)
+	c.Assert(err, ErrorMatches, ".*host node:22 is not in the inventory.*")
+
+	// An accepting policy admits a key the built-in check would reject.
+	accept := func(host string, addr net.Addr, key ssh.PublicKey) error { return nil }
+	WithHostKeyCallback(accept)(term)
+	c.Assert(term.hostKeyCheck()("node:22", nil, signer.PublicKey()), IsNil)
+}
+
+func (s *WebSuite) TestRecordingMode(c *C) {
+	signer, err := ssh.ParsePrivateKey(fixtures.PEMBytes["ecdsa"])
+	c.Assert(err, IsNil)
+	off := false
+
+	// Node recording, the default: a plain host key is rejected and the
+	// user's agent forwarding preference is honored.
+	term := &TerminalHandler{params: TerminalRequest{
+		RecordingMode: services.RecordAtNode,
+		ForwardAgent:  &off,
+	}}
+	c.Assert(term.checkHostKey("node:22", nil, signer.PublicKey()), NotNil)
+	c.Assert(term.forwardAgent(), Equals, false)
+
+	// Proxy recording: the in-path recording proxy verifies the node's
+	// host certificate itself and needs the agent to dial onward, so the
+	// presented key is accepted and forwarding is forced on.
+	term = &TerminalHandler{params: TerminalRequest{
+		RecordingMode: services.RecordAtProxy,
+		ForwardAgent:  &off,
+	}}
+	c.Assert(term.checkHostKey("proxy:3023", nil, signer.PublicKey()), IsNil)
+	c.Assert(term.forwardAgent(), Equals, true)
+
+	// An unknown mode is rejected at validation time.
+	_, err = NewTerminal(TerminalRequest{
+		Login:          s.user,
+		Server:         "localhost",
+		SessionID:      session.NewID(),
+		Term:           session.TerminalParams{W: 100, H: 100},
+		Namespace:      defaults.Namespace,
+		SessionTimeout: time.Second,
+		RecordingMode:  "tape",
+	}, authProviderMock{}, nil)
+	c.Assert(err, ErrorMatches, ".*recording_mode.*")
+}
+
+func (s *WebSuite) TestKeepAlive(c *C) {
+	// Pongs reset the missed ping counter.
+	var keepAlive terminalKeepAlive
+	c.Assert(keepAlive.pingSent(), Equals, 1)
+	c.Assert(keepAlive.pingSent(), Equals, 2)
+	keepAlive.pongReceived()
+	c.Assert(keepAlive.pingSent(), Equals, 1)
+
+	// A client that never replies to pings has its session torn down.
+	done := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{KeepAliveInterval: 5 * time.Millisecond}}
+		term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+		term.streamKeepAlive(ws)
+		<-term.terminalContext.Done()
+		close(done)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timeout waiting for keepalive teardown")
+	}
+}
+
+func (s *WebSuite) TestKeepAliveJitter(c *C) {
+	interval := 10 * time.Second
+	jitter := 0.2
+	low := time.Duration(float64(interval) * (1 - jitter))
+	high := time.Duration(float64(interval) * (1 + jitter))
+
+	// Successive intervals stay inside the jitter band but do not repeat:
+	// the whole point is that sessions drift apart over time.
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		d := jitteredInterval(interval, jitter)
+		if d < low || d > high {
+			c.Fatalf("interval %v outside jitter band [%v, %v]", d, low, high)
+		}
+		seen[d] = true
+	}
+	c.Assert(len(seen) > 1, Equals, true)
+
+	// Zero jitter keeps the fixed cadence.
+	c.Assert(jitteredInterval(interval, 0), Equals, interval)
+}
+
+func (s *WebSuite) TestPongTimeout(c *C) {
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Continuous output refreshes the idle watcher: a silent user running
+	// a noisy command survives past the idle timeout.
+	fakeClock := clockwork.NewFakeClock()
+	idleCh := make(chan struct{})
+	watcher := newIdleWatcher(fakeClock, time.Minute, func() { close(idleCh) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.watch(ctx)
+
+	term := &TerminalHandler{params: TerminalRequest{BinaryProtocol: true}}
+	term.idleWatcher = watcher
+	sock := newWrappedSocket(ws, term)
+
+	for i := 0; i < 3; i++ {
+		fakeClock.BlockUntil(1)
+		fakeClock.Advance(45 * time.Second)
+		_, err = sock.Write([]byte("output"))
+		c.Assert(err, IsNil)
+	}
+	select {
+	case <-idleCh:
+		c.Fatalf("idle timeout fired despite flowing output")
+	default:
+	}
+
+	// The pong deadline judges network liveness on its own: when pongs
+	// stop the session dies even though output could still flow.
+	dead := &TerminalHandler{params: TerminalRequest{
+		KeepAliveInterval: 5 * time.Millisecond,
+		PongTimeout:       20 * time.Millisecond,
+	}}
+	dead.terminalContext, dead.terminalCancel = context.WithCancel(context.Background())
+	go dead.streamKeepAlive(ws)
+
+	select {
+	case <-dead.terminalContext.Done():
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timeout waiting for pong deadline teardown")
+	}
+}
+
+func (s *WebSuite) TestWrappedSocketEmptyFrame(c *C) {
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		// An empty frame followed by one that carries data.
+		websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType})
+		websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: []byte("data")})
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The empty frame is skipped: the first Read already returns the data
+	// of the second frame instead of a zero byte count.
+	conn := newWrappedSocket(ws, nil)
+	out := make([]byte, 10)
+	n, err := conn.Read(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(out[:n]), Equals, "data")
+}
+
+func (s *WebSuite) TestOnCloseCallback(c *C) {
+	var calls []CloseInfo
+	term := &TerminalHandler{}
+	term.SetOnClose(func(info CloseInfo) { calls = append(calls, info) })
+	term.startTime = time.Now().Add(-time.Minute)
+	term.wrappedSock = &wrappedSocket{written: 42}
+
+	// Only the first teardown path gets to report, later ones are ignored.
+	term.fireClose("node disconnected", false)
+	term.fireClose("session ended", true)
+
+	c.Assert(calls, HasLen, 1)
+	c.Assert(calls[0].Reason, Equals, "node disconnected")
+	c.Assert(calls[0].CleanExit, Equals, false)
+	c.Assert(calls[0].ExitStatus, Equals, -1)
+	c.Assert(calls[0].BytesTransferred, Equals, int64(42))
+	c.Assert(calls[0].Duration >= time.Minute, Equals, true)
+
+	// Close is one of the teardown paths.
+	calls = nil
+	term = &TerminalHandler{}
+	term.SetOnClose(func(info CloseInfo) { calls = append(calls, info) })
+	term.Close()
+	c.Assert(calls, HasLen, 1)
+	c.Assert(calls[0].Reason, Equals, "connection closed")
+}
+
+func (s *WebSuite) TestCurrentLatency(c *C) {
+	// Nothing measured yet.
+	term := &TerminalHandler{}
+	c.Assert(term.currentLatency(), Equals, time.Duration(-1))
+
+	// A pong that matches a ping yields a measurement.
+	term.keepAlive.pingSent()
+	time.Sleep(5 * time.Millisecond)
+	term.keepAlive.pongReceived()
+	c.Assert(term.currentLatency() >= 5*time.Millisecond, Equals, true)
+}
+
+func (s *WebSuite) TestIdleWatcher(c *C) {
+	fakeClock := clockwork.NewFakeClock()
+	idleCh := make(chan struct{})
+	watcher := newIdleWatcher(fakeClock, time.Minute, func() { close(idleCh) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.watch(ctx)
+
+	// Activity before the deadline pushes it out.
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(30 * time.Second)
+	watcher.activity()
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(45 * time.Second)
+	select {
+	case <-idleCh:
+		c.Fatalf("idle timeout fired despite activity")
+	default:
+	}
+
+	// A full minute of silence closes the session.
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Minute)
+	select {
+	case <-idleCh:
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for idle timeout to fire")
+	}
+}
+
+func (s *WebSuite) TestBinaryDirectionNegotiation(c *C) {
+	boolPtr := func(v bool) *bool { return &v }
+	ws := &websocket.Conn{}
+
+	testCases := []struct {
+		req         TerminalRequest
+		binaryWrite bool
+		binaryRead  bool
+	}{
+		// Without overrides both directions follow BinaryProtocol.
+		{req: TerminalRequest{}, binaryWrite: false, binaryRead: false},
+		{req: TerminalRequest{BinaryProtocol: true}, binaryWrite: true, binaryRead: true},
+		// Each direction can be overridden independently.
+		{req: TerminalRequest{BinaryOutput: boolPtr(true)}, binaryWrite: true, binaryRead: false},
+		{req: TerminalRequest{BinaryProtocol: true, BinaryInput: boolPtr(false)}, binaryWrite: true, binaryRead: false},
+		{req: TerminalRequest{BinaryInput: boolPtr(true)}, binaryWrite: false, binaryRead: true},
+		{req: TerminalRequest{BinaryProtocol: true, BinaryOutput: boolPtr(false)}, binaryWrite: false, binaryRead: true},
+	}
+
+	for _, testCase := range testCases {
+		conn := newWrappedSocket(ws, &TerminalHandler{params: testCase.req})
+		c.Assert(conn.binaryWrite, Equals, testCase.binaryWrite)
+		c.Assert(conn.binaryRead, Equals, testCase.binaryRead)
+	}
+}
+
+func (s *WebSuite) TestForwardAgentToggle(c *C) {
+	boolPtr := func(v bool) *bool { return &v }
+
+	testCases := []struct {
+		req      TerminalRequest
+		forwards bool
+	}{
+		// Unset keeps the historical default of forwarding the agent.
+		{req: TerminalRequest{}, forwards: true},
+		{req: TerminalRequest{ForwardAgent: boolPtr(true)}, forwards: true},
+		{req: TerminalRequest{ForwardAgent: boolPtr(false)}, forwards: false},
+	}
+
+	for _, testCase := range testCases {
+		term := &TerminalHandler{params: testCase.req}
+		c.Assert(term.forwardAgent(), Equals, testCase.forwards)
+	}
+
+	// With forwarding disabled the agent is still used locally to
+	// authenticate, so the session comes up and runs commands as usual.
+	pack := s.authPack(c, "noforward")
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:      session.NewID(),
+		SessionTimeout: 500 * time.Millisecond,
+		ForwardAgent:   boolPtr(false),
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo off=$((5+5))\r\n")
+	c.Assert(err, IsNil)
+	err = s.waitForOutput(term, "off=10")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestPinnedProxy(c *C) {
+	h := s.webHandler.handler
+
+	// Malformed addresses and unknown proxies are rejected up front.
+	c.Assert(h.validateProxyHostPort("not-an-address"), NotNil)
+	c.Assert(h.validateProxyHostPort("proxy.example.com:3080,ssh"), NotNil)
+	c.Assert(h.validateProxyHostPort("proxy.example.com:3080,3023"), NotNil)
+
+	// The proxy serving the request is always valid.
+	c.Assert(h.validateProxyHostPort(h.ProxyHostPort()), IsNil)
+
+	// Register a proxy reachable under another name for this host, as a
+	// geo-distributed deployment would, advertising the ports the handler
+	// actually serves.
+	defaultAddr := h.ProxyHostPort()
+	idx := strings.LastIndex(defaultAddr, ",")
+	sshPort := defaultAddr[idx+1:]
+	_, webPort, err := net.SplitHostPort(defaultAddr[:idx])
+	c.Assert(err, IsNil)
+
+	proxy := &services.ServerV2{
+		Kind:    services.KindProxy,
+		Version: services.V2,
+		Metadata: services.Metadata{
+			Name:      "proxy-pinned",
+			Namespace: defaults.Namespace,
+		},
+		Spec: services.ServerSpecV2{
+			Addr:       "localhost:" + sshPort,
+			PublicAddr: "localhost:" + webPort,
+		},
+	}
+	c.Assert(s.proxyClient.UpsertProxy(proxy), IsNil)
+
+	// Pin the registered name: same host as the default, spelled the way
+	// the registered proxy advertises it.
+	pinned := strings.Replace(defaultAddr, "127.0.0.1", "localhost", 1)
+	c.Assert(pinned, Not(Equals), defaultAddr)
+	c.Assert(h.validateProxyHostPort(pinned), IsNil)
+
+	// The registered host with ports of the client's choosing is refused:
+	// only the ports the proxy advertises may be dialed.
+	c.Assert(h.validateProxyHostPort("localhost:"+webPort+",2222"), NotNil)
+	c.Assert(h.validateProxyHostPort("localhost:9999,"+sshPort), NotNil)
+
+	// An unknown proxy is rejected at the connect endpoint.
+	pack := s.authPack(c, "pinned")
+	_, err = s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:     session.NewID(),
+		ProxyHostPort: "evil.example.com:3080,3023",
+	})
+	c.Assert(err, NotNil)
+
+	// The pinned proxy is accepted and the session works through it.
+	sid := session.NewID()
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:      sid,
+		SessionTimeout: 500 * time.Millisecond,
+		ProxyHostPort:  pinned,
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo pinned=$((6+6))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "pinned=12"), IsNil)
+
+	// The chosen proxy made it into the client config, not the default.
+	activeSessions.Lock()
+	handlers := activeSessions.handlers[sid]
+	activeSessions.Unlock()
+	c.Assert(len(handlers), Equals, 1)
+	c.Assert(handlers[0].teleportClient.Config.ProxyHostPort, Equals, pinned)
+}
+
+func (s *WebSuite) TestCharsetRoundTrip(c *C) {
+	// Charsets without a vendored encoding are rejected up front.
+	_, err := lookupCharset("shift-jis")
+	c.Assert(err, NotNil)
+
+	// "こんにちは" in UTF-16LE, as a node configured for that charset
+	// would emit it.
+	utf16Hello := []byte{0x53, 0x30, 0x93, 0x30, 0x6b, 0x30, 0x61, 0x30, 0x6f, 0x30}
+
+	enc, err := lookupCharset("utf-16le")
+	c.Assert(err, IsNil)
+
+	inputC := make(chan []byte, 1)
+	errC := make(chan error, 2)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{charset: enc}
+		sock := newWrappedSocket(ws, term)
+
+		// Node output goes out converted to UTF-8.
+		_, err := sock.Write(utf16Hello)
+		errC <- err
+
+		// Browser input comes back converted to the node charset.
+		buf := make([]byte, 64)
+		n, err := sock.Read(buf)
+		errC <- err
+		inputC <- buf[:n]
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	var re rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+	c.Assert(string(re.Payload), Equals, "こんにちは")
+
+	c.Assert(websocket.JSON.Send(ws, rawEnvelope{
+		Type:    defaults.RawEnvelopeType,
+		Payload: []byte("こんにちは"),
+	}), IsNil)
+
+	c.Assert(<-errC, IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(<-inputC, DeepEquals, utf16Hello)
+}
+
+func (s *WebSuite) TestWithCharset(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	req := TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}
+
+	// Without the option the handler stores the encoding named by the
+	// request, UTF-8 by default.
+	term, err := NewTerminal(req, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.charset, Equals, unicode.UTF8)
+
+	// An injected encoding wins over the request charset.
+	custom := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	term, err = NewTerminal(req, authProviderMock{server: node}, nil, WithCharset(custom))
+	c.Assert(err, IsNil)
+	c.Assert(term.charset, Equals, custom)
+
+	// The wrapped socket derives its encoder and decoder from the stored
+	// encoding, so both layers agree on the injected transform.
+	done := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		<-done
+	}})
+	defer srv.Close()
+	defer close(done)
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	sock := newWrappedSocket(ws, term)
+	out, err := sock.encoder.Bytes([]byte("A"))
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, []byte{0x41, 0x00})
+	in, err := sock.decoder.Bytes([]byte{0x41, 0x00})
+	c.Assert(err, IsNil)
+	c.Assert(in, DeepEquals, []byte("A"))
+}
+
+func (s *WebSuite) TestEventBufferOverflow(c *C) {
+	ring := newEventRing(4)
+
+	// A fast source with no sender draining: lifecycle events survive the
+	// overflow, old print events are dropped and counted.
+	ring.push(events.EventFields{events.EventType: events.SessionStartEvent})
+	for i := 0; i < 10; i++ {
+		ring.push(events.EventFields{events.EventType: events.SessionPrintEvent})
+	}
+	ring.push(events.EventFields{events.EventType: events.SessionEndEvent})
+
+	var types []string
+	totalDropped := 0
+	for {
+		event, dropped, ok := ring.pop()
+		if !ok {
+			break
+		}
+		totalDropped += dropped
+		types = append(types, event.GetType())
+	}
+
+	c.Assert(len(types), Equals, 4)
+	c.Assert(types[0], Equals, events.SessionStartEvent)
+	c.Assert(types[len(types)-1], Equals, events.SessionEndEvent)
+	// Nothing was lost silently: every dropped event was counted.
+	c.Assert(totalDropped+len(types), Equals, 12)
+}
+
+func (s *WebSuite) TestCloseBeforeServe(c *C) {
+	// The SessionContext can close its closers before handler ever ran:
+	// no websocket, no SSH session, no terminal context. None of that may
+	// panic.
+	term := &TerminalHandler{params: TerminalRequest{}}
+	c.Assert(term.Close(), IsNil)
+
+	// Repeated closes from the other teardown paths are no-ops.
+	c.Assert(term.Close(), IsNil)
+	c.Assert(term.Close(), IsNil)
+}
+
+func (s *WebSuite) TestRecordToPath(c *C) {
+	// Transcripts are rejected while no recording directory is set.
+	_, err := resolveRecordingPath("transcript.log")
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+
+	WebRecordingDir = c.MkDir()
+	defer func() { WebRecordingDir = "" }()
+
+	// Names escaping the directory are rejected.
+	_, err = resolveRecordingPath("../escape.log")
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+	_, err = resolveRecordingPath("/etc/passwd")
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+
+	pack := s.authPack(c, "recorded")
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:      session.NewID(),
+		SessionTimeout: 500 * time.Millisecond,
+		RecordToPath:   "transcript.log",
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo rec=$((21+21))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "rec=42"), IsNil)
+	ws.Close()
+
+	// The transcript is flushed on teardown: poll until a complete file
+	// with the expected records shows up. A read racing the final flush
+	// may see a partial last line, so parse failures just mean try again.
+	path := filepath.Join(WebRecordingDir, "transcript.log")
+	deadline := time.Now().Add(10 * time.Second)
+	var sizes []string
+	for {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+
+		var output []byte
+		sizes = nil
+		lastMS := 0
+		parsed := true
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			parsed = false
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+			if !parsed || line == "" {
+				continue
+			}
+			var fields events.EventFields
+			if json.Unmarshal([]byte(line), &fields) != nil {
+				parsed = false
+				continue
+			}
+			// Every record carries a monotonic millisecond offset.
+			ms := fields.GetInt(events.SessionEventTimestamp)
+			if ms < lastMS {
+				parsed = false
+				continue
+			}
+			lastMS = ms
+			switch fields.GetType() {
+			case events.SessionPrintEvent:
+				data, err := base64.StdEncoding.DecodeString(fields.GetString("data"))
+				c.Assert(err, IsNil)
+				output = append(output, data...)
+			case events.ResizeEvent:
+				sizes = append(sizes, fields.GetString(events.TerminalSize))
+			}
+		}
+		if parsed && len(sizes) > 0 && strings.Contains(removeSpace(string(output)), "rec=42") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The initial window change was recorded with the requested geometry.
+	c.Assert(sizes[0], Equals, "100:100")
+}
+
+func (s *WebSuite) TestStderrTagging(c *C) {
+	// Command mode wires stderr through a tagging view of the same socket,
+	// so a command writing to stderr reaches the browser in frames it can
+	// highlight apart from stdout.
+	for _, binary := range []bool{true, false} {
+		params := TerminalRequest{BinaryProtocol: binary}
+		errC := make(chan error, 2)
+		srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+			sock := newWrappedSocket(ws, &TerminalHandler{params: params})
+			_, err := sock.Write([]byte("regular output"))
+			errC <- err
+			_, err = stderrSocket{sock}.Write([]byte("command failed"))
+			errC <- err
+		}})
+
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+		c.Assert(err, IsNil)
+
+		if binary {
+			var frame []byte
+			c.Assert(websocket.Message.Receive(ws, &frame), IsNil)
+			prefix, payload, err := decodeBinaryFrame(frame)
+			c.Assert(err, IsNil)
+			c.Assert(prefix, Equals, defaults.RawWebsocketPrefix)
+			c.Assert(string(payload), Equals, "regular output")
+
+			c.Assert(websocket.Message.Receive(ws, &frame), IsNil)
+			prefix, payload, err = decodeBinaryFrame(frame)
+			c.Assert(err, IsNil)
+			c.Assert(prefix, Equals, defaults.StderrWebsocketPrefix)
+			c.Assert(string(payload), Equals, "command failed")
+		} else {
+			var re rawEnvelope
+			c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+			c.Assert(re.Type, Equals, defaults.RawEnvelopeType)
+			c.Assert(string(re.Payload), Equals, "regular output")
+
+			c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+			c.Assert(re.Type, Equals, defaults.StderrEnvelopeType)
+			c.Assert(string(re.Payload), Equals, "command failed")
+		}
+
+		c.Assert(<-errC, IsNil)
+		c.Assert(<-errC, IsNil)
+		ws.Close()
+		srv.Close()
+	}
+}
+
+// scriptedConn is a messageConn replaying fixed frames, used to drive the
+// framing logic without a websocket.
+type scriptedConn struct {
+	frames [][]byte
+}
+
+func (c *scriptedConn) Send(v interface{}) error { return nil }
+
+func (c *scriptedConn) Receive(v interface{}) error {
+	if len(c.frames) == 0 {
+		return io.EOF
+	}
+	frame := c.frames[0]
+	c.frames = c.frames[1:]
+	if out, ok := v.(*[]byte); ok {
+		*out = frame
+		return nil
+	}
+	return json.Unmarshal(frame, v)
+}
+
+func (c *scriptedConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *scriptedConn) Close() error { return nil }
+
+// stuckConn is a messageConn whose sends block until released, standing in
+// for a browser that stopped draining its connection.
+type stuckConn struct {
+	release chan struct{}
+}
+
+func (c *stuckConn) Send(v interface{}) error {
+	<-c.release
+	return nil
+}
+
+func (c *stuckConn) Receive(v interface{}) error {
+	<-c.release
+	return io.EOF
+}
+
+func (c *stuckConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *stuckConn) Close() error { return nil }
+
+func (s *WebSuite) TestOutputBacklog(c *C) {
+	baseline := counterValue(c, webTerminalSlowClientWarnings)
+	conn := &stuckConn{release: make(chan struct{})}
+	term := &TerminalHandler{params: TerminalRequest{BinaryProtocol: true}}
+	sock := newWrappedSocketConn(conn, term)
+	term.wrappedSock = sock
+
+	// Writers pile up against a connection nobody drains: each parks in a
+	// blocked send and the watermark climbs past the warn threshold.
+	chunk := make([]byte, defaults.OutputBacklogWarnBytes/2+1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sock.Write(chunk)
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for term.outputBacklog() < 4*len(chunk) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Assert(term.outputBacklog(), Equals, 4*len(chunk))
+
+	// The backlog crossed the threshold more than once but the warning is
+	// rate limited to a single log line.
+	c.Assert(counterValue(c, webTerminalSlowClientWarnings)-baseline, Equals, 1.0)
+
+	// Once the client drains, nothing is pending anymore but the
+	// high-water mark keeps the worst case on record.
+	close(conn.release)
+	wg.Wait()
+	c.Assert(atomic.LoadInt64(&sock.pending), Equals, int64(0))
+	c.Assert(term.outputBacklog(), Equals, 4*len(chunk))
+}
+
+// captureConn is a messageConn recording the binary frames sent through it.
+type captureConn struct {
+	sent [][]byte
+}
+
+func (c *captureConn) Send(v interface{}) error {
+	if frame, ok := v.([]byte); ok {
+		c.sent = append(c.sent, append([]byte{}, frame...))
+	}
+	return nil
+}
+
+func (c *captureConn) Receive(v interface{}) error { return io.EOF }
+
+func (c *captureConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *captureConn) Close() error { return nil }
+
+// rawFrames decodes the captured binary frames, keeping only raw output
+// payloads.
+func (c *captureConn) rawFrames() []string {
+	var out []string
+	for _, frame := range c.sent {
+		prefix, payload, err := decodeBinaryFrame(frame)
+		if err != nil || prefix != defaults.RawWebsocketPrefix {
+			continue
+		}
+		out = append(out, string(payload))
+	}
+	return out
+}
+
+func (s *WebSuite) TestStripBOM(c *C) {
+	bom := "\xef\xbb\xbf"
+	newSock := func(strip bool) (*wrappedSocket, *captureConn) {
+		conn := &captureConn{}
+		term := &TerminalHandler{params: TerminalRequest{BinaryProtocol: true, StripBOM: strip}}
+		return newWrappedSocketConn(conn, term), conn
+	}
+
+	// A leading BOM is stripped exactly once: a later one is program
+	// output and passes through.
+	sock, conn := newSock(true)
+	n, err := sock.Write([]byte(bom + "hello"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(bom)+5)
+	_, err = sock.Write([]byte(bom + "world"))
+	c.Assert(err, IsNil)
+	c.Assert(conn.rawFrames(), DeepEquals, []string{"hello", bom + "world"})
+
+	// A BOM split across frames is still recognized.
+	sock, conn = newSock(true)
+	_, err = sock.Write([]byte(bom[:1]))
+	c.Assert(err, IsNil)
+	_, err = sock.Write([]byte(bom[1:] + "hi"))
+	c.Assert(err, IsNil)
+	c.Assert(conn.rawFrames(), DeepEquals, []string{"hi"})
+
+	// Bytes that merely start like a BOM are not lost: once the match
+	// fails the withheld prefix is re-emitted in front of the data.
+	sock, conn = newSock(true)
+	_, err = sock.Write([]byte(bom[:2]))
+	c.Assert(err, IsNil)
+	_, err = sock.Write([]byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(conn.rawFrames(), DeepEquals, []string{bom[:2] + "x"})
+
+	// Default off: the BOM reaches the client untouched.
+	sock, conn = newSock(false)
+	_, err = sock.Write([]byte(bom + "hello"))
+	c.Assert(err, IsNil)
+	c.Assert(conn.rawFrames(), DeepEquals, []string{bom + "hello"})
+}
+
+// FuzzWrappedSocketRead feeds arbitrary frames through the framing layer
+// looking for panics: Read must either hand out bytes or fail with an
+// error, whatever the client sends.
+func FuzzWrappedSocketRead(f *testing.F) {
+	f.Add([]byte(`{"t":"r","p":"aGk="}`), false)
+	f.Add([]byte(`{"t":"k","p":"SIGINT"}`), false)
+	f.Add([]byte(`{"t":"zzz"}`), false)
+	f.Add([]byte(`not json`), false)
+	f.Add([]byte{}, true)
+	f.Add([]byte{defaults.RawWebsocketPrefix, 'h', 'i'}, true)
+	f.Add([]byte{defaults.RawWebsocketPrefix}, true)
+	f.Add([]byte{defaults.ResizeWebsocketPrefix, '8', '0', ':', '2', '5'}, true)
+	f.Fuzz(func(t *testing.T, frame []byte, binary bool) {
+		var term *TerminalHandler
+		if binary {
+			term = &TerminalHandler{params: TerminalRequest{BinaryProtocol: true}}
+		}
+		sock := newWrappedSocketConn(&scriptedConn{frames: [][]byte{frame}}, term)
+		buf := make([]byte, 64)
+		for i := 0; i < 8; i++ {
+			if _, err := sock.Read(buf); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func (s *WebSuite) TestSubsystem(c *C) {
+	// A subsystem replaces the shell or command, never both.
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+	_, err := NewTerminal(TerminalRequest{
+		Login:              "root",
+		Server:             "localhost",
+		SessionID:          session.NewID(),
+		Term:               session.TerminalParams{W: 100, H: 100},
+		Namespace:          defaults.Namespace,
+		Subsystem:          "proxysites",
+		InteractiveCommand: []string{"ls"},
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, ErrorMatches, ".*mutually exclusive.*")
+
+	// End to end: the proxy's own SSH server serves the "proxysites"
+	// subsystem, which writes the cluster list as JSON and exits. Getting
+	// that JSON back proves the named subsystem ran instead of a shell: no
+	// PTY is allocated, so there is no prompt, just the subsystem output.
+	pack := s.authPack(c, "subsys")
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server:    s.proxy.Addr(),
+		Login:     s.user,
+		Term:      session.TerminalParams{W: 100, H: 100},
+		SessionID: session.NewID(),
+		Subsystem: "proxysites",
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	c.Assert(s.waitForOutput(term, `"name"`), IsNil)
+}
+
+func (s *WebSuite) TestDetectBell(c *C) {
+	written := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{DetectBell: true}}
+		sock := newWrappedSocket(ws, term)
+		_, err := sock.Write([]byte("ding\aDONE"))
+		written <- err
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The raw output arrives untouched, BEL byte included.
+	var re rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+	c.Assert(re.Type, Equals, defaults.RawEnvelopeType)
+	c.Assert(string(re.Payload), Equals, "ding\aDONE")
+
+	// The bell notification rides alongside it.
+	var be rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &be), IsNil)
+	c.Assert(be.Type, Equals, defaults.BellEnvelopeType)
+
+	c.Assert(<-written, IsNil)
+}
+
+func (s *WebSuite) TestJoinNotice(c *C) {
+	sid := session.NewID()
+	pack := s.authPack(c, "joinnotice")
+
+	ws1, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws1.Close()
+
+	// Wait until the session is live before the second party joins.
+	term1 := newWrappedSocket(ws1, nil)
+	_, err = io.WriteString(term1, "echo up=$((20+3))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term1, "up=23"), IsNil)
+
+	ws2, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	// The first party is told who joined, in a notice frame tagged apart
+	// from terminal output.
+	for i := 0; ; i++ {
+		c.Assert(i < 100, Equals, true)
+
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws1, &ue), IsNil)
+		if ue.Type != defaults.NoticeEnvelopeType {
+			continue
+		}
+
+		var re rawEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &re), IsNil)
+		c.Assert(string(re.Payload), Equals, "joinnotice joined the session")
+		break
+	}
+}
+
+// signalRecorderMock records the signals delivered to the shell session.
+type signalRecorderMock struct {
+	signals chan ssh.Signal
+}
+
+func (m *signalRecorderMock) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (m *signalRecorderMock) Signal(sig ssh.Signal) error {
+	m.signals <- sig
+	return nil
+}
+
+func (m *signalRecorderMock) Close() error { return nil }
+
+func (s *WebSuite) TestSignalFrame(c *C) {
+	// Signals SSH can not deliver are rejected.
+	_, err := parseSignal("SIGSTOP")
+	c.Assert(err, NotNil)
+	_, err = parseSignal("")
+	c.Assert(err, NotNil)
+
+	// Client supplied spellings are normalized to the SSH signal name.
+	for _, name := range []string{"INT", "SIGINT", "sigint", " int "} {
+		sig, err := parseSignal(name)
+		c.Assert(err, IsNil)
+		c.Assert(sig, Equals, ssh.SIGINT)
+	}
+
+	// A SIGINT frame from the browser ends up as a Signal call on the
+	// SSH session, over both protocols.
+	for _, binary := range []bool{true, false} {
+		mock := &signalRecorderMock{signals: make(chan ssh.Signal, 1)}
+		term := &TerminalHandler{params: TerminalRequest{BinaryProtocol: binary}}
+		term.sshSession = mock
+
+		done := make(chan struct{})
+		srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+			sock := newWrappedSocket(ws, term)
+			buf := make([]byte, 64)
+			sock.Read(buf)
+			<-done
+		}})
+
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+		c.Assert(err, IsNil)
+
+		if binary {
+			c.Assert(websocket.Message.Send(ws, encodeBinaryFrame(defaults.SignalWebsocketPrefix, []byte("SIGINT"))), IsNil)
+		} else {
+			c.Assert(websocket.JSON.Send(ws, signalEnvelope{
+				Type:    defaults.SignalEnvelopeType,
+				Payload: "SIGINT",
+			}), IsNil)
+		}
+
+		select {
+		case sig := <-mock.signals:
+			c.Assert(sig, Equals, ssh.SIGINT)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("signal never reached the session")
+		}
+
+		close(done)
+		ws.Close()
+		srv.Close()
+	}
+}
+
+// endEventProviderMock emits a single session end event, so tests can
+// drive the audit-end teardown path.
+type endEventProviderMock struct {
+	authProviderMock
+}
+
+func (mock endEventProviderMock) GetSessionEvents(n string, s session.ID, c int, p bool) ([]events.EventFields, error) {
+	if c > 0 {
+		return nil, trace.NotFound("no more events")
+	}
+	return []events.EventFields{{
+		events.EventType:   events.SessionEndEvent,
+		events.EventCursor: 1,
+	}}, nil
+}
+
+func (s *WebSuite) TestEndOn(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	// Unknown modes are rejected, empty keeps the historical default.
+	_, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+		EndOn:     "on-tuesdays",
+	}, authProviderMock{server: node}, nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+
+	term, err := NewTerminal(TerminalRequest{
+		Login:     "root",
+		Server:    "localhost",
+		SessionID: session.NewID(),
+		Term:      session.TerminalParams{W: 100, H: 100},
+		Namespace: defaults.Namespace,
+	}, authProviderMock{server: node}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(term.params.EndOn, Equals, endOnBoth)
+
+	newTerm := func(endOn string, timeout time.Duration) *TerminalHandler {
+		t := &TerminalHandler{
+			params:         TerminalRequest{EndOn: endOn},
+			sessionTimeout: timeout,
+		}
+		t.terminalContext, t.terminalCancel = context.WithCancel(context.Background())
+		t.eventContext, t.eventCancel = context.WithCancel(context.Background())
+		return t
+	}
+	wait := func(t *TerminalHandler) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			t.waitForEnd()
+			close(done)
+		}()
+		return done
+	}
+	assertDone := func(done chan struct{}, what string) {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			c.Fatalf("%v did not tear down", what)
+		}
+	}
+
+	// ssh-exit: the SSH connection returning is enough, the event stream
+	// is stopped instead of waited for.
+	sshExitTerm := newTerm(endOnSSHExit, time.Hour)
+	done := wait(sshExitTerm)
+	sshExitTerm.terminalCancel()
+	assertDone(done, "ssh-exit session")
+	select {
+	case <-sshExitTerm.eventContext.Done():
+	default:
+		c.Fatalf("event stream was not stopped")
+	}
+
+	// both: without an end event the teardown happens once the timeout
+	// after SSH exit expires.
+	bothTerm := newTerm(endOnBoth, 100*time.Millisecond)
+	done = wait(bothTerm)
+	bothTerm.terminalCancel()
+	assertDone(done, "both session")
+
+	// audit-end: the end event, emitted by the provider through the event
+	// stream, tears the session down even though the SSH connection never
+	// returned.
+	auditTerm := newTerm(endOnAuditEnd, time.Hour)
+	auditTerm.authProvider = endEventProviderMock{}
+	auditTerm.namespace = defaults.Namespace
+	auditTerm.sessionID = session.NewID()
+
+	endedC := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		go auditTerm.streamEvents(ws, &client.TeleportClient{})
+		auditTerm.waitForEnd()
+		close(endedC)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Drain frames so the event send never blocks.
+	go io.Copy(ioutil.Discard, ws)
+
+	assertDone(endedC, "audit-end session")
+
+	// The SSH side is asked to stop as well.
+	select {
+	case <-auditTerm.terminalContext.Done():
+	default:
+		c.Fatalf("terminal context was not canceled")
+	}
+
+	// audit-end with a session that never produces an end event: once the
+	// SSH connection has returned, the session timeout bounds the wait and
+	// the client is told why the session was torn down.
+	hungTerm := newTerm(endOnAuditEnd, 100*time.Millisecond)
+	hungEndedC := make(chan struct{})
+	hungSrv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		hungTerm.wrappedSock = newWrappedSocket(ws, hungTerm)
+		hungTerm.terminalCancel()
+		hungTerm.waitForEnd()
+		close(hungEndedC)
+	}})
+	defer hungSrv.Close()
+
+	hungWs, err := websocket.Dial(strings.Replace(hungSrv.URL, "http:", "ws:", 1), "", hungSrv.URL)
+	c.Assert(err, IsNil)
+	defer hungWs.Close()
+
+	assertDone(hungEndedC, "hung audit-end session")
+
+	c.Assert(hungWs.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	for i := 0; ; i++ {
+		c.Assert(i < 100, Equals, true)
+
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(hungWs, &ue), IsNil)
+		if ue.Type != defaults.NoticeEnvelopeType {
+			continue
+		}
+
+		var re rawEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &re), IsNil)
+		c.Assert(string(re.Payload), Equals, "timed out waiting for the session end event")
+		break
+	}
+}
+
+// eventsOnlyProviderMock serves a short event stream ending with the
+// session end event and counts how often it was polled.
+type eventsOnlyProviderMock struct {
+	authProviderMock
+	polls *int32
+}
+
+func (mock eventsOnlyProviderMock) GetSessionEvents(n string, s session.ID, c int, p bool) ([]events.EventFields, error) {
+	atomic.AddInt32(mock.polls, 1)
+	if c > 0 {
+		return nil, trace.NotFound("no more events")
+	}
+	return []events.EventFields{
+		{
+			events.EventType:   events.SessionStartEvent,
+			events.EventCursor: 1,
+		},
+		{
+			events.EventType:   events.SessionEndEvent,
+			events.EventCursor: 2,
+		},
+	}, nil
+}
+
+func (s *WebSuite) TestEventsOnly(c *C) {
+	node := services.ServerV2{}
+	node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+	node.Spec.Hostname = "nodehostname"
+
+	// A detached monitoring session has no shell to run anything in.
+	_, err := NewTerminal(TerminalRequest{
+		Login:      "root",
+		Server:     "localhost",
+		SessionID:  session.NewID(),
+		Term:       session.TerminalParams{W: 100, H: 100},
+		Namespace:  defaults.Namespace,
+		EventsOnly: true,
+		Subsystem:  "sftp",
+	}, authProviderMock{server: node}, nil)
+	c.Assert(trace.IsBadParameter(err), Equals, true)
+
+	polls := new(int32)
+	term, err := NewTerminal(TerminalRequest{
+		Login:             "root",
+		Server:            "localhost",
+		SessionID:         session.NewID(),
+		Term:              session.TerminalParams{W: 100, H: 100},
+		Namespace:         defaults.Namespace,
+		EventsOnly:        true,
+		EventPollInterval: 10 * time.Millisecond,
+		ProtocolVersion:   defaults.TerminalProtocolVersion,
+	}, eventsOnlyProviderMock{authProviderMock{server: node}, polls}, nil)
+	c.Assert(err, IsNil)
+
+	term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+	term.eventContext, term.eventCancel = context.WithCancel(context.Background())
+
+	doneC := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term.streamEventsOnly(ws)
+		close(doneC)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The session's audit events arrive over the websocket, with the
+	// close frame after the end event.
+	c.Assert(ws.SetReadDeadline(time.Now().Add(10*time.Second)), IsNil)
+	var sawStart, sawEnd bool
+	for {
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &ue), IsNil)
+		if ue.Type == defaults.CloseEnvelopeType {
+			break
+		}
+		if ue.Type != defaults.AuditEnvelopeType {
+			continue
+		}
+		var ee eventEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &ee), IsNil)
+		switch ee.Payload.GetType() {
+		case events.SessionStartEvent:
+			sawStart = true
+		case events.SessionEndEvent:
+			sawEnd = true
+		}
+	}
+	c.Assert(sawStart, Equals, true)
+	c.Assert(sawEnd, Equals, true)
+
+	select {
+	case <-doneC:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("events-only session did not tear down")
+	}
+
+	// The events came from polling the backend, no SSH connection was
+	// ever attempted.
+	c.Assert(atomic.LoadInt32(polls) > 0, Equals, true)
+	c.Assert(term.sshSession, IsNil)
+}
+
+func (s *WebSuite) TestKillSession(c *C) {
+	// Killing an unknown session reports NotFound.
+	err := KillSession(session.NewID(), "no such session")
+	c.Assert(trace.IsNotFound(err), Equals, true)
+
+	pack := s.authPack(c, "foo")
+	sid := session.NewID()
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "vinsong"), IsNil)
+
+	killErr := make(chan error, 1)
+	go func() { killErr <- KillSession(sid, "killed by admin") }()
+	c.Assert(<-killErr, IsNil)
+
+	// The reason reaches the user's terminal and the connection is torn
+	// down shortly after.
+	c.Assert(s.waitForOutput(term, "killed by admin"), IsNil)
+	c.Assert(ws.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	buf := make([]byte, 1024)
+	for {
+		_, err = term.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	c.Assert(err, Equals, io.EOF)
+
+	// A client that declared the protocol version receives the reason as
+	// a structured error frame it can style apart from terminal output,
+	// not as a raw envelope smuggled past the negotiated framing.
+	sid2 := session.NewID()
+	ws2, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:       sid2,
+		SessionTimeout:  500 * time.Millisecond,
+		ProtocolVersion: defaults.TerminalProtocolVersion,
+	})
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	term2 := newWrappedSocket(ws2, nil)
+	_, err = io.WriteString(term2, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term2, "vinsong"), IsNil)
+
+	go func() { killErr <- KillSession(sid2, "killed again") }()
+	c.Assert(<-killErr, IsNil)
+
+	c.Assert(ws2.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	var ue unknownEnvelope
+	for {
+		c.Assert(websocket.JSON.Receive(ws2, &ue), IsNil)
+		if ue.Type == defaults.ErrorEnvelopeType {
+			break
+		}
+	}
+	var ee errorEnvelope
+	c.Assert(json.Unmarshal(ue.Raw, &ee), IsNil)
+	c.Assert(ee.Payload.Code, Equals, "access_denied")
+	c.Assert(ee.Payload.Message, Equals, "killed again")
+}
+
+// flakyCredentialProvider fails a configurable number of GetAgent calls
+// before behaving, standing in for a key store that hiccups while the proxy
+// restarts.
+type flakyCredentialProvider struct {
+	failures      int
+	getAgentCalls int
+}
+
+func (p *flakyCredentialProvider) GetAgent() (agent.Agent, *ssh.Certificate, error) {
+	p.getAgentCalls++
+	if p.getAgentCalls <= p.failures {
+		return nil, nil, trace.ConnectionProblem(nil, "key store unavailable")
+	}
+	return agent.NewKeyring(), &ssh.Certificate{}, nil
+}
+
+func (p *flakyCredentialProvider) ClientTLSConfig(clusterName ...string) (*tls.Config, error) {
+	return &tls.Config{}, nil
+}
+
+func (s *WebSuite) TestCredentialRetry(c *C) {
+	// A single transient GetAgent failure is absorbed by the retry and the
+	// session proceeds with the credentials from the second attempt.
+	provider := &flakyCredentialProvider{failures: 1}
+	userAgent, cert, _, tlsConfig, err := getUserCredentials(provider)
+	c.Assert(err, IsNil)
+	c.Assert(provider.getAgentCalls, Equals, 2)
+	c.Assert(userAgent, NotNil)
+	c.Assert(cert, NotNil)
+	c.Assert(tlsConfig, NotNil)
+
+	// A provider that keeps failing exhausts the tight budget and the
+	// error surfaces instead of retrying forever.
+	provider = &flakyCredentialProvider{failures: defaults.CredentialRetryAttempts + 1}
+	_, _, _, _, err = getUserCredentials(provider)
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, ".*failed to get user credentials.*")
+	c.Assert(provider.getAgentCalls, Equals, defaults.CredentialRetryAttempts)
+}
+
+func (s *WebSuite) TestActiveSessionsForUser(c *C) {
+	pack := s.authPack(c, "listalice")
+
+	// Two live terminals for the same user.
+	sid1 := session.NewID()
+	ws1, err := s.makeTerminal(pack, sid1)
+	c.Assert(err, IsNil)
+	defer ws1.Close()
+	term1 := newWrappedSocket(ws1, nil)
+	_, err = io.WriteString(term1, "echo list=$((1+0))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term1, "list=1"), IsNil)
+
+	sid2 := session.NewID()
+	ws2, err := s.makeTerminal(pack, sid2)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+	term2 := newWrappedSocket(ws2, nil)
+	_, err = io.WriteString(term2, "echo list=$((1+1))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term2, "list=2"), IsNil)
+
+	infos := ActiveSessions("listalice")
+	c.Assert(infos, HasLen, 2)
+	bySession := make(map[session.ID]SessionInfo)
+	for _, info := range infos {
+		bySession[info.SessionID] = info
+	}
+	for _, sid := range []session.ID{sid1, sid2} {
+		info, ok := bySession[sid]
+		c.Assert(ok, Equals, true)
+		c.Assert(info.Server, Not(Equals), "")
+		c.Assert(info.Login, Equals, s.user)
+		c.Assert(info.StartTime.IsZero(), Equals, false)
+	}
+
+	// Other users do not see these terminals.
+	c.Assert(ActiveSessions("listbob"), HasLen, 0)
+
+	// A handler without a session context never shows up, even for a
+	// Teleport user whose name matches its OS login.
+	orphan := &TerminalHandler{
+		sessionID: session.NewID(),
+		params:    TerminalRequest{Login: "listalice"},
+	}
+	registerSession(orphan)
+	defer unregisterSession(orphan)
+	c.Assert(ActiveSessions("listalice"), HasLen, 2)
+}
+
+func (s *WebSuite) TestCompressedOutput(c *C) {
+	// A screenful of log output compresses well, a shell prompt does not
+	// pay the CPU cost at all.
+	big := strings.Repeat("2026-08-30T12:00:00Z INFO request handled path=/healthz status=200\r\n", 50)
+	small := "$ "
+
+	writeErr := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{Compress: true, BinaryProtocol: true}}
+		sock := newWrappedSocket(ws, term)
+		var err error
+		if _, er := sock.Write([]byte(big)); er != nil {
+			err = er
+		}
+		if _, er := sock.Write([]byte(small)); err == nil && er != nil {
+			err = er
+		}
+		writeErr <- err
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	c.Assert(ws.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+
+	// The large frame arrives compressed and inflates back to the exact
+	// output bytes.
+	var frame []byte
+	c.Assert(websocket.Message.Receive(ws, &frame), IsNil)
+	prefix, payload, err := decodeBinaryFrame(frame)
+	c.Assert(err, IsNil)
+	c.Assert(prefix, Equals, defaults.CompressedRawWebsocketPrefix)
+	c.Assert(len(payload) < len(big), Equals, true)
+	inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	c.Assert(err, IsNil)
+	c.Assert(string(inflated), Equals, big)
+
+	// The frame below the threshold goes out as plain raw output.
+	c.Assert(websocket.Message.Receive(ws, &frame), IsNil)
+	prefix, payload, err = decodeBinaryFrame(frame)
+	c.Assert(err, IsNil)
+	c.Assert(prefix, Equals, defaults.RawWebsocketPrefix)
+	c.Assert(string(payload), Equals, small)
+
+	c.Assert(<-writeErr, IsNil)
+
+	// A JSON protocol client with a non-UTF-8 session charset gets the
+	// decoded UTF-8 in compressed frames too, the same bytes the small
+	// frames carry.
+	utf16Big := make([]byte, 0, len(big)*2)
+	for _, b := range []byte(big) {
+		utf16Big = append(utf16Big, b, 0)
+	}
+	srv2 := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{Compress: true, Charset: "utf-16le"}}
+		term.charset = terminalCharsets["utf-16le"]
+		sock := newWrappedSocket(ws, term)
+		_, er := sock.Write(utf16Big)
+		writeErr <- er
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv2.Close()
+
+	ws2, err := websocket.Dial(strings.Replace(srv2.URL, "http:", "ws:", 1), "", srv2.URL)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+	c.Assert(ws2.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+
+	c.Assert(websocket.Message.Receive(ws2, &frame), IsNil)
+	prefix, payload, err = decodeBinaryFrame(frame)
+	c.Assert(err, IsNil)
+	c.Assert(prefix, Equals, defaults.CompressedRawWebsocketPrefix)
+	inflated, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	c.Assert(err, IsNil)
+	c.Assert(string(inflated), Equals, big)
+
+	c.Assert(<-writeErr, IsNil)
+}
+
+func (s *WebSuite) TestBracketedPaste(c *C) {
+	testCases := []struct {
+		binary    bool
+		bracketed bool
+		want      string
+	}{
+		// With bracketing on, paste frames are wrapped in the markers.
+		{binary: true, bracketed: true, want: "\x1b[200~hello\x1b[201~"},
+		{binary: false, bracketed: true, want: "\x1b[200~hello\x1b[201~"},
+		// With bracketing off, paste frames behave like typed input.
+		{binary: true, bracketed: false, want: "hello"},
+	}
+
+	for _, testCase := range testCases {
+		params := TerminalRequest{
+			BracketedPaste: testCase.bracketed,
+			BinaryProtocol: testCase.binary,
+		}
+		resultC := make(chan string, 1)
+		srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+			sock := newWrappedSocket(ws, &TerminalHandler{params: params})
+			buf := make([]byte, 64)
+			n, err := sock.Read(buf)
+			if err != nil {
+				resultC <- err.Error()
+				return
+			}
+			resultC <- string(buf[:n])
+		}})
+
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+		c.Assert(err, IsNil)
+
+		if testCase.binary {
+			c.Assert(websocket.Message.Send(ws, encodeBinaryFrame(defaults.PasteWebsocketPrefix, []byte("hello"))), IsNil)
+		} else {
+			c.Assert(websocket.JSON.Send(ws, rawEnvelope{
+				Type:    defaults.PasteEnvelopeType,
+				Payload: []byte("hello"),
+			}), IsNil)
+		}
+
+		c.Assert(<-resultC, Equals, testCase.want)
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func (s *WebSuite) TestEventSequence(c *C) {
+	sid := session.NewID()
+	ws1, err := s.makeTerminal(s.authPack(c, "foo"), sid)
+	c.Assert(err, IsNil)
+	defer ws1.Close()
+
+	// A second party joining generates audit events (join, resizes) for
+	// the first terminal to receive.
+	ws2, err := s.makeTerminal(s.authPack(c, "bar"), sid)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	// Audit frames carry a contiguous sequence starting at 1.
+	c.Assert(ws1.SetReadDeadline(time.Now().Add(15*time.Second)), IsNil)
+	next := 1
+	for next <= 2 {
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws1, &ue), IsNil)
+		if ue.Type != defaults.AuditEnvelopeType {
+			continue
+		}
+		var ee eventEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &ee), IsNil)
+		c.Assert(ee.Seq, Equals, next)
+		next++
+	}
+
+	// A failed send ends the event stream instead of leaving a gap.
+	blockC := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) { <-blockC }})
+	defer srv.Close()
+	defer close(blockC)
+
+	brokenWS, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	c.Assert(brokenWS.Close(), IsNil)
+
+	term := &TerminalHandler{}
+	term.eventContext, term.eventCancel = context.WithCancel(context.Background())
+	err = term.sendEventOrCancel(brokenWS, events.EventFields{events.EventType: events.ResizeEvent})
+	c.Assert(err, NotNil)
+	select {
+	case <-term.eventContext.Done():
+	case <-time.After(time.Second):
+		c.Fatalf("event stream was not canceled after a failed send")
+	}
+}
+
+func (s *WebSuite) TestOriginAllowlist(c *C) {
+	allowed := []string{"app.example.com", "*.teleport.dev"}
+
+	// Exact hosts and wildcard subdomains match, ports are ignored.
+	c.Assert(originAllowed("https://app.example.com", allowed), Equals, true)
+	c.Assert(originAllowed("https://app.example.com:3080", allowed), Equals, true)
+	c.Assert(originAllowed("https://proxy.teleport.dev", allowed), Equals, true)
+	c.Assert(originAllowed("https://evil.example.com", allowed), Equals, false)
+	c.Assert(originAllowed("https://example.com", allowed), Equals, false)
+	c.Assert(originAllowed("", allowed), Equals, false)
+
+	// An empty list keeps the empty origin checker so any origin passes.
+	term := &TerminalHandler{}
+	c.Assert(term.websocketServer().Handshake, IsNil)
+
+	// A configured list rejects mismatched origins during the handshake.
+	term = &TerminalHandler{params: TerminalRequest{AllowedOrigins: allowed}}
+	srv := term.websocketServer()
+	c.Assert(srv.Handshake, NotNil)
+
+	req := &http.Request{Header: http.Header{"Origin": []string{"https://app.example.com"}}}
+	c.Assert(srv.Handshake(nil, req), IsNil)
+
+	req = &http.Request{Header: http.Header{"Origin": []string{"https://evil.net"}}}
+	err := srv.Handshake(nil, req)
+	c.Assert(err, NotNil)
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+}
+
+func (s *WebSuite) TestInitCommand(c *C) {
+	pack := s.authPack(c, "foo")
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:      session.NewID(),
+		SessionTimeout: 500 * time.Millisecond,
+		InitCommand:    "cd /tmp\r\n",
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+
+	// The pty echoes the init command, proving it reached stdin before any
+	// typed input.
+	c.Assert(s.waitForOutput(term, "cd /tmp"), IsNil)
+
+	// The shell is still interactive and reflects the seeded state.
+	_, err = io.WriteString(term, "echo at=$PWD\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "at=/tmp"), IsNil)
+}
+
+func (s *WebSuite) TestSessionSummaryLogging(c *C) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		// Feed the handler 100 bytes of input, then drain its output.
+		websocket.Message.Send(ws, encodeBinaryFrame(defaults.RawWebsocketPrefix, make([]byte, 100)))
+		var frame []byte
+		websocket.Message.Receive(ws, &frame)
+		<-done
+	}})
+	defer srv.Close()
+	defer close(done)
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := &TerminalHandler{params: TerminalRequest{BinaryProtocol: true}}
+	term.startTime = time.Now()
+	sock := newWrappedSocket(ws, term)
+	term.wrappedSock = sock
+
+	// Push a known volume through both directions.
+	_, err = sock.Write(make([]byte, 250))
+	c.Assert(err, IsNil)
+	buf := make([]byte, 200)
+	n, err := sock.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 100)
+
+	hook := &logCaptureHook{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(hook)
+	term.entry = logrus.NewEntry(logger)
+
+	term.logSessionSummary()
+
+	c.Assert(hook.entries, HasLen, 1)
+	c.Assert(hook.entries[0].Data["bytes_sent"], Equals, int64(250))
+	c.Assert(hook.entries[0].Data["bytes_received"], Equals, int64(100))
+	c.Assert(hook.entries[0].Data["exit_status"], Equals, -1)
+}
+
+func (s *WebSuite) TestResizeTerminal(c *C) {
+	sid := session.NewID()
+
+	// Create a new user "foo", open a terminal to a new session, and wait for
+	// it to be ready.
+	pack1 := s.authPack(c, "foo")
+	ws1, err := s.makeTerminal(pack1, sid)
+	c.Assert(err, IsNil)
+	defer ws1.Close()
+	err = s.waitForRawEvent(ws1, 5*time.Second)
+	c.Assert(err, IsNil)
+
+	// Create a new user "bar", open a terminal to the session created above,
+	// and wait for it to be ready.
+	pack2 := s.authPack(c, "bar")
+	ws2, err := s.makeTerminal(pack2, sid)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+	err = s.waitForRawEvent(ws2, 5*time.Second)
+	c.Assert(err, IsNil)
+
+	// Look at the audit events for the first terminal. It should have two
+	// resize events from the second terminal (80x25 default then 100x100). Only
+	// the second terminal will get these because resize events are not sent
+	// back to the originator.
+	err = s.waitForResizeEvent(ws1, 5*time.Second)
+	c.Assert(err, IsNil)
+	err = s.waitForResizeEvent(ws1, 5*time.Second)
+	c.Assert(err, IsNil)
+
+	// Look at the stream events for the second terminal. We don't expect to see
+	// any resize events yet. It will timeout.
+	err = s.waitForResizeEvent(ws2, 1*time.Second)
+	c.Assert(err, NotNil)
+
+	// Resize the second terminal. This should be reflected on the first terminal
+	// because resize events are not sent back to the originator.
+	params, err := session.NewTerminalParamsFromInt(300, 120)
+	c.Assert(err, IsNil)
+	websocket.JSON.Send(ws2, eventEnvelope{
+		Type: defaults.ResizeRequestEnvelopeType,
+		Payload: events.EventFields{
+			events.EventType:      events.ResizeEvent,
+			events.EventNamespace: defaults.Namespace,
+			events.SessionEventID: sid.String(),
+			events.TerminalSize:   params.Serialize(),
+		},
+	})
+
+	// This time the first terminal will see the resize event.
+	err = s.waitForResizeEvent(ws1, 5*time.Second)
+	c.Assert(err, IsNil)
+
+	// The originator sees its own resize as well now, emitted by its own
+	// handler rather than pushed back by the node. TestResizeAuditEvent
+	// covers that path; it is not asserted here because the timed out
+	// wait above leaves a competing reader on ws2.
+}
+
+func (s *WebSuite) TestResizeAuditEvent(c *C) {
+	// A single party session: the node pushes resize events only to the
+	// other parties, so any resize event seen here was emitted by this
+	// party's own handler.
+	ws, err := s.makeTerminal(s.authPack(c, "resizeaudit"))
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Make sure the SSH session is up before resizing: window changes
+	// before the session exists are dropped.
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo up=$((20+3))\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "up=23"), IsNil)
+
+	params, err := session.NewTerminalParamsFromInt(301, 121)
+	c.Assert(err, IsNil)
+	websocket.JSON.Send(ws, eventEnvelope{
+		Type: defaults.ResizeRequestEnvelopeType,
+		Payload: events.EventFields{
+			events.EventType:    events.ResizeEvent,
+			events.TerminalSize: params.Serialize(),
+		},
+	})
+
+	// The resize comes back as an audit event carrying the new dimensions
+	// and who resized.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &ue), IsNil)
+		if ue.Type != defaults.AuditEnvelopeType {
+			continue
+		}
+		var ee eventEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &ee), IsNil)
+		if ee.Payload.GetType() != events.ResizeEvent {
+			continue
+		}
+		c.Assert(ee.Payload.GetString(events.TerminalSize), Equals, params.Serialize())
+		c.Assert(ee.Payload.GetString(events.EventUser), Equals, "resizeaudit")
+		return
+	}
+}
+
+func (s *WebSuite) TestShellNegotiator(c *C) {
+	newNode := func(osLabel string) services.Server {
+		node := &services.ServerV2{}
+		node.SetName("eca53e45-86a9-11e7-a893-0242ac0a0101")
+		if osLabel != "" {
+			node.Metadata.Labels = map[string]string{"os": osLabel}
+		}
+		return node
+	}
+
+	// The "os" label picks the negotiator; missing, unknown and absent
+	// nodes keep the POSIX behavior.
+	_, ok := negotiatorForNode(newNode("linux")).(unixNegotiator)
+	c.Assert(ok, Equals, true)
+	_, ok = negotiatorForNode(newNode("")).(unixNegotiator)
+	c.Assert(ok, Equals, true)
+	_, ok = negotiatorForNode(nil).(unixNegotiator)
+	c.Assert(ok, Equals, true)
+	_, ok = negotiatorForNode(newNode("windows")).(windowsNegotiator)
+	c.Assert(ok, Equals, true)
+	_, ok = negotiatorForNode(newNode("Windows Server 2019")).(windowsNegotiator)
+	c.Assert(ok, Equals, true)
+
+	// POSIX hosts get the TERM the client asked for plus explicit terminal
+	// modes, Windows hosts an xterm flavor and no modes at all.
+	c.Assert(unixNegotiator{}.TermType("screen"), Equals, "screen")
+	c.Assert(unixNegotiator{}.TerminalModes(), NotNil)
+	c.Assert(windowsNegotiator{}.TermType("linux"), Equals, "xterm-256color")
+	c.Assert(windowsNegotiator{}.TermType("xterm"), Equals, "xterm")
+	c.Assert(windowsNegotiator{}.TerminalModes(), IsNil)
+}
+
+func (s *WebSuite) TestConnectStatusFrames(c *C) {
+	ws, err := s.makeTerminal(s.authPack(c, "statusframes"))
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Collect the status frames interleaved with the other traffic until
+	// the terminal reports ready.
+	var details []string
+	c.Assert(ws.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	for {
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &ue), IsNil)
+		if ue.Type != defaults.StatusEnvelopeType {
+			continue
+		}
+		var se statusEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &se), IsNil)
+		details = append(details, se.Payload.Detail)
+		if se.Payload.State == statusStateReady {
+			break
+		}
+		c.Assert(se.Payload.State, Equals, statusStateConnecting)
+	}
+
+	// Every connect step reported itself, in order.
+	c.Assert(details, DeepEquals, []string{
+		"resolving node", "dialing proxy", "dialing node", "opening shell", "shell ready",
+	})
+}
+
+func (s *WebSuite) TestResizeAck(c *C) {
+	ws, err := s.makeTerminal(s.authPack(c, "foo"))
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Make sure the SSH session is up before resizing: window changes
+	// before the session exists are dropped without an ack.
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.waitForOutput(term, "vinsong"), IsNil)
+
+	params, err := session.NewTerminalParamsFromInt(201, 101)
+	c.Assert(err, IsNil)
+	websocket.JSON.Send(ws, eventEnvelope{
+		Type: defaults.ResizeRequestEnvelopeType,
+		Payload: events.EventFields{
+			events.EventType:    events.ResizeEvent,
+			events.TerminalSize: params.Serialize(),
+		},
+	})
+
+	// The ack carries the dimensions that were applied.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(ws, &ue), IsNil)
+		if ue.Type != defaults.ResizeAckEnvelopeType {
+			continue
+		}
+		var ack resizeAckEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &ack), IsNil)
+		c.Assert(ack.Payload.OK, Equals, true)
+		c.Assert(ack.Payload.W, Equals, 201)
+		c.Assert(ack.Payload.H, Equals, 101)
+		return
+	}
+}
+
+func (s *WebSuite) TestTerminal(c *C) {
+	ws, err := s.makeTerminal(s.authPack(c, "foo"))
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Create a wrapped connection that gives access to the terminal stream.
+	term := newWrappedSocket(ws, nil)
+
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+
+	err = s.waitForOutput(term, "vinsong")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestScrollbackBuffer(c *C) {
+	buffer := newScrollbackBuffer(8)
+
+	// An empty buffer has nothing to replay.
+	c.Assert(buffer.Bytes(), HasLen, 0)
+
+	buffer.Write([]byte("hello"))
+	c.Assert(string(buffer.Bytes()), Equals, "hello")
+
+	// Overflow keeps the most recent bytes only.
+	buffer.Write([]byte(" world"))
+	c.Assert(string(buffer.Bytes()), Equals, "lo world")
+
+	// A single write larger than the capacity keeps its tail.
+	buffer.Write([]byte("0123456789abcdef"))
+	c.Assert(string(buffer.Bytes()), Equals, "89abcdef")
+
+	// Resuming from an offset replays only what the client is missing.
+	buffer = newScrollbackBuffer(8)
+	buffer.Write([]byte("abcdefgh"))
+	buffer.Write([]byte("ijkl"))
+
+	// In range: only the bytes newer than the offset come back.
+	out, full := buffer.BytesFrom(8)
+	c.Assert(string(out), Equals, "ijkl")
+	c.Assert(full, Equals, false)
+
+	// Exactly at the tail: the client is missing nothing.
+	out, full = buffer.BytesFrom(12)
+	c.Assert(out, HasLen, 0)
+	c.Assert(full, Equals, false)
+
+	// Older than the earliest retained byte: fall back to a full replay.
+	out, full = buffer.BytesFrom(2)
+	c.Assert(string(out), Equals, "efghijkl")
+	c.Assert(full, Equals, true)
+
+	// A position that was never written: also a full replay.
+	out, full = buffer.BytesFrom(13)
+	c.Assert(string(out), Equals, "efghijkl")
+	c.Assert(full, Equals, true)
+}
+
+func (s *WebSuite) TestSessionEnv(c *C) {
+	sid := session.NewID()
+	term := &TerminalHandler{params: TerminalRequest{
+		SessionID: sid,
+		Env: map[string]string{
+			"TERM":                 "xterm-256color",
+			sshutils.SessionEnvVar: "forged-session-id",
+		},
+	}}
+
+	// Requested variables are merged in, the reserved session variable
+	// always wins on collision.
+	env := term.sessionEnv()
+	c.Assert(env["TERM"], Equals, "xterm-256color")
+	c.Assert(env[sshutils.SessionEnvVar], Equals, string(sid))
+
+	// Malformed variable names are rejected.
+	c.Assert(validateEnv(map[string]string{"TERM": "xterm"}), IsNil)
+	c.Assert(validateEnv(nil), IsNil)
+	c.Assert(validateEnv(map[string]string{"": "empty"}), NotNil)
+	c.Assert(validateEnv(map[string]string{"FOO=BAR": "baz"}), NotNil)
+	c.Assert(validateEnv(map[string]string{"FOO\x00": "baz"}), NotNil)
+}
+
+func (s *WebSuite) TestSessionEnvClusterDefaults(c *C) {
+	sid := session.NewID()
+	term := &TerminalHandler{params: TerminalRequest{
+		SessionID: sid,
+		Env: map[string]string{
+			"LC_ALL":               "C",
+			sshutils.SessionEnvVar: "forged-session-id",
+		},
+	}}
+	WithDefaultEnv(map[string]string{
+		"LANG":                 "en_US.UTF-8",
+		"LC_ALL":               "en_US.UTF-8",
+		sshutils.SessionEnvVar: "forged-session-id",
+	})(term)
+
+	// Cluster defaults apply where the user set nothing, user-supplied
+	// variables override them, and the reserved session variable beats
+	// both.
+	env := term.sessionEnv()
+	c.Assert(env["LANG"], Equals, "en_US.UTF-8")
+	c.Assert(env["LC_ALL"], Equals, "C")
+	c.Assert(env[sshutils.SessionEnvVar], Equals, string(sid))
+}
+
+func (s *WebSuite) TestReadOnlyDiscardsInput(c *C) {
+	readC := make(chan []byte, 1)
+	errC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{ReadOnly: true}}
+		conn := newWrappedSocket(ws, term)
+		out := make([]byte, 100)
+		n, err := conn.Read(out)
+		readC <- out[:n]
+		errC <- err
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+
+	// Typed input is silently discarded, the read loop never yields the
+	// keystrokes and runs into EOF once the connection closes.
+	websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: []byte("echo do not run this\r\n")})
+	websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: []byte("more keystrokes")})
+	ws.Close()
+
+	c.Assert(<-readC, HasLen, 0)
+	c.Assert(<-errC, Equals, io.EOF)
+}
+
+func (s *WebSuite) TestReadOnlyBlocksFileTransfer(c *C) {
+	term := &TerminalHandler{params: TerminalRequest{ReadOnly: true}}
+	errC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		conn := newWrappedSocket(ws, term)
+		out := make([]byte, 100)
+		for {
+			_, err := conn.Read(out)
+			if err != nil {
+				errC <- err
+				return
+			}
+		}
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// An observer asking for a download is refused, the refusal comes back
+	// as a failed transfer result.
+	c.Assert(websocket.JSON.Send(ws, fileTransferEnvelope{
+		Type:    defaults.FileTransferEnvelopeType,
+		Payload: fileTransferRequest{Operation: fileTransferDownload, Path: "/etc/passwd"},
+	}), IsNil)
+
+	c.Assert(ws.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	var pe fileProgressEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &pe), IsNil)
+	c.Assert(pe.Type, Equals, defaults.FileProgressEnvelopeType)
+	c.Assert(pe.Payload.Error, Matches, ".*read-only session.*")
+
+	// An upload request never allocates the upload channel and its chunks
+	// are dropped at the read loop.
+	c.Assert(websocket.JSON.Send(ws, fileTransferEnvelope{
+		Type:    defaults.FileTransferEnvelopeType,
+		Payload: fileTransferRequest{Operation: fileTransferUpload, Path: "/tmp/planted", Size: 5},
+	}), IsNil)
+	c.Assert(websocket.JSON.Receive(ws, &pe), IsNil)
+	c.Assert(pe.Payload.Error, Matches, ".*read-only session.*")
+	c.Assert(websocket.JSON.Send(ws, fileChunkEnvelope{
+		Type:    defaults.FileChunkEnvelopeType,
+		Payload: []byte("chunk"),
+	}), IsNil)
+
+	ws.Close()
+	c.Assert(<-errC, Equals, io.EOF)
+	c.Assert(term.fileUploadCh, IsNil)
+}
+
+func (s *WebSuite) TestMaxFrameBytes(c *C) {
+	errC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{MaxFrameBytes: 64}}
+		conn := newWrappedSocket(ws, term)
+		out := make([]byte, 100)
+		_, err := conn.Read(out)
+		errC <- err
+		ws.Close()
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// An oversized frame is rejected before decoding and takes the read
+	// loop down, which tears the connection down with it.
+	oversized := bytes.Repeat([]byte("A"), 4096)
+	c.Assert(websocket.JSON.Send(ws, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: oversized}), IsNil)
+	c.Assert(trace.IsLimitExceeded(<-errC), Equals, true)
+
+	// The server side closed the websocket: the client runs into EOF.
+	var e rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &e), Equals, io.EOF)
+
+	// A frame within the limit passes untouched.
+	readC := make(chan []byte, 1)
+	srv2 := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{MaxFrameBytes: 1024}}
+		conn := newWrappedSocket(ws, term)
+		out := make([]byte, 100)
+		n, er := conn.Read(out)
+		readC <- out[:n]
+		errC <- er
+	}})
+	defer srv2.Close()
+
+	ws2, err := websocket.Dial(strings.Replace(srv2.URL, "http:", "ws:", 1), "", srv2.URL)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	c.Assert(websocket.JSON.Send(ws2, rawEnvelope{Type: defaults.RawEnvelopeType, Payload: []byte("ls\r\n")}), IsNil)
+	c.Assert(string(<-readC), Equals, "ls\r\n")
+	c.Assert(<-errC, IsNil)
+}
+
+func (s *WebSuite) TestInvalidUTF8Output(c *C) {
+	// A lone 0xFF byte is substituted, valid runes around it survive.
+	replaced := replaceInvalidUTF8([]byte{'o', 'k', 0xff, '!'})
+	c.Assert(string(replaced), Equals, "ok�!")
+
+	// Through the envelope wrapper: writing invalid UTF-8 in "replace"
+	// mode does not error and the frame carries sane output.
+	errC := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{InvalidUTF8: invalidUTF8Replace}}
+		conn := newWrappedSocket(ws, term)
+		_, err := conn.Write([]byte{'o', 'k', 0xff})
+		errC <- err
+	}})
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	var re rawEnvelope
+	c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+	c.Assert(<-errC, IsNil)
+	c.Assert(strings.HasPrefix(string(re.Payload), "ok"), Equals, true)
+	c.Assert(utf8.Valid(re.Payload), Equals, true)
+}
+
+func (s *WebSuite) TestTerminalLimit(c *C) {
+	defer func(old int) { MaxTerminalsPerUser = old }(MaxTerminalsPerUser)
+	MaxTerminalsPerUser = 2
+
+	// The cap is enforced per user.
+	c.Assert(acquireTerminal("alice"), IsNil)
+	c.Assert(acquireTerminal("alice"), IsNil)
+	err := acquireTerminal("alice")
+	c.Assert(err, NotNil)
+	c.Assert(trace.IsLimitExceeded(err), Equals, true)
+
+	// Other users are unaffected.
+	c.Assert(acquireTerminal("bob"), IsNil)
+
+	// Releasing a slot makes room again.
+	releaseTerminal("alice")
+	c.Assert(acquireTerminal("alice"), IsNil)
+
+	releaseTerminal("alice")
+	releaseTerminal("alice")
+	releaseTerminal("bob")
+
+	// End to end: with a cap of one, the second terminal of the same user
+	// is refused with a readable error instead of hanging. A dedicated
+	// user keeps terminals of other tests out of the count.
+	MaxTerminalsPerUser = 1
+	pack := s.authPack(c, "limituser")
+
+	ws, err := s.makeTerminal(pack)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+	err = s.waitForOutput(term, "vinsong")
+	c.Assert(err, IsNil)
+
+	ws2, err := s.makeTerminal(pack)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	term2 := newWrappedSocket(ws2, nil)
+	err = s.waitForOutput(term2, "too many open terminals")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestSessionMetadataFrame(c *C) {
+	sid := session.NewID()
+	pack := s.authPack(c, "foo")
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// The metadata has to be the first frame that is neither the
+	// capabilities hello, a connection progress status, nor raw terminal
+	// output.
+	var me sessionMetadataEnvelope
+	for i := 0; ; i++ {
+		c.Assert(i < 100, Equals, true)
+
+		var ue unknownEnvelope
+		err = websocket.JSON.Receive(ws, &ue)
+		c.Assert(err, IsNil)
+		if ue.Type == defaults.CapabilitiesEnvelopeType || ue.Type == defaults.StatusEnvelopeType || ue.Type == defaults.RawEnvelopeType {
+			continue
+		}
+
+		c.Assert(ue.Type, Equals, defaults.SessionMetadataEnvelopeType)
+		c.Assert(json.Unmarshal(ue.Raw, &me), IsNil)
+		break
+	}
+
+	c.Assert(me.Payload.SessionID, Equals, string(sid))
+	c.Assert(me.Payload.Login, Equals, pack.login)
+	c.Assert(me.Payload.HostName, Not(Equals), "")
+}
+
+func (s *WebSuite) TestShellQuote(c *C) {
+	// Plain paths stay intact, spaces and metacharacters stay literal.
+	c.Assert(shellQuote("/tmp/plain.txt"), Equals, "'/tmp/plain.txt'")
+	c.Assert(shellQuote("/tmp/with space.txt"), Equals, "'/tmp/with space.txt'")
+	c.Assert(shellQuote("/tmp/a;rm -rf $HOME`id`"), Equals, "'/tmp/a;rm -rf $HOME`id`'")
+
+	// An embedded single quote cannot terminate the quoting.
+	c.Assert(shellQuote("/tmp/it's"), Equals, `'/tmp/it'\''s'`)
+}
+
+func (s *WebSuite) TestFileTransferRoundTrip(c *C) {
+	dir := c.MkDir()
+	payload := bytes.Repeat([]byte("web terminal file transfer round trip "), 1000)
+
+	// Upload: stream the payload to the repo's scp sink, the same protocol
+	// a node-side scp speaks.
+	sink := &scp.Command{Sink: true, Target: []string{dir}}
+	local, remote, localIn := newSCPPipe(c)
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- sink.Execute(remote)
+	}()
+
+	var uploadedBytes int64
+	err := uploadFile(local, "roundtrip.txt", int64(len(payload)), bytes.NewReader(payload), func(transferred int64) {
+		uploadedBytes = transferred
+	})
+	c.Assert(err, IsNil)
+	localIn.Close()
+	c.Assert(<-doneC, IsNil)
+	c.Assert(uploadedBytes, Equals, int64(len(payload)))
+
+	uploaded, err := ioutil.ReadFile(filepath.Join(dir, "roundtrip.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(uploaded, payload), Equals, true)
+
+	// Download: read the uploaded file back through the repo's scp source
+	// and verify byte equality end to end.
+	source := &scp.Command{Source: true, Target: []string{filepath.Join(dir, "roundtrip.txt")}}
+	local, remote, localIn = newSCPPipe(c)
+	go func() {
+		doneC <- source.Execute(remote)
+	}()
+
+	var buf bytes.Buffer
+	name, size, err := downloadFile(local, &buf, nil)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "roundtrip.txt")
+	c.Assert(size, Equals, int64(len(payload)))
+	c.Assert(bytes.Equal(buf.Bytes(), payload), Equals, true)
+	localIn.Close()
+	c.Assert(<-doneC, IsNil)
+}
+
+func (s *WebSuite) TestResizeDebouncer(c *C) {
+	var mu sync.Mutex
+	var sent []session.TerminalParams
+	debouncer := newResizeDebouncer(10*time.Millisecond, func(params *session.TerminalParams) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, *params)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go debouncer.run(ctx)
+
+	// Fire a storm of resizes, far faster than the debounce period.
+	for i := 1; i <= 100; i++ {
+		debouncer.push(session.TerminalParams{W: i, H: i})
+	}
+
+	// Give the debouncer a few periods to drain.
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Only a handful of window-changes made it to the node, and the final
+	// size was the one applied last.
+	c.Assert(len(sent) >= 1, Equals, true)
+	c.Assert(len(sent) < 10, Equals, true)
+	c.Assert(sent[len(sent)-1], DeepEquals, session.TerminalParams{W: 100, H: 100})
+}
+
+func (s *WebSuite) TestTermType(c *C) {
+	// Only allowlisted terminal types are accepted.
+	c.Assert(validateTermType("xterm"), IsNil)
+	c.Assert(validateTermType("xterm-256color"), IsNil)
+	c.Assert(validateTermType("vt100"), IsNil)
+	c.Assert(validateTermType("xterm\x00evil"), NotNil)
+	c.Assert(validateTermType("rxvt-unicode"), NotNil)
+
+	// The requested type has to show up in the remote environment, proving
+	// it was sent in the pty-req.
+	pack := s.authPack(c, "foo")
+	ws, err := s.makeTerminalWithRequest(pack, TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:      session.NewID(),
+		SessionTimeout: 500 * time.Millisecond,
+		TermType:       "screen",
+	})
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo term=$TERM\r\n")
+	c.Assert(err, IsNil)
+	err = s.waitForOutput(term, "term=screen")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestCloseFrame(c *C) {
+	// A clean exit carries the exit status and is marked clean.
+	frame := closeFrame(nil, 0, "")
+	c.Assert(frame.Type, Equals, defaults.CloseEnvelopeType)
+	c.Assert(frame.Payload.Reason, Equals, "session ended")
+	c.Assert(frame.Payload.ExitCode, Equals, 0)
+	c.Assert(frame.Payload.Clean, Equals, true)
+	c.Assert(frame.Payload.Side, Equals, "")
+
+	// A non-zero exit status is still a clean close.
+	frame = closeFrame(nil, 42, "")
+	c.Assert(frame.Payload.ExitCode, Equals, 42)
+	c.Assert(frame.Payload.Clean, Equals, true)
+
+	// An error-path close carries the error as the reason and the side the
+	// failure was observed on.
+	frame = closeFrame(trace.ConnectionProblem(nil, "node went away"), 1, failureSideServer)
+	c.Assert(frame.Payload.Reason, Equals, "node went away")
+	c.Assert(frame.Payload.ExitCode, Equals, 1)
+	c.Assert(frame.Payload.Clean, Equals, false)
+	c.Assert(frame.Payload.Side, Equals, failureSideServer)
+}
+
+func (s *WebSuite) TestFailureSide(c *C) {
+	// The first observation wins: a browser that went away makes the SSH
+	// side fail moments later, the report still blames the client.
+	term := &TerminalHandler{}
+	c.Assert(term.failedSide(), Equals, "")
+	term.noteFailure(failureSideClient)
+	term.noteFailure(failureSideServer)
+	c.Assert(term.failedSide(), Equals, failureSideClient)
+
+	// A websocket read error is recorded as a client-side failure.
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		io.Copy(ioutil.Discard, ws)
+	}})
+	defer srv.Close()
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+	c.Assert(err, IsNil)
+	readTerm := &TerminalHandler{}
+	sock := newWrappedSocket(ws, readTerm)
+	c.Assert(ws.SetReadDeadline(time.Now().Add(10*time.Millisecond)), IsNil)
+	_, err = sock.Read(make([]byte, 10))
+	c.Assert(err, NotNil)
+	c.Assert(readTerm.failedSide(), Equals, failureSideClient)
+	ws.Close()
+
+	// An SSH connection failure is reported as a server-side failure in
+	// the error and close frames. A proxy address nothing listens on makes
+	// tc.SSH fail without a node ever being reached.
+	sshSrv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		term := &TerminalHandler{params: TerminalRequest{ProtocolVersion: defaults.TerminalProtocolVersion}}
+		term.terminalContext, term.terminalCancel = context.WithCancel(context.Background())
+		tc, er := client.NewClient(&client.Config{
+			Username:      "failureside",
+			HostLogin:     "failureside",
+			ProxyHostPort: "127.0.0.1:1",
+			Host:          "127.0.0.1",
+			SkipLocalAuth: true,
+			AuthMethods:   []ssh.AuthMethod{ssh.Password("unused")},
+			TLS:           &tls.Config{},
+		})
+		if er != nil {
+			c.Errorf("unable to build client: %v", er)
+			return
+		}
+		term.streamTerminal(ws, tc)
+	}})
+	defer sshSrv.Close()
+
+	sshWS, err := websocket.Dial(strings.Replace(sshSrv.URL, "http:", "ws:", 1), "", sshSrv.URL)
+	c.Assert(err, IsNil)
+	defer sshWS.Close()
+	c.Assert(sshWS.SetReadDeadline(time.Now().Add(10*time.Second)), IsNil)
+	for {
+		var ue unknownEnvelope
+		c.Assert(websocket.JSON.Receive(sshWS, &ue), IsNil)
+		if ue.Type != defaults.CloseEnvelopeType {
+			continue
+		}
+		var frame closeEnvelope
+		c.Assert(json.Unmarshal(ue.Raw, &frame), IsNil)
+		c.Assert(frame.Payload.Clean, Equals, false)
+		c.Assert(frame.Payload.Side, Equals, failureSideServer)
+		break
+	}
+}
+
+func (s *WebSuite) TestScrollbackReplay(c *C) {
+	sid := session.NewID()
+	pack := s.authPack(c, "foo")
+
+	req := TerminalRequest{
+		Server: s.srvID,
+		Login:  pack.login,
+		Term: session.TerminalParams{
+			W: 100,
+			H: 100,
+		},
+		SessionID:       sid,
+		SessionTimeout:  500 * time.Millisecond,
+		ScrollbackBytes: 4096,
+	}
+
+	ws, err := s.makeTerminalWithRequest(pack, req)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Produce some output so the scrollback buffer has something in it.
+	term := newWrappedSocket(ws, nil)
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+	err = s.waitForOutput(term, "vinsong")
+	c.Assert(err, IsNil)
+
+	// Join the same session again. The scrollback tail has to be replayed
+	// to the new connection without typing anything.
+	ws2, err := s.makeTerminalWithRequest(pack, req)
+	c.Assert(err, IsNil)
+	defer ws2.Close()
+
+	term2 := newWrappedSocket(ws2, nil)
+	err = s.waitForOutput(term2, "vinsong")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestScrollbackReplayChunks(c *C) {
+	tail := []byte("0123456789abcdef")
+
+	for _, binary := range []bool{true, false} {
+		params := TerminalRequest{
+			BinaryProtocol:   binary,
+			ReplayChunkBytes: 4,
+			ReplayChunkDelay: time.Millisecond,
+		}
+		doneC := make(chan struct{})
+		srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+			term := &TerminalHandler{params: params}
+			term.replayScrollback(newWrappedSocket(ws, term), tail)
+			close(doneC)
+		}})
+
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), "", srv.URL)
+		c.Assert(err, IsNil)
+
+		// The backlog arrives in multiple bounded frames, all tagged as
+		// replay so the UI can show a history indicator.
+		var got []byte
+		for i := 0; i < 4; i++ {
+			if binary {
+				var frame []byte
+				c.Assert(websocket.Message.Receive(ws, &frame), IsNil)
+				prefix, payload, err := decodeBinaryFrame(frame)
+				c.Assert(err, IsNil)
+				c.Assert(prefix, Equals, defaults.ReplayWebsocketPrefix)
+				c.Assert(len(payload), Equals, 4)
+				got = append(got, payload...)
+			} else {
+				var re rawEnvelope
+				c.Assert(websocket.JSON.Receive(ws, &re), IsNil)
+				c.Assert(re.Type, Equals, defaults.ReplayEnvelopeType)
+				c.Assert(len(re.Payload), Equals, 4)
+				got = append(got, re.Payload...)
+			}
+		}
+		c.Assert(string(got), Equals, string(tail))
+
+		select {
+		case <-doneC:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("replay did not finish")
+		}
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func (s *WebSuite) TestWebAgentForward(c *C) {
+	ws, err := s.makeTerminal(s.authPack(c, "foo"))
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Create a wrapped connection that gives access to the terminal stream.
+	term := newWrappedSocket(ws, nil)
+
+	_, err = io.WriteString(term, "echo $SSH_AUTH_SOCK\r\n")
+	c.Assert(err, IsNil)
+
+	err = s.waitForOutput(term, "/")
+	c.Assert(err, IsNil)
+}
+
+func (s *WebSuite) TestActiveSessions(c *C) {
+	sid := session.NewID()
+	pack := s.authPack(c, "foo")
+
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Create a wrapped connection that gives access to the terminal stream.
+	term := newWrappedSocket(ws, nil)
+
+	// To make sure we have a session.
+	_, err = io.WriteString(term, "echo vinsong\r\n")
+	c.Assert(err, IsNil)
+
+	// Make sure server has replied.
+	err = s.waitForOutput(term, "vinsong")
+	c.Assert(err, IsNil)
+
+	// Make sure this session appears in the list of active sessions.
+	var sessResp *siteSessionsGetResponse
+	for i := 0; i < 10; i++ {
+		// Get site nodes and make sure the node has our active party.
+		re, err := pack.clt.Get(pack.clt.Endpoint("webapi", "sites", s.server.ClusterName(), "sessions"), url.Values{})
+		c.Assert(err, IsNil)
+
+		c.Assert(json.Unmarshal(re.Bytes(), &sessResp), IsNil)
+		c.Assert(len(sessResp.Sessions), Equals, 1)
+
+		// Sessions do not appear momentarily as there's async heartbeat
+		// procedure.
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	c.Assert(len(sessResp.Sessions), Equals, 1)
+	c.Assert(sessResp.Sessions[0].ID, Equals, sid)
+}
+
+func (s *WebSuite) TestCloseConnectionsOnLogout(c *C) {
+	sid := session.NewID()
+	pack := s.authPack(c, "foo")
+
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	// Create a wrapped connection that gives access to the terminal stream.
+	term := newWrappedSocket(ws, nil)
+
+	// to make sure we have a session
+	_, err = io.WriteString(term, "expr 137 + 39\r\n")
+	c.Assert(err, IsNil)
+
+	// make sure server has replied
+	out := make([]byte, 100)
+	term.Read(out)
+
+	_, err = pack.clt.Delete(
+		pack.clt.Endpoint("webapi", "sessions"))
+	c.Assert(err, IsNil)
+
+	// wait until we timeout or detect that connection has been closed
+	after := time.After(5 * time.Second)
+	errC := make(chan error)
+	go func() {
+		for {
+			_, err := term.Read(out)
+			if err != nil {
+				errC <- err
+			}
+		}
+	}()
+
+	select {
+	case <-after:
+		c.Fatalf("timeout")
+	case err := <-errC:
+		c.Assert(err, Equals, io.EOF)
+	}
+}
+
+func (s *WebSuite) TestCreateSession(c *C) {
+	pack := s.authPack(c, "foo")
+
+	sess := session.Session{
+		TerminalParams: session.TerminalParams{W: 300, H: 120},
+		Login:          s.user,
+	}
+
+	re, err := pack.clt.PostJSON(
+		pack.clt.Endpoint("webapi", "sites", s.server.ClusterName(), "sessions"),
+		siteSessionGenerateReq{Session: sess},
+	)
+	c.Assert(err, IsNil)
+
+	var created *siteSessionGenerateResponse
+	c.Assert(json.Unmarshal(re.Bytes(), &created), IsNil)
+	c.Assert(created.Session.ID, Not(Equals), "")
+}
+
+func (s *WebSuite) TestPlayback(c *C) {
+	pack := s.authPack(c, "foo")
+	sid := session.NewID()
+	ws, err := s.makeTerminal(pack, sid)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+}
+
+func (s *WebSuite) TestNewU2FUser(c *C) {
+	// configure cluster authentication preferences
+	cap, err := services.NewAuthPreference(services.AuthPreferenceSpecV2{
+		Type:         teleport.Local,
+		SecondFactor: teleport.U2F,
+		U2F: &services.U2F{
+			AppID:  "https://" + s.server.ClusterName(),
+			Facets: []string{"https://" + s.server.ClusterName()},
+		},
+	})
+	c.Assert(err, IsNil)
+	err = s.server.AuthServer.AuthServer.SetAuthPreference(cap)
+	c.Assert(err, IsNil)
+
+	token, err := s.server.Auth().CreateSignupToken(services.UserV1{Name: "bob", AllowedLogins: []string{s.user}}, 0)
+	c.Assert(err, IsNil)
+
+	clt := s.client()
+	re, err := clt.Get(clt.Endpoint("webapi", "u2f", "signuptokens", token), url.Values{})
+	c.Assert(err, IsNil)
+
+	var u2fRegReq u2f.RegisterRequest
+	c.Assert(json.Unmarshal(re.Bytes(), &u2fRegReq), IsNil)
+
+	u2fRegResp, err := s.mockU2F.RegisterResponse(&u2fRegReq)
+	c.Assert(err, IsNil)
+
+	tempPass := "abc123"
+
+	re, err = clt.PostJSON(clt.Endpoint("webapi", "u2f", "users"), createNewU2FUserReq{
+		InviteToken:         token,
+		Pass:                tempPass,
+		U2FRegisterResponse: *u2fRegResp,
+	})
+	c.Assert(err, IsNil)
+
+	var rawSess *createSessionResponseRaw
+	c.Assert(json.Unmarshal(re.Bytes(), &rawSess), IsNil)
+	cookies := re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+
+	// now make sure we are logged in by calling authenticated method
+	// we need to supply both session cookie and bearer token for
+	// request to succeed
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, IsNil)
+
+	clt = s.client(roundtrip.BearerAuth(rawSess.Token), roundtrip.CookieJar(jar))
+	jar.SetCookies(s.url(), re.Cookies())
+
+	re, err = clt.Get(clt.Endpoint("webapi", "sites"), url.Values{})
 	c.Assert(err, IsNil)
 
 	var sites *getSitesResponse
@@ -1382,6 +5519,11 @@ type authProviderMock struct {
 	server services.ServerV2
 }
 
+func (mock authProviderMock) GetNamespace(n string) (*services.Namespace, error) {
+	namespace := services.NewNamespace(n)
+	return &namespace, nil
+}
+
 func (mock authProviderMock) GetNodes(n string) ([]services.Server, error) {
 	return []services.Server{&mock.server}, nil
 }
@@ -1390,6 +5532,223 @@ func (mock authProviderMock) GetSessionEvents(n string, s session.ID, c int, p b
 	return []events.EventFields{}, nil
 }
 
+// sessionProviderMock is an authProviderMock whose backend knows one
+// session record, scoped by namespace like the real session service.
+type sessionProviderMock struct {
+	authProviderMock
+	session *session.Session
+}
+
+func (mock sessionProviderMock) GetSession(namespace string, sid session.ID) (*session.Session, error) {
+	if mock.session == nil || mock.session.ID != sid || mock.session.Namespace != namespace {
+		return nil, trace.NotFound("no session %v in namespace %v", sid, namespace)
+	}
+	return mock.session, nil
+}
+
+func (mock sessionProviderMock) GetNamespaces() ([]services.Namespace, error) {
+	namespaces := []services.Namespace{{Metadata: services.Metadata{Name: defaults.Namespace}}}
+	if mock.session != nil && mock.session.Namespace != defaults.Namespace {
+		namespaces = append(namespaces, services.Namespace{Metadata: services.Metadata{Name: mock.session.Namespace}})
+	}
+	return namespaces, nil
+}
+
+// singleNodeProviderMock counts lookups so tests can prove which
+// resolution path was taken.
+type singleNodeProviderMock struct {
+	authProviderMock
+	getNodeCalls  int
+	getNodesCalls int
+}
+
+func (mock *singleNodeProviderMock) GetNode(namespace string, name string) (services.Server, error) {
+	mock.getNodeCalls++
+	if mock.server.GetName() != name {
+		return nil, trace.NotFound("node %q not found", name)
+	}
+	return &mock.server, nil
+}
+
+func (mock *singleNodeProviderMock) GetNodes(n string) ([]services.Server, error) {
+	mock.getNodesCalls++
+	return mock.authProviderMock.GetNodes(n)
+}
+
+// labelNodeProviderMock adds the server-side label match on top of the
+// counting mocks.
+type labelNodeProviderMock struct {
+	singleNodeProviderMock
+	getNodeByLabelsCalls int
+}
+
+func (mock *labelNodeProviderMock) GetNodeByLabels(namespace string, labels map[string]string) (services.Server, error) {
+	mock.getNodeByLabelsCalls++
+	if mock.server.MatchAgainst(labels) {
+		return &mock.server, nil
+	}
+	return nil, trace.NotFound("no nodes match")
+}
+
+// joinProviderMock knows about one existing session; any other session ID
+// is reported as not found, like a session that has not started yet.
+type joinProviderMock struct {
+	authProviderMock
+	existing session.ID
+}
+
+func (mock joinProviderMock) GetSessionEvents(n string, sid session.ID, after int, p bool) ([]events.EventFields, error) {
+	if sid == mock.existing {
+		return []events.EventFields{{"event": events.SessionStartEvent}}, nil
+	}
+	return nil, trace.NotFound("session %v not found", sid)
+}
+
+// deniedNamespaceMock refuses namespace reads the way the auth API does
+// for a user whose roles do not cover the namespace.
+type deniedNamespaceMock struct {
+	authProviderMock
+}
+
+func (mock deniedNamespaceMock) GetNamespace(n string) (*services.Namespace, error) {
+	return nil, trace.AccessDenied("access to namespace %q denied", n)
+}
+
+// gaugeValue reads the current value of a prometheus gauge.
+func gaugeValue(c *C, gauge prometheus.Gauge) float64 {
+	var metric dto.Metric
+	c.Assert(gauge.Write(&metric), IsNil)
+	return metric.GetGauge().GetValue()
+}
+
+// counterValue reads the current value of a prometheus counter.
+func counterValue(c *C, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	c.Assert(counter.Write(&metric), IsNil)
+	return metric.GetCounter().GetValue()
+}
+
+// logCaptureHook records every log entry fired through it.
+type logCaptureHook struct {
+	entries []*logrus.Entry
+}
+
+func (h *logCaptureHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logCaptureHook) Fire(entry *logrus.Entry) error {
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+// flakyProviderMock returns an empty node list for the first calls and
+// the real one afterwards, mimicking a stale backend cache or a node
+// that only just registered.
+type flakyProviderMock struct {
+	empty  int
+	calls  int
+	server services.ServerV2
+}
+
+func (mock *flakyProviderMock) GetNamespace(n string) (*services.Namespace, error) {
+	namespace := services.NewNamespace(n)
+	return &namespace, nil
+}
+
+func (mock *flakyProviderMock) GetNodes(n string) ([]services.Server, error) {
+	mock.calls++
+	if mock.calls <= mock.empty {
+		return nil, nil
+	}
+	return []services.Server{&mock.server}, nil
+}
+
+func (mock *flakyProviderMock) GetSessionEvents(n string, s session.ID, c int, p bool) ([]events.EventFields, error) {
+	return []events.EventFields{}, nil
+}
+
+// eventProviderMock serves a fixed list of events honoring the cursor the
+// caller resumes from.
+type eventProviderMock struct {
+	events []events.EventFields
+}
+
+func (mock *eventProviderMock) GetNamespace(n string) (*services.Namespace, error) {
+	namespace := services.NewNamespace(n)
+	return &namespace, nil
+}
+
+func (mock *eventProviderMock) GetNodes(n string) ([]services.Server, error) {
+	return nil, nil
+}
+
+func (mock *eventProviderMock) GetSessionEvents(n string, sid session.ID, after int, p bool) ([]events.EventFields, error) {
+	var out []events.EventFields
+	for _, event := range mock.events {
+		if event.GetInt(events.EventCursor) >= after {
+			out = append(out, event)
+		}
+	}
+	return out, nil
+}
+
+// syncWriterMock captures writes coming from multiple goroutines.
+type syncWriterMock struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (mock *syncWriterMock) Write(data []byte) (int, error) {
+	mock.Lock()
+	defer mock.Unlock()
+	return mock.buffer.Write(data)
+}
+
+func (mock *syncWriterMock) String() string {
+	mock.Lock()
+	defer mock.Unlock()
+	return mock.buffer.String()
+}
+
+type recordingStatusMock struct {
+	backlog int
+	failed  bool
+}
+
+func (mock recordingStatusMock) RecordingBacklog() (int, bool) {
+	return mock.backlog, mock.failed
+}
+
+// pipeReadWriter glues two pipe halves into the single channel the scp
+// protocol speaks over.
+type pipeReadWriter struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (p *pipeReadWriter) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *pipeReadWriter) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+// newSCPPipe builds a connected local/remote channel pair out of OS pipes
+// (buffered, like a real SSH channel). The returned closer is the local
+// write end, closing it signals EOF to the remote side.
+func newSCPPipe(c *C) (local, remote io.ReadWriter, localIn io.Closer) {
+	remoteR, localW, err := os.Pipe()
+	c.Assert(err, IsNil)
+	localR, remoteW, err := os.Pipe()
+	c.Assert(err, IsNil)
+
+	local = &pipeReadWriter{r: localR, w: localW}
+	remote = &pipeReadWriter{r: remoteR, w: remoteW}
+	return local, remote, localW
+}
+
 func (s *WebSuite) makeTerminal(pack *authPack, opts ...session.ID) (*websocket.Conn, error) {
 	var sessionID session.ID
 	if len(opts) == 0 {
@@ -1398,12 +5757,7 @@ func (s *WebSuite) makeTerminal(pack *authPack, opts ...session.ID) (*websocket.
 		sessionID = opts[0]
 	}
 
-	u := url.URL{
-		Host:   s.url().Host,
-		Scheme: client.WSS,
-		Path:   fmt.Sprintf("/v1/webapi/sites/%v/connect", currentSiteShortcut),
-	}
-	data, err := json.Marshal(TerminalRequest{
+	return s.makeTerminalWithRequest(pack, TerminalRequest{
 		Server: s.srvID,
 		Login:  pack.login,
 		Term: session.TerminalParams{
@@ -1413,6 +5767,15 @@ func (s *WebSuite) makeTerminal(pack *authPack, opts ...session.ID) (*websocket.
 		SessionID:      sessionID,
 		SessionTimeout: 500 * time.Millisecond,
 	})
+}
+
+func (s *WebSuite) makeTerminalWithRequest(pack *authPack, req TerminalRequest) (*websocket.Conn, error) {
+	u := url.URL{
+		Host:   s.url().Host,
+		Scheme: client.WSS,
+		Path:   fmt.Sprintf("/v1/webapi/sites/%v/connect", currentSiteShortcut),
+	}
+	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
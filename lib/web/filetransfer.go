@@ -0,0 +1,457 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/sshutils/scp"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// fileTransferUpload moves bytes from the web client to the node.
+	fileTransferUpload = "upload"
+
+	// fileTransferDownload moves bytes from the node to the web client.
+	fileTransferDownload = "download"
+
+	// fileChunkSize is how many file bytes travel in a single frame.
+	fileChunkSize = 32 * 1024
+)
+
+// fileTransferRequest is the control message that starts a file transfer
+// over the websocket of an established terminal session.
+type fileTransferRequest struct {
+	// Operation is "upload" or "download".
+	Operation string `json:"operation"`
+
+	// Path is the path of the file on the node.
+	Path string `json:"path"`
+
+	// Size is the number of bytes the client is about to upload. It is
+	// not set for downloads.
+	Size int64 `json:"size,omitempty"`
+}
+
+// fileTransferEnvelope is used to receive a file transfer request.
+type fileTransferEnvelope struct {
+	Type    string              `json:"t"`
+	Payload fileTransferRequest `json:"p"`
+}
+
+// fileChunkEnvelope is used to send/receive a chunk of file bytes.
+type fileChunkEnvelope struct {
+	Type    string `json:"t"`
+	Payload []byte `json:"p"`
+}
+
+// fileProgressEnvelope is used to send file transfer progress (and the
+// final result) to the web client.
+type fileProgressEnvelope struct {
+	Type    string       `json:"t"`
+	Payload fileProgress `json:"p"`
+}
+
+// fileProgress describes how far along a file transfer is.
+type fileProgress struct {
+	// Transferred is the number of bytes moved so far.
+	Transferred int64 `json:"transferred"`
+
+	// Total is the size of the file when known, -1 otherwise.
+	Total int64 `json:"total"`
+
+	// Done indicates the transfer completed successfully.
+	Done bool `json:"done,omitempty"`
+
+	// Error is set when the transfer failed.
+	Error string `json:"error,omitempty"`
+}
+
+// beginFileTransfer is called from the websocket read loop when a transfer
+// control message arrives. The upload channel is allocated before the read
+// loop continues so no chunks are lost.
+func (t *TerminalHandler) beginFileTransfer(ws *websocket.Conn, req fileTransferRequest) {
+	if req.Operation == fileTransferUpload && !t.params.ReadOnly {
+		t.fileUploadCh = make(chan []byte, 64)
+	}
+	go t.runFileTransfer(ws, req)
+}
+
+// deliverFileChunk hands an upload chunk from the websocket read loop to
+// the transfer in flight. Chunks arriving outside a transfer are dropped.
+func (t *TerminalHandler) deliverFileChunk(chunk []byte) {
+	if t.fileUploadCh == nil || len(chunk) == 0 {
+		return
+	}
+	select {
+	case t.fileUploadCh <- chunk:
+	case <-t.terminalContext.Done():
+	}
+}
+
+// runFileTransfer performs the transfer and reports the final result to
+// the web client.
+func (t *TerminalHandler) runFileTransfer(ws *websocket.Conn, req fileTransferRequest) {
+	err := t.fileTransfer(ws, req)
+
+	result := fileProgress{Total: -1, Done: err == nil}
+	if err != nil {
+		log.Warnf("File transfer failed: %v.", err)
+		result.Error = err.Error()
+	}
+
+	er := websocket.JSON.Send(ws, fileProgressEnvelope{
+		Type:    defaults.FileProgressEnvelopeType,
+		Payload: result,
+	})
+	if er != nil {
+		log.Warnf("Unable to send file transfer result to web client: %v.", er)
+	}
+}
+
+// fileTransfer streams the file between the web client and the node by
+// driving the scp command on the node over the established SSH connection,
+// the same way "tsh scp" does.
+func (t *TerminalHandler) fileTransfer(ws *websocket.Conn, req fileTransferRequest) error {
+	// A read-only observer may watch the session but not move files to or
+	// from the node: a transfer rides the same SSH connection the typed
+	// input gate protects.
+	if t.params.ReadOnly {
+		return trace.AccessDenied("read-only session: file transfers are disabled")
+	}
+	if t.sshClient == nil {
+		return trace.NotFound("no established connection to the node")
+	}
+	if req.Path == "" {
+		return trace.BadParameter("path: missing file path")
+	}
+
+	sendProgress := func(transferred int64, total int64) {
+		er := websocket.JSON.Send(ws, fileProgressEnvelope{
+			Type:    defaults.FileProgressEnvelopeType,
+			Payload: fileProgress{Transferred: transferred, Total: total},
+		})
+		if er != nil {
+			log.Warnf("Unable to send file transfer progress to web client: %v.", er)
+		}
+	}
+
+	switch req.Operation {
+	case fileTransferUpload:
+		if req.Size <= 0 {
+			return trace.BadParameter("size: missing upload size")
+		}
+		data := &chunkReader{ch: t.fileUploadCh, ctx: t.terminalContext}
+		return t.scpSession("/usr/bin/scp -t "+shellQuote(req.Path), func(ch io.ReadWriter) error {
+			err := uploadFile(ch, filepath.Base(req.Path), req.Size, data, func(transferred int64) {
+				sendProgress(transferred, req.Size)
+			})
+			return trace.Wrap(err)
+		})
+	case fileTransferDownload:
+		return t.scpSession("/usr/bin/scp -f "+shellQuote(req.Path), func(ch io.ReadWriter) error {
+			_, _, err := downloadFile(ch, &fileChunkWriter{ws: ws, terminal: t}, func(transferred int64) {
+				sendProgress(transferred, -1)
+			})
+			return trace.Wrap(err)
+		})
+	default:
+		return trace.BadParameter("unsupported file transfer operation %q", req.Operation)
+	}
+}
+
+// shellQuote wraps a client-supplied path in single quotes so the remote
+// shell treats it as one literal argument: spaces survive and shell
+// metacharacters cannot break out of the scp invocation. An embedded
+// single quote is closed, escaped and reopened.
+func shellQuote(path string) string {
+	return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
+
+// scpSession opens a session on the established SSH connection, starts the
+// remote scp command and hands the session's stdin/stdout to fn as a
+// single channel. The transfer is canceled when the terminal closes.
+func (t *TerminalHandler) scpSession(shellCmd string, fn func(ch io.ReadWriter) error) error {
+	s, err := t.sshClient.NewSession()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer s.Close()
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	ch := utils.NewPipeNetConn(
+		stdout,
+		stdin,
+		utils.MultiCloser(),
+		&net.IPAddr{},
+		&net.IPAddr{},
+	)
+
+	fnC := make(chan error, 1)
+	go func() {
+		fnC <- fn(ch)
+		stdin.Close()
+	}()
+
+	runC := make(chan error, 1)
+	go func() { runC <- s.Run(shellCmd) }()
+
+	var runErr error
+	select {
+	case <-t.terminalContext.Done():
+		// The terminal is going away, tear the session down to cancel the
+		// transfer.
+		s.Close()
+		runErr = trace.ConnectionProblem(nil, "terminal closed during file transfer")
+	case runErr = <-runC:
+	}
+
+	err = <-fnC
+	if trace.IsEOF(err) {
+		err = nil
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(runErr)
+}
+
+// uploadFile streams size bytes of data to the remote "scp -t" sink over
+// ch, speaking the scp source protocol. progress is called as bytes go
+// out.
+func uploadFile(ch io.ReadWriter, name string, size int64, data io.Reader, progress func(transferred int64)) error {
+	// The sink starts by acknowledging the session.
+	err := readSCPResponse(ch)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// Announce the file, then wait for the go-ahead.
+	_, err = fmt.Fprintf(ch, "C0644 %d %s\n", size, name)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	err = readSCPResponse(ch)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// Stream the file bytes in chunks so progress can be reported.
+	buffer := make([]byte, fileChunkSize)
+	remaining := size
+	for remaining > 0 {
+		chunkLen := int64(len(buffer))
+		if remaining < chunkLen {
+			chunkLen = remaining
+		}
+		n, err := io.ReadFull(data, buffer[:chunkLen])
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		_, err = ch.Write(buffer[:n])
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		remaining -= int64(n)
+		if progress != nil {
+			progress(size - remaining)
+		}
+	}
+
+	// Seal the file and collect the sink's acknowledgment.
+	_, err = ch.Write([]byte{scp.OKByte})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(readSCPResponse(ch))
+}
+
+// downloadFile speaks the scp sink protocol against the remote "scp -f"
+// source on ch and streams the file bytes into sink. It returns the name
+// and size of the received file.
+func downloadFile(ch io.ReadWriter, sink io.Writer, progress func(transferred int64)) (string, int64, error) {
+	// Kick the source into sending the file header.
+	_, err := ch.Write([]byte{scp.OKByte})
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+
+	line, err := readSCPLine(ch)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	if len(line) == 0 || line[0] != 'C' {
+		return "", 0, trace.BadParameter("expected a file header, got %q", line)
+	}
+	fc, err := scp.ParseNewFile(line[1:])
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+
+	// Acknowledge the header, then stream the file bytes.
+	_, err = ch.Write([]byte{scp.OKByte})
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+
+	buffer := make([]byte, fileChunkSize)
+	remaining := int64(fc.Length)
+	for remaining > 0 {
+		chunkLen := int64(len(buffer))
+		if remaining < chunkLen {
+			chunkLen = remaining
+		}
+		n, err := io.ReadFull(ch, buffer[:chunkLen])
+		if err != nil {
+			return "", 0, trace.Wrap(err)
+		}
+		_, err = sink.Write(buffer[:n])
+		if err != nil {
+			return "", 0, trace.Wrap(err)
+		}
+		remaining -= int64(n)
+		if progress != nil {
+			progress(int64(fc.Length) - remaining)
+		}
+	}
+
+	// The source seals the file with an acknowledgment of its own.
+	err = readSCPResponse(ch)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	_, err = ch.Write([]byte{scp.OKByte})
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+
+	return fc.Name, int64(fc.Length), nil
+}
+
+// readSCPResponse reads a single scp acknowledgment: a zero byte for OK, a
+// warning/error byte followed by a message line otherwise.
+func readSCPResponse(ch io.Reader) error {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(ch, b)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	switch b[0] {
+	case scp.OKByte:
+		return nil
+	case scp.WarnByte, scp.ErrByte:
+		message, err := readSCPLine(ch)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Errorf(message)
+	}
+	return trace.BadParameter("unrecognized scp response %#v", b)
+}
+
+// readSCPLine reads bytes up to the newline that ends every scp command.
+// It reads one byte at a time so no file data is consumed by accident.
+func readSCPLine(ch io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(ch, b)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if len(line) > 0 && (line[0] == scp.WarnByte || line[0] == scp.ErrByte) {
+		return "", trace.Errorf(strings.TrimSpace(string(line[1:])))
+	}
+	return string(line), nil
+}
+
+// chunkReader adapts upload chunks delivered over the websocket to the
+// io.Reader the scp protocol streams from.
+type chunkReader struct {
+	ch  chan []byte
+	ctx context.Context
+
+	// buf holds the remainder of a chunk that did not fit into the buffer
+	// passed to Read.
+	buf []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		select {
+		case chunk := <-r.ch:
+			r.buf = chunk
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fileChunkWriter frames downloaded file bytes for the websocket.
+type fileChunkWriter struct {
+	ws       *websocket.Conn
+	terminal *TerminalHandler
+}
+
+func (w *fileChunkWriter) Write(data []byte) (int, error) {
+	if w.terminal != nil && w.terminal.binaryOutput() {
+		err := websocket.Message.Send(w.ws, encodeBinaryFrame(defaults.FileTransferWebsocketPrefix, data))
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+		return len(data), nil
+	}
+
+	err := websocket.JSON.Send(w.ws, fileChunkEnvelope{
+		Type:    defaults.FileChunkEnvelopeType,
+		Payload: data,
+	})
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return len(data), nil
+}
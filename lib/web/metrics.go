@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webTerminalActiveSessions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "web_terminal_active_sessions",
+			Help: "Number of web terminal sessions currently connected",
+		},
+	)
+	webTerminalSessionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "web_terminal_sessions_total",
+			Help: "Total number of web terminal sessions served",
+		},
+	)
+	webTerminalBytesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "web_terminal_received_bytes_total",
+			Help: "Terminal bytes received from web clients",
+		},
+	)
+	webTerminalBytesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "web_terminal_sent_bytes_total",
+			Help: "Terminal bytes sent to web clients",
+		},
+	)
+	webTerminalSlowClientWarnings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "web_terminal_slow_client_warnings_total",
+			Help: "Times a web terminal output backlog crossed the slow client threshold",
+		},
+	)
+	webTerminalSessionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "web_terminal_session_duration_seconds",
+			Help: "Duration of web terminal sessions",
+			// Buckets from one second up to a full working day
+			Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+		},
+	)
+)
+
+func init() {
+	// Metrics have to be registered to be exposed:
+	prometheus.MustRegister(webTerminalActiveSessions)
+	prometheus.MustRegister(webTerminalSessionsTotal)
+	prometheus.MustRegister(webTerminalBytesReceived)
+	prometheus.MustRegister(webTerminalBytesSent)
+	prometheus.MustRegister(webTerminalSlowClientWarnings)
+	prometheus.MustRegister(webTerminalSessionDuration)
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gravitational/trace"
@@ -59,6 +60,56 @@ type SessionContext struct {
 	parent    *sessionCache
 	closers   []io.Closer
 	tc        *client.TeleportClient
+
+	// eventCursors tracks the last audit event delivered to the web client
+	// per terminal session so reconnects can resume without duplicates.
+	eventCursors map[session.ID]int
+
+	// scrollbacks holds the recent terminal output per session so a new
+	// connection joining the session can have it replayed.
+	scrollbacks map[session.ID]*scrollbackBuffer
+}
+
+// GetEventCursor returns the index of the last audit event delivered to the
+// web client for the given session, or -1 when nothing has been delivered
+// yet.
+func (c *SessionContext) GetEventCursor(sid session.ID) int {
+	c.Lock()
+	defer c.Unlock()
+	if cursor, ok := c.eventCursors[sid]; ok {
+		return cursor
+	}
+	return -1
+}
+
+// SetEventCursor records the index of the last audit event delivered to the
+// web client for the given session. The cursor outlives the individual
+// terminal connection so a reconnect resumes strictly after it.
+func (c *SessionContext) SetEventCursor(sid session.ID, cursor int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.eventCursors == nil {
+		c.eventCursors = make(map[session.ID]int)
+	}
+	c.eventCursors[sid] = cursor
+}
+
+// GetScrollback returns the scrollback buffer for the given session,
+// creating it with the requested capacity on first use. The buffer outlives
+// the individual terminal connection so a browser tab reload can have the
+// recent output replayed.
+func (c *SessionContext) GetScrollback(sid session.ID, capacity int) *scrollbackBuffer {
+	c.Lock()
+	defer c.Unlock()
+	if c.scrollbacks == nil {
+		c.scrollbacks = make(map[session.ID]*scrollbackBuffer)
+	}
+	buffer, ok := c.scrollbacks[sid]
+	if !ok {
+		buffer = newScrollbackBuffer(capacity)
+		c.scrollbacks[sid] = buffer
+	}
+	return buffer
 }
 
 func (c *SessionContext) AddClosers(closers ...io.Closer) {
@@ -17,20 +17,36 @@ limitations under the License.
 package web
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/net/websocket"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/unicode"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/client"
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
@@ -41,6 +57,8 @@ import (
 
 	"github.com/gravitational/trace"
 
+	"github.com/jonboulle/clockwork"
+	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -62,31 +80,550 @@ type TerminalRequest struct {
 	// Namespace is node namespace.
 	Namespace string `json:"namespace"`
 
-	// ProxyHostPort is the address of the server to connect to.
-	ProxyHostPort string `json:"-"`
+	// ProxyHostPort is the address of the proxy to connect through, in the
+	// "host:webport,sshport" notation of --proxy. Empty means the proxy
+	// serving this request; a client supplied value lets multi-proxy setups
+	// pin a specific (e.g. nearest) proxy and must refer to a proxy
+	// registered in the cluster.
+	ProxyHostPort string `json:"proxy_host_port,omitempty"`
 
 	// Cluster is the name of the remote cluster to connect to.
 	Cluster string `json:"-"`
 
+	// AllowedOrigins, when non-empty, restricts the websocket handshake to
+	// requests whose Origin header host matches an entry. Entries are
+	// exact hosts or wildcard subdomains ("*.example.com"). Empty keeps
+	// the empty origin checker, see Serve. Set by the embedding server,
+	// not the client.
+	AllowedOrigins []string `json:"-"`
+
+	// TrustedProxies is a list of CIDR blocks of load balancers and reverse
+	// proxies trusted to report the real client address through the
+	// X-Forwarded-For / Forwarded headers. When the websocket peer falls in
+	// one of the blocks the audit client address comes from those headers,
+	// otherwise the peer address is used verbatim. Set by the embedding
+	// server, not the client.
+	TrustedProxies []string `json:"-"`
+
 	// InteractiveCommand is a command to execut.e
 	InteractiveCommand []string `json:"-"`
 
+	// Subsystem, when set, requests the named SSH subsystem on the node
+	// instead of a shell or command. No PTY is allocated: subsystems speak
+	// their own protocol over the raw channel. Mutually exclusive with
+	// InteractiveCommand.
+	Subsystem string `json:"subsystem,omitempty"`
+
+	// InitCommand is written to the shell's stdin verbatim right after the
+	// shell is created, seeding an otherwise interactive session (for
+	// example "cd /app\n"). Unlike InteractiveCommand the shell stays
+	// open. Nothing is appended or escaped: without a trailing newline the
+	// shell executes nothing, and any newlines included run exactly like
+	// typed input would.
+	InitCommand string `json:"init_command,omitempty"`
+
+	// RecordToPath names a file, relative to WebRecordingDir, to tee a
+	// timing annotated transcript of the session output into on the proxy.
+	// The transcript holds exactly what the web client saw, independent of
+	// any cluster side recording. Rejected unless WebRecordingDir is set.
+	RecordToPath string `json:"record_to_path,omitempty"`
+
 	// SessionTimeout is how long to wait for the session end event to arrive.
 	SessionTimeout time.Duration
+
+	// EndOn selects which condition tears the session down: "ssh-exit"
+	// closes as soon as the SSH connection returns, "audit-end" waits for
+	// the session end audit event, "both" (the default) closes on SSH
+	// exit after giving the end event SessionTimeout to arrive.
+	EndOn string `json:"end_on,omitempty"`
+
+	// ReportRecordingStatus requests periodic frames with the status of the
+	// session recording upload (proxy-recorded sessions only).
+	ReportRecordingStatus bool `json:"report_recording_status,omitempty"`
+
+	// LineBuffered requests line buffered terminal output: frames are held
+	// back until a newline is seen or a short flush interval expires. This
+	// reduces the frame rate for clients that can not handle high frequency
+	// frames at the cost of some interactivity.
+	LineBuffered bool `json:"line_buffered,omitempty"`
+
+	// ServeDeadline bounds the total lifetime of the connection: from the
+	// websocket upgrade all the way to teardown. Unlike idle timeouts it
+	// also covers sessions that never make it out of the connecting phase.
+	// Zero means no deadline.
+	ServeDeadline time.Duration
+
+	// BinaryProtocol requests binary websocket frames for raw terminal
+	// bytes: a single prefix byte followed by the PTY bytes untouched. This
+	// avoids the UTF-8 round trip that corrupts non UTF-8 output. When
+	// false the UTF-8 text envelopes are used for backward compatibility.
+	BinaryProtocol bool `json:"binary_protocol,omitempty"`
+
+	// BinaryOutput overrides BinaryProtocol for server to client frames
+	// only, so output can be binary while input stays UTF-8 text (or the
+	// other way around).
+	BinaryOutput *bool `json:"binary_output,omitempty"`
+
+	// BinaryInput overrides BinaryProtocol for client to server frames
+	// only.
+	BinaryInput *bool `json:"binary_input,omitempty"`
+
+	// PhaseTimeouts maps a connect phase (see client.ConnectPhase*) to the
+	// time the connection may spend in it. When a phase exceeds its budget
+	// the error sent to the client names the phase that stalled. Phases
+	// without a budget have no deadline.
+	PhaseTimeouts map[string]time.Duration `json:"phase_timeouts,omitempty"`
+
+	// CoalesceEvents lists the audit event types for which runs of
+	// consecutive events are collapsed into a single summary event (last
+	// payload plus a count) to reduce browser load.
+	CoalesceEvents []string `json:"coalesce_events,omitempty"`
+
+	// EventFilter lists the audit event types forwarded to the web client.
+	// An empty list forwards everything. Lets lightweight consumers (like a
+	// dashboard) subscribe to only "session.join"/"session.leave"/"resize"
+	// instead of the full stream.
+	EventFilter []string `json:"event_filter,omitempty"`
+
+	// EventBufferSize caps the number of audit events buffered between the
+	// event source and the websocket sender. On overflow the oldest
+	// droppable event is discarded (session lifecycle events never are)
+	// and the drop is reported to the client. Zero means the default.
+	EventBufferSize int `json:"event_buffer_size,omitempty"`
+
+	// EventPollInterval is how often the backend is polled for audit
+	// events that are not pushed over the events channel. Busy sessions
+	// can back off while quiet ones stay responsive. Zero means the
+	// default period.
+	EventPollInterval time.Duration `json:"event_poll_interval,omitempty"`
+
+	// EventBatchSize caps how many audit events a single poll delivers.
+	// The cursor only advances past delivered events, the rest follow on
+	// the next poll. Zero means no cap.
+	EventBatchSize int `json:"event_batch_size,omitempty"`
+
+	// ReplayEventsAfter asks for the audit events already recorded for the
+	// session, from this index forward, to be replayed before any live
+	// event so a joiner gets context. Replayed events are tagged with the
+	// HistoricalEnvelopeType and the range is capped to the most recent
+	// MaxReplayEvents. Zero (the default) disables the replay.
+	ReplayEventsAfter int `json:"replay_events_after,omitempty"`
+
+	// CompressEvents enables per frame gzip compression of large audit
+	// event frames. Compressed frames are sent as binary messages with
+	// the AuditGzipWebsocketPrefix so the client knows to inflate them.
+	CompressEvents bool `json:"compress_events,omitempty"`
+
+	// Compress enables per frame deflate compression of large terminal
+	// output frames, worthwhile for verbose output over slow links.
+	// Compressed frames are sent as binary messages with the
+	// CompressedRawWebsocketPrefix so the client knows to inflate them.
+	Compress bool `json:"compress,omitempty"`
+
+	// CompressThreshold is the frame size in bytes above which an audit or
+	// terminal output frame is compressed; tiny frames (keystroke echo)
+	// are cheaper to send as is. Zero means the per stream default,
+	// defaults.AuditGzipThresholdBytes for audit frames and
+	// defaults.RawDeflateThresholdBytes for terminal output.
+	CompressThreshold int `json:"compress_threshold,omitempty"`
+
+	// CompressLevel is the compression level for both streams, zero means
+	// the library default.
+	CompressLevel int `json:"compress_level,omitempty"`
+
+	// NodeResolutionTimeout is how long to keep re-querying the backend
+	// when the requested node is not in the returned list yet: a freshly
+	// joined node (or a stale cache read) shows up a moment later. Zero
+	// fails on the first miss like before.
+	NodeResolutionTimeout time.Duration `json:"node_resolution_timeout,omitempty"`
+
+	// Principal selects which certificate principal the client identifies
+	// with, for users whose certificate carries several (per principal
+	// RBAC on the node). Empty means the certificate's first principal.
+	Principal string `json:"principal,omitempty"`
+
+	// ResumeToken re-attaches to an existing session after a transient
+	// websocket drop. The token is handed out in the metadata frame of
+	// the original connection and stays valid for the grace period.
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// MaxOutputBytesPerSec bounds the rate terminal output is written to
+	// the websocket. When the limit is hit writes block rather than drop
+	// data, so backpressure reaches the SSH channel. Zero means no limit.
+	MaxOutputBytesPerSec int `json:"max_output_bytes_per_sec,omitempty"`
+
+	// MaxFrameBytes caps the size of a single inbound websocket frame.
+	// An oversized frame is rejected before decoding and tears the
+	// connection down, so a malicious client can not exhaust memory with
+	// a single frame. Zero means the default cap.
+	MaxFrameBytes int `json:"max_frame_bytes,omitempty"`
+
+	// HeartbeatInterval is how often a synthetic "session.heartbeat"
+	// audit event is emitted while the terminal is connected, so audit
+	// consumers see liveness from long idle sessions. Distinct from the
+	// network keepalive. Zero disables heartbeats.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval,omitempty"`
+
+	// MaxTermWidth bounds the PTY width requested from the node, both at
+	// session start and on resize. Zero means defaults.MaxTerminalWidth.
+	// Oversized requests are clamped and logged, not forwarded verbatim.
+	MaxTermWidth int `json:"max_term_width,omitempty"`
+
+	// MaxTermHeight bounds the PTY height requested from the node, zero
+	// means defaults.MaxTerminalHeight.
+	MaxTermHeight int `json:"max_term_height,omitempty"`
+
+	// RequestID is an opaque ID the browser attaches so its logs can be
+	// correlated with server logs: every log line of the handler carries
+	// it and it is echoed back in the session metadata frame. A UUID is
+	// generated when the client does not supply one.
+	RequestID string `json:"request_id,omitempty"`
+
+	// StrictHostKeyChecking controls verification of the host key the node
+	// presents against the cluster's trusted host authorities. It defaults
+	// to true: accepting unverified host keys has to be requested
+	// explicitly.
+	StrictHostKeyChecking *bool `json:"strict_host_key_checking,omitempty"`
+
+	// KeepAliveInterval is how often a keepalive ping is sent to the web
+	// client. Clients that miss too many pings in a row (a closed laptop
+	// lid, lost network) have their session torn down promptly instead of
+	// lingering until the session timeout. Zero disables keepalives.
+	KeepAliveInterval time.Duration `json:"keepalive_interval,omitempty"`
+
+	// WriteTimeout bounds every websocket send. A client that stops
+	// draining its connection trips the deadline and the session is torn
+	// down, instead of the output goroutine blocking forever while the
+	// SSH session keeps producing data. Zero disables the deadline.
+	WriteTimeout time.Duration `json:"write_timeout,omitempty"`
+
+	// PasteChunkBytes breaks oversized input frames (clipboard pastes)
+	// into chunks of at most this many bytes, fed to the node with a
+	// short gap in between so terminal applications are not hit with one
+	// giant write. Keystroke-sized input is unaffected. Zero disables
+	// chunking.
+	PasteChunkBytes int `json:"paste_chunk_bytes,omitempty"`
+
+	// DefaultPort is the SSH port used when the server name carries no
+	// explicit port, for clusters standardized on a non-standard port so
+	// users do not have to type it. Zero keeps the old behavior of
+	// letting the client pick the port.
+	DefaultPort int `json:"default_port,omitempty"`
+
+	// IdleTimeout closes the session after this long without any user
+	// activity: keyboard input or terminal output. A long-running command
+	// that keeps printing counts as activity, resize and control frames
+	// do not. Zero disables the idle timeout.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// PongTimeout is the network-level liveness deadline: the session is
+	// torn down when no keepalive pong has come back for this long,
+	// independent of IdleTimeout which tracks user activity. Zero falls
+	// back to counting missed pings (defaults.MaxMissedKeepAlives times
+	// KeepAliveInterval). Only meaningful with KeepAliveInterval set.
+	PongTimeout time.Duration `json:"pong_timeout,omitempty"`
+
+	// KeepAliveJitter randomizes each keepalive interval by up to this
+	// fraction in either direction, so many sessions started at once do not
+	// ping in lockstep. Must be in [0, 1); zero means the default
+	// defaults.KeepAliveJitter.
+	KeepAliveJitter float64 `json:"keepalive_jitter,omitempty"`
+
+	// ForwardAgent controls whether the user's SSH agent is forwarded to
+	// the remote node. The agent is always used locally to authenticate
+	// the connection; this only controls whether processes on the node can
+	// reach it. Unset keeps the historical default of forwarding.
+	ForwardAgent *bool `json:"forward_agent,omitempty"`
+
+	// RecordingMode is where the cluster records sessions, one of
+	// services.RecordAtNode (the default), services.RecordAtProxy or
+	// services.RecordOff. In proxy recording mode the recording proxy sits
+	// in the connection path: agent forwarding is forced on so the proxy
+	// can dial the node on the user's behalf, and node host key
+	// verification is the proxy's job.
+	RecordingMode string `json:"recording_mode,omitempty"`
+
+	// StripBOM removes a UTF-8 byte order mark from the very beginning of
+	// the output stream. Some programs (notably on Windows) prefix their
+	// output with one and it renders as a stray character in the browser
+	// terminal. Only the opening bytes of the stream are considered, a
+	// BOM-looking sequence later in the output passes through untouched.
+	StripBOM bool `json:"strip_bom,omitempty"`
+
+	// ScrollbackBytes keeps a bounded buffer of the most recent terminal
+	// output which is replayed when a new connection joins the session, so
+	// a browser tab reload does not come back to a blank screen. Zero
+	// disables the scrollback buffer.
+	ScrollbackBytes int `json:"scrollback_bytes,omitempty"`
+
+	// ReplayChunkBytes caps the size of a single scrollback replay frame,
+	// so large backlogs do not exceed browser frame limits. Zero means
+	// the default chunk size.
+	ReplayChunkBytes int `json:"replay_chunk_bytes,omitempty"`
+
+	// ReplayChunkDelay is the pause between scrollback replay frames,
+	// giving the browser a chance to render the history progressively.
+	// Zero means the default delay.
+	ReplayChunkDelay time.Duration `json:"replay_chunk_delay,omitempty"`
+
+	// ResumeFromSeq is the absolute scrollback byte offset the client
+	// already holds locally, so on reconnect only newer output is
+	// replayed. When the offset is older than what the buffer still
+	// retains the full tail is replayed instead, flagged in the metadata
+	// frame. Zero replays the full tail.
+	ResumeFromSeq int `json:"resume_from_seq,omitempty"`
+
+	// ProtocolVersion is the version of the websocket terminal protocol
+	// the client speaks. Frames older clients do not understand (like the
+	// structured close envelope) are only sent when the client declares a
+	// version that includes them.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+
+	// Env is the set of environment variables to request for the session,
+	// the same way "tsh ssh --env" works. The reserved session variable
+	// can not be overridden.
+	Env map[string]string `json:"env,omitempty"`
+
+	// TermType is the terminal type requested for the server-side PTY, for
+	// example "xterm-256color". It is validated against an allowlist and
+	// defaults to the safe "xterm".
+	TermType string `json:"term_type,omitempty"`
+
+	// ResizeDebouncePeriod is how often at most window-change requests are
+	// forwarded to the node: only the most recent size is sent every
+	// period. Zero means the default.
+	ResizeDebouncePeriod time.Duration `json:"resize_debounce_period,omitempty"`
+
+	// ReadOnly joins the session as an observer: typed input is discarded
+	// before it reaches the node while output, resize and audit events
+	// still flow. Meant for auditors and shadowing.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// EventsOnly serves a detached monitoring session: no SSH connection
+	// is made and no terminal output flows, the websocket only carries the
+	// audit events of the session, polled from the backend. Meant for
+	// monitoring tools that do not want a shell.
+	EventsOnly bool `json:"events_only,omitempty"`
+
+	// InvalidUTF8 is how invalid UTF-8 in terminal output is handled:
+	// "replace" (the default) substitutes the Unicode replacement
+	// character, "fail" aborts output like before. Programs legitimately
+	// emit non UTF-8 bytes, so "replace" keeps the session alive.
+	InvalidUTF8 string `json:"invalid_utf8,omitempty"`
+
+	// DetectBell emits a bell notification frame whenever terminal output
+	// contains a BEL character, so the UI can flash the tab or play a
+	// sound. The BEL byte stays in the raw stream. Off by default to
+	// avoid scanning every output write.
+	DetectBell bool `json:"detect_bell,omitempty"`
+
+	// BracketedPaste wraps content arriving in paste frames in the xterm
+	// bracketed paste markers (ESC [200~ ... ESC [201~) so terminal
+	// applications can tell a paste apart from typed input.
+	BracketedPaste bool `json:"bracketed_paste,omitempty"`
+
+	// Charset is the character encoding the remote node emits and expects.
+	// Terminal output is decoded from it to the UTF-8 the browser renders,
+	// keyboard input is encoded back before it reaches the node. Empty
+	// means UTF-8. Binary protocol frames pass bytes through untouched.
+	// See terminalCharsets for the supported names.
+	Charset string `json:"charset,omitempty"`
+}
+
+const (
+	// invalidUTF8Replace substitutes invalid byte sequences in terminal
+	// output with the Unicode replacement character.
+	invalidUTF8Replace = "replace"
+
+	// invalidUTF8Fail aborts terminal output on invalid byte sequences.
+	invalidUTF8Fail = "fail"
+)
+
+const (
+	// endOnSSHExit tears the session down as soon as the SSH connection
+	// returns, without waiting for the session end audit event.
+	endOnSSHExit = "ssh-exit"
+
+	// endOnAuditEnd tears the session down when the session end audit
+	// event arrives, even if the SSH connection is still up.
+	endOnAuditEnd = "audit-end"
+
+	// endOnBoth tears the session down when the SSH connection returns,
+	// after a bounded window for the session end event to arrive. This is
+	// the historical behavior and the default.
+	endOnBoth = "both"
+)
+
+// terminalCharsets maps the charset names a TerminalRequest may select to
+// their encodings. The table covers what the vendored encoding packages
+// provide; supporting another charset (Shift-JIS, GBK, Latin-1) is
+// vendoring its golang.org/x/text package and adding an entry.
+var terminalCharsets = map[string]encoding.Encoding{
+	"":         unicode.UTF8,
+	"utf-8":    unicode.UTF8,
+	"utf-16le": unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be": unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// lookupCharset resolves a requested charset name, empty selects UTF-8.
+func lookupCharset(name string) (encoding.Encoding, error) {
+	enc, ok := terminalCharsets[strings.ToLower(name)]
+	if !ok {
+		return nil, trace.BadParameter("charset: unsupported charset %q", name)
+	}
+	return enc, nil
+}
+
+// TerminalOption mutates a TerminalHandler as NewTerminal constructs it.
+// Options are applied after request validation, so they win over request
+// fields.
+type TerminalOption func(*TerminalHandler)
+
+// WithCharset overrides the session character encoding with an arbitrary
+// encoding.Encoding, bypassing the terminalCharsets table. It is meant for
+// embedders with a vendored encoding the table does not list and for tests
+// injecting a custom transform into the framing layer.
+func WithCharset(enc encoding.Encoding) TerminalOption {
+	return func(t *TerminalHandler) {
+		t.charset = enc
+	}
+}
+
+// WithDefaultEnv sets cluster-level default environment variables (locale
+// settings like LANG) injected into every session below the user-supplied
+// Env, so a user can still override them and the reserved session variable
+// still wins over both.
+func WithDefaultEnv(env map[string]string) TerminalOption {
+	return func(t *TerminalHandler) {
+		t.defaultEnv = env
+	}
+}
+
+// WithHostKeyCallback replaces the built-in host certificate check with a
+// custom verification policy (checking keys against an external inventory,
+// for example). When not provided the built-in check runs.
+func WithHostKeyCallback(callback ssh.HostKeyCallback) TerminalOption {
+	return func(t *TerminalHandler) {
+		t.hostKeyCallback = callback
+	}
+}
+
+// CloseInfo describes how a terminal session ended. It is handed to the
+// close callback so embedders have a single place to hook teardown
+// accounting.
+type CloseInfo struct {
+	// Reason is why the session ended.
+	Reason string
+
+	// ExitStatus is the exit status of the remote shell or command, -1 when
+	// it is not known.
+	ExitStatus int
+
+	// Duration is how long the session was served.
+	Duration time.Duration
+
+	// BytesTransferred is the number of terminal bytes sent to the web
+	// client.
+	BytesTransferred int64
+
+	// CleanExit indicates the session ended normally and not because of a
+	// timeout, error or revocation.
+	CleanExit bool
+}
+
+// RecordingStatusReporter reports the status of the session recording upload
+// for proxy-recorded sessions.
+type RecordingStatusReporter interface {
+	// RecordingBacklog returns the number of recording chunks waiting to be
+	// uploaded and whether the upload has failed.
+	RecordingBacklog() (backlog int, failed bool)
 }
 
 // AuthProvider is a subset of the full Auth API.
 type AuthProvider interface {
+	GetNamespace(name string) (*services.Namespace, error)
 	GetNodes(namespace string) ([]services.Server, error)
 	GetSessionEvents(namespace string, sid session.ID, after int, includePrintEvents bool) ([]events.EventFields, error)
 }
 
-// newTerminal creates a web-based terminal based on WebSockets and returns a
-// new TerminalHandler.
-func NewTerminal(req TerminalRequest, authProvider AuthProvider, ctx *SessionContext) (*TerminalHandler, error) {
+// SingleNodeProvider is an optional extension of AuthProvider for backends
+// that can fetch one node by name without pulling the whole node list.
+// When the requested server looks like a node ID the resolver prefers this
+// path; providers without it keep working through the GetNodes scan.
+type SingleNodeProvider interface {
+	GetNode(namespace string, name string) (services.Server, error)
+}
+
+// SessionProvider is an optional extension of AuthProvider for backends
+// that can look up an active session record by ID and enumerate the
+// namespaces records may live in. NewTerminal uses it to reject a join
+// request whose session lives in a different namespace with a precise
+// error instead of an obscure SSH-layer failure; providers without it
+// keep the old behavior.
+type SessionProvider interface {
+	GetSession(namespace string, sid session.ID) (*session.Session, error)
+	GetNamespaces() ([]services.Namespace, error)
+}
+
+// LabelNodeProvider is an optional extension of AuthProvider for backends
+// that can match a label selector server-side. "labels:" targets prefer
+// this path for the same reason node IDs prefer SingleNodeProvider: no
+// full node list pull. The backend must return exactly one matching node,
+// anything else falls back to the scan.
+type LabelNodeProvider interface {
+	GetNodeByLabels(namespace string, labels map[string]string) (services.Server, error)
+}
+
+// terminalResolution is what resolveTerminalRequest learned about a
+// request: the normalized request with defaults filled in, the parsed
+// charset and trusted proxy blocks, the resolved target node and whether
+// the session is being joined rather than created.
+type terminalResolution struct {
+	req            TerminalRequest
+	charset        encoding.Encoding
+	trustedProxies []*net.IPNet
+	node           services.Server
+	hostName       string
+	hostPort       int
+	joined         bool
+}
+
+// ValidateTerminalRequest reports whether a terminal request would pass the
+// pre-flight checks NewTerminal runs — well-formed fields, namespace
+// access, a resolvable server, an advertised login — without opening a
+// websocket or an SSH session. It gives frontends a cheap dry run for
+// immediate form feedback. Requests carrying a ResumeToken bypass these
+// checks in NewTerminal and are not validated here.
+func ValidateTerminalRequest(req TerminalRequest, authProvider AuthProvider) error {
+	if req.ResumeToken != "" {
+		return nil
+	}
+	_, err := resolveTerminalRequest(req, authProvider)
+	return trace.Wrap(err)
+}
+
+// resolveTerminalRequest runs the pre-flight checks and server resolution
+// for a terminal request without dialing anything: field validation,
+// default filling, the role-checked namespace read and the node lookup.
+func resolveTerminalRequest(req TerminalRequest, authProvider AuthProvider) (*terminalResolution, error) {
 	if req.SessionTimeout == 0 {
 		req.SessionTimeout = defaults.HTTPIdleTimeout
 	}
+	if req.ScrollbackBytes > defaults.MaxScrollbackBytes {
+		req.ScrollbackBytes = defaults.MaxScrollbackBytes
+	}
+	if req.ResumeFromSeq < 0 {
+		return nil, trace.BadParameter("resume_from_seq: must not be negative")
+	}
+	if req.ReplayEventsAfter < 0 {
+		return nil, trace.BadParameter("replay_events_after: must not be negative")
+	}
+	if req.KeepAliveJitter < 0 || req.KeepAliveJitter >= 1 {
+		return nil, trace.BadParameter("keepalive_jitter: must be in [0, 1)")
+	}
+	if req.KeepAliveJitter == 0 {
+		req.KeepAliveJitter = defaults.KeepAliveJitter
+	}
 
 	// Make sure whatever session is requested is a valid session.
 	_, err := session.ParseID(string(req.SessionID))
@@ -94,33 +631,278 @@ func NewTerminal(req TerminalRequest, authProvider AuthProvider, ctx *SessionCon
 		return nil, trace.BadParameter("sid: invalid session id")
 	}
 
+	req.Login = strings.TrimSpace(req.Login)
 	if req.Login == "" {
 		return nil, trace.BadParameter("login: missing login")
 	}
+	err = validateLogin("login", req.Login)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if req.Principal != "" {
+		err = validateLogin("principal", req.Principal)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
 	if req.Term.W <= 0 || req.Term.H <= 0 {
 		return nil, trace.BadParameter("term: bad term dimensions")
 	}
+	if req.Namespace == "" {
+		return nil, trace.BadParameter("namespace: missing namespace")
+	}
+	if !services.IsValidNamespace(req.Namespace) {
+		return nil, trace.BadParameter("namespace: invalid namespace %q", req.Namespace)
+	}
+	if req.MaxTermWidth == 0 {
+		req.MaxTermWidth = defaults.MaxTerminalWidth
+	}
+	if req.MaxTermHeight == 0 {
+		req.MaxTermHeight = defaults.MaxTerminalHeight
+	}
+	if req.Term.W > req.MaxTermWidth || req.Term.H > req.MaxTermHeight {
+		log.Warnf("Clamping oversized initial terminal dimensions %vx%v to %vx%v.",
+			req.Term.W, req.Term.H, req.MaxTermWidth, req.MaxTermHeight)
+		if req.Term.W > req.MaxTermWidth {
+			req.Term.W = req.MaxTermWidth
+		}
+		if req.Term.H > req.MaxTermHeight {
+			req.Term.H = req.MaxTermHeight
+		}
+	}
+	err = validateEnv(req.Env)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if req.TermType == "" {
+		req.TermType = teleport.SafeTerminalType
+	}
+	err = validateTermType(req.TermType)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	switch req.InvalidUTF8 {
+	case "":
+		req.InvalidUTF8 = invalidUTF8Replace
+	case invalidUTF8Replace, invalidUTF8Fail:
+	default:
+		return nil, trace.BadParameter(
+			"invalid_utf8: expected %q or %q, got %q",
+			invalidUTF8Replace, invalidUTF8Fail, req.InvalidUTF8)
+	}
+	charset, err := lookupCharset(req.Charset)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	switch req.EndOn {
+	case "":
+		// A subsystem has no recorded session, so there is no session end
+		// audit event to wait for: the SSH connection returning is final.
+		if req.Subsystem != "" {
+			req.EndOn = endOnSSHExit
+		} else {
+			req.EndOn = endOnBoth
+		}
+	case endOnSSHExit, endOnAuditEnd, endOnBoth:
+	default:
+		return nil, trace.BadParameter(
+			"end_on: expected %q, %q or %q, got %q",
+			endOnSSHExit, endOnAuditEnd, endOnBoth, req.EndOn)
+	}
+	if req.CompressLevel < gzip.HuffmanOnly || req.CompressLevel > gzip.BestCompression {
+		return nil, trace.BadParameter("compress_level: invalid gzip level %v", req.CompressLevel)
+	}
+	switch req.RecordingMode {
+	case "":
+		req.RecordingMode = services.RecordAtNode
+	case services.RecordAtNode, services.RecordAtProxy, services.RecordOff:
+	default:
+		return nil, trace.BadParameter(
+			"recording_mode: expected %q, %q or %q, got %q",
+			services.RecordAtNode, services.RecordAtProxy, services.RecordOff, req.RecordingMode)
+	}
+	if req.RequestID == "" {
+		req.RequestID = uuid.New()
+	}
+	if req.DefaultPort < 0 || req.DefaultPort > 65535 {
+		return nil, trace.BadParameter("default_port: invalid port %v", req.DefaultPort)
+	}
+	if req.Subsystem != "" && len(req.InteractiveCommand) > 0 {
+		return nil, trace.BadParameter("subsystem: mutually exclusive with an interactive command")
+	}
+	if req.EventsOnly && (req.Subsystem != "" || len(req.InteractiveCommand) > 0) {
+		return nil, trace.BadParameter("events_only: mutually exclusive with a subsystem or an interactive command")
+	}
+	if req.RecordToPath != "" {
+		req.RecordToPath, err = resolveRecordingPath(req.RecordToPath)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	trustedProxies, err := parseTrustedProxies(req.TrustedProxies)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// The namespace read goes through the role-checking auth API, so a
+	// user who is not permitted to access the namespace is turned away
+	// before any nodes are dialed.
+	_, err = authProvider.GetNamespace(req.Namespace)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// A join request naming a session from another namespace would only
+	// fail deep in the SSH layer, after a timeout. The backend scopes
+	// session records by namespace, so a hit in the requested namespace
+	// settles it; on a miss the remaining namespaces are searched for the
+	// record so the mismatch is reported precisely. A session no namespace
+	// knows is simply being created and skips the check.
+	if sessions, ok := authProvider.(SessionProvider); ok {
+		_, err := sessions.GetSession(req.Namespace, req.SessionID)
+		if err != nil && !trace.IsNotFound(err) {
+			return nil, trace.Wrap(err)
+		}
+		if trace.IsNotFound(err) {
+			namespaces, err := sessions.GetNamespaces()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			for _, namespace := range namespaces {
+				name := namespace.Metadata.Name
+				if name == req.Namespace {
+					continue
+				}
+				_, err := sessions.GetSession(name, req.SessionID)
+				if trace.IsNotFound(err) {
+					continue
+				}
+				if err != nil {
+					return nil, trace.Wrap(err)
+				}
+				return nil, trace.BadParameter(
+					"sid: session %v belongs to namespace %q, not %q",
+					req.SessionID, name, req.Namespace)
+			}
+		}
+	}
+
+	node, servers, hostName, hostPort, err := resolveServerWithRetry(req, authProvider)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// An explicit port in the server name wins; otherwise fall back to
+	// the requested cluster-wide default instead of letting the client
+	// pick.
+	if hostPort == 0 && req.DefaultPort != 0 {
+		hostPort = req.DefaultPort
+	}
+
+	// A session that already has recorded events is being joined rather
+	// than created. A session the backend does not know yet is a create:
+	// its record only appears once the first party connects.
+	joined := false
+	sessionEvents, err := authProvider.GetSessionEvents(req.Namespace, req.SessionID, 0, false)
+	if err == nil && len(sessionEvents) > 0 {
+		joined = true
+	}
 
-	servers, err := authProvider.GetNodes(req.Namespace)
+	// If the node advertises the principals it accepts, validate the login
+	// early to give the user actionable feedback instead of a downstream
+	// authentication failure.
+	err = validateServerLogin(req.Login, req.Server, servers)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 
-	hostName, hostPort, err := resolveServerHostPort(req.Server, servers)
+	return &terminalResolution{
+		req:            req,
+		charset:        charset,
+		trustedProxies: trustedProxies,
+		node:           node,
+		hostName:       hostName,
+		hostPort:       hostPort,
+		joined:         joined,
+	}, nil
+}
+
+// newTerminal creates a web-based terminal based on WebSockets and returns a
+// new TerminalHandler.
+func NewTerminal(req TerminalRequest, authProvider AuthProvider, ctx *SessionContext, opts ...TerminalOption) (*TerminalHandler, error) {
+	// A reconnect presenting a resume token re-attaches to the existing
+	// handler (same identity, options and scrollback) instead of resolving
+	// the request anew. Serving the re-attached handler dials a fresh SSH
+	// connection that rejoins the recorded session by its ID.
+	if req.ResumeToken != "" {
+		term, err := resumeSession(req.ResumeToken, time.Now())
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		// The token alone is not proof of ownership: it travels in every
+		// metadata frame and can end up in client logs. Re-attaching hands
+		// out the original handler with the original user's credentials,
+		// so only that user may resume.
+		if term.ctx != nil && (ctx == nil || ctx.user != term.ctx.user) {
+			return nil, trace.AccessDenied("resume token does not belong to this user")
+		}
+		for _, opt := range opts {
+			opt(term)
+		}
+		return term, nil
+	}
+
+	res, err := resolveTerminalRequest(req, authProvider)
 	if err != nil {
-		return nil, trace.BadParameter("invalid server name %q: %v", req.Server, err)
+		return nil, trace.Wrap(err)
+	}
+	req = res.req
+
+	// RBAC has already decided which logins the user may assume: they are
+	// the principals in the session certificate. A login the certificate
+	// can never authenticate fails fast here. Without a session context
+	// (or a parseable certificate) the check is deferred to the node.
+	if ctx != nil {
+		if _, cert, err := ctx.GetAgent(); err == nil {
+			err = validateCertLogin(req.Login, cert.ValidPrincipals)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+		}
 	}
 
-	return &TerminalHandler{
+	term := &TerminalHandler{
 		namespace:      req.Namespace,
 		sessionID:      req.SessionID,
 		params:         req,
+		charset:        res.charset,
 		ctx:            ctx,
-		hostName:       hostName,
-		hostPort:       hostPort,
+		hostName:       res.hostName,
+		hostPort:       res.hostPort,
+		node:           res.node,
 		authProvider:   authProvider,
+		trustedProxies: res.trustedProxies,
 		sessionTimeout: req.SessionTimeout,
-	}, nil
+		joined:         res.joined,
+		entry: log.WithFields(log.Fields{
+			"request_id": req.RequestID,
+			"joined":     res.joined,
+		}),
+		resumeToken: uuid.New(),
+	}
+	for _, opt := range opts {
+		opt(term)
+	}
+	return term, nil
+}
+
+// shellSession is the part of *ssh.Session the terminal handler drives:
+// out-of-band requests (window changes, signals) and teardown. Pulled out
+// as an interface so tests can observe the requests going to the node.
+type shellSession interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, error)
+	Signal(sig ssh.Signal) error
+	Close() error
 }
 
 // TerminalHandler connects together an SSH session with a web-based
@@ -135,6 +917,19 @@ type TerminalHandler struct {
 	// params is the initial PTY size.
 	params TerminalRequest
 
+	// charset is the session character encoding the wrapped socket derives
+	// its encoder and decoder from. NewTerminal resolves it from
+	// params.Charset (UTF-8 when empty) and WithCharset may override it.
+	charset encoding.Encoding
+
+	// defaultEnv holds cluster-level default environment variables layered
+	// below the user-supplied params.Env. Set with WithDefaultEnv.
+	defaultEnv map[string]string
+
+	// hostKeyCallback replaces the built-in host certificate check when
+	// set. Set with WithHostKeyCallback.
+	hostKeyCallback ssh.HostKeyCallback
+
 	// ctx is a web session context for the currently logged in user.
 	ctx *SessionContext
 
@@ -147,8 +942,25 @@ type TerminalHandler struct {
 	// hostPort is the port of the server.
 	hostPort int
 
+	// node is the registered node the request resolved to, nil when the
+	// target was a plain address that matched no registered node. Used to
+	// surface node metadata (platform labels) to the web client.
+	node services.Server
+
+	// joined is true when the request connected to a session that already
+	// existed, false when this connection created the session. Surfaced
+	// to auditors via the log fields and to the UI via the metadata
+	// frame.
+	joined bool
+
+	// replayFull is true when the client asked to resume the scrollback
+	// from an offset the buffer no longer retains, so the full tail was
+	// replayed instead of just the missed part. Surfaced to the UI via
+	// the metadata frame.
+	replayFull bool
+
 	// sshSession holds the "shell" SSH channel to the node.
-	sshSession *ssh.Session
+	sshSession shellSession
 
 	// teleportClient is the client used to form the connection.
 	teleportClient *client.TeleportClient
@@ -165,475 +977,4529 @@ type TerminalHandler struct {
 	// eventCancel is used to signal when the event is closing.
 	eventCancel context.CancelFunc
 
+	// lineBuffer is the line buffered output writer when one was
+	// requested, kept so buffered output can be flushed before the close
+	// frame goes out.
+	lineBuffer *lineBufferedWriter
+
+	// drainC asks streamEvents for one final poll once the SSH session
+	// has ended, so pending audit events reach the browser before the
+	// close frame.
+	drainC chan struct{}
+
+	// eventsDrained is closed by streamEvents when that final poll is
+	// done.
+	eventsDrained chan struct{}
+
 	// request is the HTTP request that initiated the websocket connection.
 	request *http.Request
 
 	// authProvider is used to fetch nodes and sessions from the backend.
 	authProvider AuthProvider
 
+	// trustedProxies are the parsed TrustedProxies CIDR blocks, used to
+	// decide whether the forwarding headers of the peer can be believed
+	// when recording the client address.
+	trustedProxies []*net.IPNet
+
 	// sessionTimeout is how long to wait for the session end event to arrive.
 	sessionTimeout time.Duration
-}
 
-// Serve builds a connect to the remote node and then pumps back two types of
-// events: raw input/output events for what's happening on the terminal itself
-// and audit log events relevant to this session.
-func (t *TerminalHandler) Serve(w http.ResponseWriter, r *http.Request) {
-	t.request = r
+	// recordingStatus reports the status of the session recording upload.
+	// It is optional and only set for proxy-recorded sessions.
+	recordingStatus RecordingStatusReporter
 
-	// This allows closing of the websocket if the user logs out before exiting
-	// the session.
-	t.ctx.AddClosers(t)
-	defer t.ctx.RemoveCloser(t)
+	// phaseWatchdog bounds the time the connection may spend in each
+	// connect phase. It is only set when per phase budgets were requested.
+	phaseWatchdog *phaseWatchdog
 
-	// We initial a server explicitly here instead of using websocket.HandlerFunc
-	// to set an empty origin checker (this is to make our lives easier in tests).
-	// The main use of the origin checker is to enforce the browsers same-origin
-	// policy. That does not matter here because even if malicious Javascript
-	// would try and open a websocket the request to this endpoint requires the
-	// bearer token to be in the URL so it would not be sent along by default
-	// like cookies are.
-	ws := &websocket.Server{Handler: t.handler}
-	ws.ServeHTTP(w, r)
-}
+	// entry carries the request ID on every log line of the handler so
+	// browser and server logs can be correlated.
+	entry *log.Entry
 
-// Close the websocket stream.
-func (t *TerminalHandler) Close() error {
-	// Close the websocket connection to the client web browser.
-	if t.ws != nil {
-		t.ws.Close()
-	}
+	// resumeToken is the server generated token under which this session
+	// can be re-attached after a transient websocket drop.
+	resumeToken string
 
-	// Close the SSH connection to the remote node.
-	if t.sshSession != nil {
-		t.sshSession.Close()
-	}
+	// keepAlive tracks keepalive pings sent to the web client and the
+	// pongs received back.
+	keepAlive terminalKeepAlive
 
-	// If the terminal handler was closed (most likely due to the *SessionContext
-	// closing) then the stream should be closed as well.
-	t.terminalCancel()
+	// idleWatcher tears the session down after a period with no user
+	// input. It is only set when an idle timeout was requested.
+	idleWatcher *idleWatcher
 
-	return nil
-}
+	// onClose is invoked exactly once when the session tears down. It is
+	// optional.
+	onClose func(CloseInfo)
 
-// handler is the main websocket loop. It creates a Teleport client and then
-// pumps raw events and audit events back to the client until the SSH session
-// is complete.
-func (t *TerminalHandler) handler(ws *websocket.Conn) {
-	// Create a Teleport client, if not able to, show the reason to the user in
-	// the terminal.
-	tc, err := t.makeClient(ws)
-	if err != nil {
-		er := errToTerm(err, ws)
-		if er != nil {
-			log.Warnf("Unable to send error to terminal: %v: %v.", err, er)
-		}
-		return
-	}
+	// closeOnce guarantees the close callback fires exactly once no matter
+	// which teardown path runs first.
+	closeOnce sync.Once
 
-	// Create two contexts for signaling. The first
-	t.terminalContext, t.terminalCancel = context.WithCancel(context.Background())
-	t.eventContext, t.eventCancel = context.WithCancel(context.Background())
+	// failureMu guards failureSide: the websocket and SSH goroutines race
+	// to observe a failure and the first observation wins.
+	failureMu sync.Mutex
 
-	// Pump raw terminal in/out and audit events into the websocket.
-	go t.streamTerminal(ws, tc)
-	go t.streamEvents(ws, tc)
+	// failureSide records which side of the connection broke first,
+	// failureSideClient or failureSideServer. Empty for a clean end.
+	failureSide string
 
-	// Block until the terminal session is complete.
-	<-t.terminalContext.Done()
+	// teardownOnce guarantees Close runs its teardown exactly once, no
+	// matter how many closers (the deferred RemoveCloser path, the
+	// SessionContext closing) invoke it.
+	teardownOnce sync.Once
 
-	// Block until the session end event is sent or a timeout occurs.
-	timeoutCh := time.After(t.sessionTimeout)
-	for {
-		select {
-		case <-timeoutCh:
-			t.eventCancel()
-		case <-t.eventContext.Done():
+	// startTime is when the websocket connection was established.
+	startTime time.Time
+
+	// wrappedSock is the envelope wrapper the terminal bytes travel
+	// through, kept to report the number of bytes transferred.
+	wrappedSock *wrappedSocket
+
+	// resizeDebouncer collapses storms of resize requests so the node sees
+	// at most one window-change per debounce period.
+	resizeDebouncer *resizeDebouncer
+
+	// outputThrottle bounds the rate terminal output is written to the
+	// websocket. Nil when no limit was requested.
+	outputThrottle *outputThrottle
+
+	// recorder tees terminal output into a local transcript file. Nil
+	// when no transcript was requested.
+	recorder *sessionRecorder
+
+	// sshClient is the established SSH connection to the node, used to
+	// open additional sessions for file transfers.
+	sshClient *ssh.Client
+
+	// fileUploadCh delivers upload chunks from the websocket read loop to
+	// the file transfer in flight.
+	fileUploadCh chan []byte
+
+	// eventSeq numbers every audit frame sent to the web client so it can
+	// detect dropped or reordered events. Accessed atomically.
+	eventSeq int64
+}
+
+// SetOnClose attaches a callback invoked exactly once when the session
+// tears down, carrying the teardown context. It has to be called before
+// Serve.
+func (t *TerminalHandler) SetOnClose(fn func(CloseInfo)) {
+	t.onClose = fn
+}
+
+// fireClose invokes the close callback exactly once with the teardown
+// context. Later calls from other teardown paths are ignored.
+func (t *TerminalHandler) fireClose(reason string, clean bool) {
+	if t.onClose == nil {
+		return
+	}
+	t.closeOnce.Do(func() {
+		info := CloseInfo{
+			Reason:     reason,
+			ExitStatus: -1,
+			CleanExit:  clean,
+		}
+		if !t.startTime.IsZero() {
+			info.Duration = time.Since(t.startTime)
+		}
+		if t.teleportClient != nil {
+			info.ExitStatus = t.teleportClient.ExitStatus
+		}
+		if t.wrappedSock != nil {
+			info.BytesTransferred = t.wrappedSock.bytesWritten()
+		}
+		t.onClose(info)
+	})
+}
+
+// terminalKeepAlive counts keepalive pings that have gone unanswered by the
+// web client and measures the round trip latency of answered ones.
+type terminalKeepAlive struct {
+	sync.Mutex
+
+	// missed is the number of pings sent since the last pong came back.
+	missed int
+
+	// lastPing is when the most recent ping went out.
+	lastPing time.Time
+
+	// firstPing is when the first ping went out, the reference point for
+	// the pong deadline until the first pong comes back.
+	firstPing time.Time
+
+	// lastPong is when the most recent pong came back.
+	lastPong time.Time
+
+	// latency is the most recently measured round trip time.
+	latency time.Duration
+
+	// measured indicates at least one pong has come back.
+	measured bool
+}
+
+// pingSent records an outgoing ping and returns how many pings are
+// currently unanswered.
+func (k *terminalKeepAlive) pingSent() int {
+	k.Lock()
+	defer k.Unlock()
+	k.missed++
+	k.lastPing = time.Now()
+	if k.firstPing.IsZero() {
+		k.firstPing = k.lastPing
+	}
+	return k.missed
+}
+
+// sincePong reports how long ago the last pong came back, measured from
+// the first ping when no pong has been seen yet. Zero when no ping has
+// gone out either.
+func (k *terminalKeepAlive) sincePong() time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	switch {
+	case !k.lastPong.IsZero():
+		return time.Since(k.lastPong)
+	case !k.firstPing.IsZero():
+		return time.Since(k.firstPing)
+	default:
+		return 0
+	}
+}
+
+// pongReceived records a reply from the web client and updates the measured
+// round trip latency.
+func (k *terminalKeepAlive) pongReceived() {
+	k.Lock()
+	defer k.Unlock()
+	k.missed = 0
+	k.lastPong = time.Now()
+	if !k.lastPing.IsZero() {
+		k.latency = time.Since(k.lastPing)
+		k.measured = true
+	}
+}
+
+// currentLatency returns the last measured round trip latency, or -1 when
+// no reply has been measured yet.
+func (k *terminalKeepAlive) currentLatency() time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	if !k.measured {
+		return -1
+	}
+	return k.latency
+}
+
+// SetRecordingStatusReporter attaches a reporter for the status of the
+// session recording upload. It has to be called before Serve.
+func (t *TerminalHandler) SetRecordingStatusReporter(r RecordingStatusReporter) {
+	t.recordingStatus = r
+}
+
+// Serve builds a connect to the remote node and then pumps back two types of
+// events: raw input/output events for what's happening on the terminal itself
+// and audit log events relevant to this session.
+func (t *TerminalHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	t.request = r
+
+	// This allows closing of the websocket if the user logs out before exiting
+	// the session.
+	t.ctx.AddClosers(t)
+	defer t.ctx.RemoveCloser(t)
+
+	// We initial a server explicitly here instead of using websocket.HandlerFunc
+	// to set an empty origin checker (this is to make our lives easier in tests).
+	// The main use of the origin checker is to enforce the browsers same-origin
+	// policy. That does not matter here because even if malicious Javascript
+	// would try and open a websocket the request to this endpoint requires the
+	// bearer token to be in the URL so it would not be sent along by default
+	// like cookies are.
+	ws := t.websocketServer()
+	ws.ServeHTTP(w, r)
+}
+
+// websocketServer builds the websocket server used by Serve. With an
+// origin allowlist configured the handshake rejects mismatched origins
+// with a 403 before any SSH work happens, as defense-in-depth for
+// deployments behind shared proxies.
+func (t *TerminalHandler) websocketServer() *websocket.Server {
+	ws := &websocket.Server{Handler: t.handler}
+	if len(t.params.AllowedOrigins) > 0 {
+		ws.Handshake = func(cfg *websocket.Config, r *http.Request) error {
+			origin := r.Header.Get("Origin")
+			if !originAllowed(origin, t.params.AllowedOrigins) {
+				return trace.AccessDenied("origin %q is not allowed", origin)
+			}
+			return nil
+		}
+	}
+	return ws
+}
+
+// originAllowed reports whether the host of the given Origin header value
+// matches the allowlist. An entry like "*.example.com" matches any
+// subdomain of example.com, other entries have to match the host exactly.
+func originAllowed(origin string, allowed []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, entry := range allowed {
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the TrustedProxies CIDR blocks.
+func parseTrustedProxies(blocks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, block := range blocks {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(block))
+		if err != nil {
+			return nil, trace.BadParameter("trusted_proxies: invalid CIDR block %q", block)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// addrTrusted reports whether the IP part of addr (a host:port pair or a
+// bare IP) falls in one of the trusted blocks. An address that does not
+// parse is never trusted.
+func addrTrusted(addr string, trusted []*net.IPNet) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, block := range trusted {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the proxy chain reported by the request headers,
+// left-most (origin client) first. X-Forwarded-For wins when present, the
+// RFC 7239 Forwarded header is the fallback.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, value := range header["Forwarded"] {
+		for _, elem := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < len("for=") || !strings.EqualFold(pair[:len("for=")], "for=") {
+					continue
+				}
+				if hop := strings.Trim(pair[len("for="):], `"`); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedClientAddr derives the address recorded in audit events. When the
+// immediate peer is a trusted proxy the forwarded chain is walked from the
+// nearest hop towards the client and the left-most untrusted hop wins, so a
+// spoofed segment prepended by the client is never believed. A peer outside
+// the trusted blocks keeps its own address and the headers are ignored.
+func forwardedClientAddr(remoteAddr string, header http.Header, trusted []*net.IPNet) string {
+	if len(trusted) == 0 || !addrTrusted(remoteAddr, trusted) {
+		return remoteAddr
+	}
+	hops := forwardedHops(header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !addrTrusted(hops[i], trusted) {
+			return hops[i]
+		}
+	}
+	// Every hop is a trusted proxy; the left-most one is as close to the
+	// client as the chain gets.
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return remoteAddr
+}
+
+// Close the websocket stream. Close is idempotent and safe to call at any
+// point in the handler lifecycle: it may run before handler has set up the
+// terminal context (nothing to cancel yet) and may be invoked concurrently
+// from several teardown paths (the deferred RemoveCloser and the
+// *SessionContext closing all of its closers).
+func (t *TerminalHandler) Close() error {
+	t.teardownOnce.Do(func() {
+		t.fireClose("connection closed", false)
+
+		// Let the other parties of a shared session know this one is gone
+		// for good (a transient websocket drop does not come through here,
+		// those sessions stay resumable).
+		t.notifyParticipants(fmt.Sprintf("%v left the session", t.participantName()))
+
+		// Close the websocket connection to the client web browser.
+		if t.ws != nil {
+			t.ws.Close()
+		}
+
+		// Close the SSH connection to the remote node.
+		if t.sshSession != nil {
+			t.sshSession.Close()
+		}
+
+		// Flush and close the local transcript, if one was being written.
+		if t.recorder != nil {
+			if err := t.recorder.Close(); err != nil {
+				t.log().Warnf("Unable to close session transcript: %v.", err)
+			}
+		}
+
+		// If the terminal handler was closed (most likely due to the
+		// *SessionContext closing) then the stream should be closed as well.
+		if t.terminalCancel != nil {
+			t.terminalCancel()
+		}
+
+		// The session is gone for good: it can no longer be killed by ID
+		// or resumed with its token.
+		unregisterSession(t)
+		unregisterResumable(t)
+	})
+	return nil
+}
+
+// startServeDeadline arms a timer that tears the connection down once the
+// overall deadline expires. A timeout reason is sent to the web client
+// first. The returned timer should be stopped once the connection has been
+// torn down normally.
+func (t *TerminalHandler) startServeDeadline(w io.Writer, deadline time.Duration) *time.Timer {
+	return time.AfterFunc(deadline, func() {
+		t.fireClose("serve deadline exceeded", false)
+		err := errToTerm(trace.LimitExceeded("serve deadline of %v exceeded, closing session", deadline), w)
+		if err != nil {
+			t.log().Warnf("Unable to send error to terminal: %v.", err)
+		}
+		t.Close()
+	})
+}
+
+// MaxTerminalsPerUser caps the number of web terminals a single user may
+// hold open at once. It is a variable so embedders can tune it.
+var MaxTerminalsPerUser = defaults.MaxWebTerminalsPerUser
+
+// terminalCounts tracks the number of open web terminals per user so a
+// single user can not exhaust the proxy with connections.
+var terminalCounts = struct {
+	sync.Mutex
+	perUser map[string]int
+}{perUser: make(map[string]int)}
+
+// acquireTerminal reserves a terminal slot for the user, refusing when the
+// per user cap has been reached.
+func acquireTerminal(user string) error {
+	terminalCounts.Lock()
+	defer terminalCounts.Unlock()
+
+	if terminalCounts.perUser[user] >= MaxTerminalsPerUser {
+		return trace.LimitExceeded("too many open terminals for user %q (max %v)",
+			user, MaxTerminalsPerUser)
+	}
+	terminalCounts.perUser[user]++
+	return nil
+}
+
+// releaseTerminal frees the terminal slot held by the user.
+func releaseTerminal(user string) {
+	terminalCounts.Lock()
+	defer terminalCounts.Unlock()
+
+	if terminalCounts.perUser[user] <= 1 {
+		delete(terminalCounts.perUser, user)
+		return
+	}
+	terminalCounts.perUser[user]--
+}
+
+// handler is the main websocket loop. It creates a Teleport client and then
+// pumps raw events and audit events back to the client until the SSH session
+// is complete.
+func (t *TerminalHandler) handler(ws *websocket.Conn) {
+	t.startTime = time.Now()
+
+	webTerminalActiveSessions.Inc()
+	webTerminalSessionsTotal.Inc()
+	defer func() {
+		webTerminalActiveSessions.Dec()
+		webTerminalSessionDuration.Observe(time.Since(t.startTime).Seconds())
+	}()
+
+	// One structured summary line per session, always on: cheap enough for
+	// billing and debugging without scraping metrics.
+	defer t.logSessionSummary()
+
+	// Push buffered transcript records to disk at disconnect: the file
+	// stays open in case the session is resumed, Close finishes it.
+	defer func() {
+		if t.recorder != nil {
+			t.recorder.flush()
+		}
+	}()
+
+	// A single user may only hold a bounded number of terminals open. The
+	// slot is released via defer so it survives panics in the session.
+	err := acquireTerminal(t.ctx.user)
+	if err != nil {
+		t.fireClose(err.Error(), false)
+		er := t.writeError(err, ws)
+		if er != nil {
+			t.log().Warnf("Unable to send error to terminal: %v: %v.", err, er)
+		}
+		return
+	}
+	defer releaseTerminal(t.ctx.user)
+
+	// Create two contexts for signaling. The first
+	t.terminalContext, t.terminalCancel = context.WithCancel(context.Background())
+	t.eventContext, t.eventCancel = context.WithCancel(context.Background())
+	t.drainC = make(chan struct{}, 1)
+	t.eventsDrained = make(chan struct{})
+
+	// Keep the session resumable while it is connected. At teardown a
+	// transient client-side drop refreshes the grace period so it runs
+	// from the moment of disconnect; any other end is final and retires
+	// the token so the handler can be collected.
+	registerResumable(t, time.Now())
+	defer func() {
+		if t.stillResumable() {
+			registerResumable(t, time.Now())
+			return
+		}
+		unregisterResumable(t)
+	}()
+
+	// Make the session killable by ID from admin tooling and visible to
+	// the other parties of a shared session.
+	registerSession(t)
+	defer unregisterSession(t)
+
+	// Let the parties already attached to the session know who joined.
+	t.notifyParticipants(fmt.Sprintf("%v joined the session", t.participantName()))
+
+	// Collapse storms of resize requests (dragging the browser window) so
+	// the node sees at most one window-change per debounce period.
+	debouncePeriod := t.params.ResizeDebouncePeriod
+	if debouncePeriod == 0 {
+		debouncePeriod = defaults.ResizeDebouncePeriod
+	}
+	t.resizeDebouncer = newResizeDebouncer(debouncePeriod, func(params *session.TerminalParams) {
+		t.windowChange(params)
+		// Record the resize from this client's perspective too: the event
+		// rides the debouncer so a storm of resizes does not spam audit.
+		t.emitResizeEvent(ws, params)
+	})
+	go t.resizeDebouncer.run(t.terminalContext)
+
+	// If requested, bound the rate terminal output is written to the
+	// websocket. Backpressure propagates to the SSH channel naturally.
+	if t.params.MaxOutputBytesPerSec > 0 {
+		t.outputThrottle = newOutputThrottle(t.params.MaxOutputBytesPerSec)
+	}
+
+	// Unless a more specific teardown path fired the close callback first,
+	// report a normal session end. A transient client-side drop of a
+	// resumable session is not an end: the one-shot callback is saved for
+	// the teardown that follows a resume, or for the grace period expiring.
+	defer func() {
+		if t.stillResumable() {
+			return
+		}
+		t.fireClose("session ended", true)
+	}()
+
+	// Tell the client what this server supports so it can feature detect
+	// instead of guessing.
+	err = websocket.JSON.Send(ws, t.capabilitiesFrame())
+	if err != nil {
+		t.log().Warnf("Unable to send capabilities to web client: %v.", err)
+	}
+
+	// Tell an observer right away that their keystrokes go nowhere.
+	if t.params.ReadOnly {
+		er := t.writeError(trace.AccessDenied("read-only session: input is disabled"), ws)
+		if er != nil {
+			t.log().Warnf("Unable to send read-only notice to terminal: %v.", er)
+		}
+	}
+
+	// If an overall deadline was requested, bound the total lifetime of the
+	// connection, including the connecting phase below.
+	if t.params.ServeDeadline > 0 {
+		deadlineTimer := t.startServeDeadline(ws, t.params.ServeDeadline)
+		defer deadlineTimer.Stop()
+	}
+
+	// A detached monitoring session never dials the node: only the audit
+	// events of the session flow over the websocket.
+	if t.params.EventsOnly {
+		t.streamEventsOnly(ws)
+		t.log().Debugf("Closing websocket stream to web client.")
+		return
+	}
+
+	// Tell the client right away that work is in progress: the target was
+	// already resolved, the dialing phases report themselves as the
+	// connection moves through them.
+	t.sendStatus(ws, statusStateConnecting, "resolving node")
+
+	// Create a Teleport client, if not able to, show the reason to the user in
+	// the terminal.
+	tc, err := t.makeClient(ws)
+	if err != nil {
+		t.sendStatus(ws, statusStateError, err.Error())
+		t.fireClose(err.Error(), false)
+		er := t.writeError(err, ws)
+		if er != nil {
+			t.log().Warnf("Unable to send error to terminal: %v: %v.", err, er)
+		}
+		return
+	}
+
+	// Pump raw terminal in/out and audit events into the websocket.
+	go t.streamTerminal(ws, tc)
+	go t.streamEvents(ws, tc)
+
+	// If requested (and a reporter is available), periodically send the
+	// status of the session recording upload to the web client.
+	if t.params.ReportRecordingStatus && t.recordingStatus != nil {
+		go t.streamRecordingStatus(ws)
+	}
+
+	// If requested, ping the web client periodically so half open websockets
+	// (closed laptop lid, lost network) are detected and torn down promptly.
+	if t.params.KeepAliveInterval > 0 {
+		go t.streamKeepAlive(ws)
+	}
+
+	// If requested, emit a periodic liveness marker into the audit stream.
+	if t.params.HeartbeatInterval > 0 {
+		go t.streamHeartbeat(t.terminalContext, clockwork.NewRealClock(), ws)
+	}
+
+	// If requested, close the session after the configured period without
+	// any keyboard input.
+	if t.params.IdleTimeout > 0 {
+		t.idleWatcher = newIdleWatcher(clockwork.NewRealClock(), t.params.IdleTimeout, func() {
+			t.fireClose("disconnected due to inactivity", false)
+			er := t.writeError(trace.LimitExceeded("disconnected due to inactivity"), ws)
+			if er != nil {
+				t.log().Warnf("Unable to send error to terminal: %v.", er)
+			}
+			t.terminalCancel()
+		})
+		go t.idleWatcher.watch(t.terminalContext)
+	}
+
+	// Block until the teardown condition selected by EndOn is met.
+	t.waitForEnd()
+
+	t.log().Debugf("Closing websocket stream to web client.")
+}
+
+// waitForEnd blocks until the teardown condition selected by EndOn is met:
+// the SSH connection returning, the session end audit event arriving, or
+// (the default) the SSH connection returning with a bounded window for the
+// end event to follow.
+func (t *TerminalHandler) waitForEnd() {
+	switch t.params.EndOn {
+	case endOnSSHExit:
+		// The SSH connection returning is enough: the output and pending
+		// audit events were already drained before the close frame, do
+		// not hold the websocket open for the end event.
+		<-t.terminalContext.Done()
+		t.eventCancel()
+	case endOnAuditEnd:
+		// Only the session end audit event (or a dead event stream) tears
+		// the session down, no matter whether the SSH connection is still
+		// up. Parties observing a session they did not start see the
+		// final events this way. Once the SSH connection is gone too the
+		// wait becomes bounded: a session that never emits its end event
+		// must not hold the websocket open forever.
+		select {
+		case <-t.eventContext.Done():
+			t.terminalCancel()
+			return
+		case <-t.terminalContext.Done():
+		}
+		t.waitForSessionEnd()
+	default:
+		// Wait for the SSH connection to return, then give the session
+		// end event a bounded window to arrive.
+		<-t.terminalContext.Done()
+		t.waitForSessionEnd()
+	}
+}
+
+// waitForSessionEnd gives the session end audit event sessionTimeout to
+// arrive after the SSH connection has returned. When the deadline fires the
+// client is told why instead of the teardown looking like a silent hang.
+func (t *TerminalHandler) waitForSessionEnd() {
+	ctx, cancel := context.WithTimeout(context.Background(), t.sessionTimeout)
+	defer cancel()
+	select {
+	case <-t.eventContext.Done():
+	case <-ctx.Done():
+		if t.wrappedSock != nil {
+			if err := t.wrappedSock.writeNotice("timed out waiting for the session end event"); err != nil {
+				t.log().Warnf("Unable to send session timeout notice: %v.", err)
+			}
+		}
+		t.eventCancel()
+	}
+}
+
+// capabilitiesFrame builds the envelope that describes the features enabled
+// for this connection and the envelope types the server understands.
+func (t *TerminalHandler) capabilitiesFrame() capabilitiesEnvelope {
+	return capabilitiesEnvelope{
+		Type: defaults.CapabilitiesEnvelopeType,
+		Payload: terminalCapabilities{
+			ProtocolVersion: defaults.TerminalProtocolVersion,
+			EnvelopeTypes: []string{
+				defaults.AuditEnvelopeType,
+				defaults.RawEnvelopeType,
+				defaults.ResizeRequestEnvelopeType,
+				defaults.RecordingStatusEnvelopeType,
+				defaults.CapabilitiesEnvelopeType,
+				defaults.CloseEnvelopeType,
+				defaults.FileTransferEnvelopeType,
+				defaults.FileChunkEnvelopeType,
+				defaults.FileProgressEnvelopeType,
+				defaults.SessionMetadataEnvelopeType,
+				defaults.ErrorEnvelopeType,
+				defaults.ResizeAckEnvelopeType,
+				defaults.PasteEnvelopeType,
+				defaults.StderrEnvelopeType,
+				defaults.SignalEnvelopeType,
+				defaults.ReplayEnvelopeType,
+				defaults.NoticeEnvelopeType,
+				defaults.BellEnvelopeType,
+				defaults.HistoricalEnvelopeType,
+				defaults.StatusEnvelopeType,
+			},
+			LineBuffered:    t.params.LineBuffered,
+			RecordingStatus: t.params.ReportRecordingStatus && t.recordingStatus != nil,
+		},
+	}
+}
+
+// clientAddr returns the client address recorded in audit events: the
+// forwarded address when the websocket peer is a trusted proxy, the peer
+// address itself otherwise.
+func (t *TerminalHandler) clientAddr() string {
+	if t.request == nil {
+		return ""
+	}
+	return forwardedClientAddr(t.request.RemoteAddr, t.request.Header, t.trustedProxies)
+}
+
+// credentialProvider is the part of the session context credential
+// acquisition needs, split out so tests can substitute a fake.
+type credentialProvider interface {
+	GetAgent() (agent.Agent, *ssh.Certificate, error)
+	ClientTLSConfig(clusterName ...string) (*tls.Config, error)
+}
+
+// getUserCredentials acquires the user's SSH signers and TLS config from the
+// session context. A transient key-store hiccup (a proxy restarting mid
+// request) gets a few quick retries with a doubling backoff instead of
+// failing the session outright; the budget is tight so genuine auth failures
+// still surface promptly.
+func getUserCredentials(ctx credentialProvider) (agent.Agent, *ssh.Certificate, []ssh.Signer, *tls.Config, error) {
+	backoff := defaults.CredentialRetryBackoff
+	var err error
+	for attempt := 0; attempt < defaults.CredentialRetryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var userAgent agent.Agent
+		var cert *ssh.Certificate
+		userAgent, cert, err = ctx.GetAgent()
+		if err != nil {
+			err = trace.BadParameter("failed to get user credentials: %v", err)
+			continue
+		}
+
+		var signers []ssh.Signer
+		signers, err = userAgent.Signers()
+		if err != nil {
+			err = trace.BadParameter("failed to get user credentials: %v", err)
+			continue
+		}
+
+		var tlsConfig *tls.Config
+		tlsConfig, err = ctx.ClientTLSConfig()
+		if err != nil {
+			err = trace.BadParameter("failed to get client TLS config: %v", err)
+			continue
+		}
+
+		return userAgent, cert, signers, tlsConfig, nil
+	}
+	return nil, nil, nil, nil, err
+}
+
+// makeClient builds a *client.TeleportClient for the connection.
+func (t *TerminalHandler) makeClient(ws *websocket.Conn) (*client.TeleportClient, error) {
+	userAgent, cert, signers, tlsConfig, err := getUserCredentials(t.ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// Create a wrapped websocket to wrap/unwrap the envelope used to
+	// communicate over the websocket.
+	wrappedSock := newWrappedSocket(ws, t)
+	t.wrappedSock = wrappedSock
+
+	// If requested, coalesce terminal output into line buffered frames for
+	// clients that can not handle high frequency frames.
+	var terminalOutput io.Writer = wrappedSock
+	if t.params.LineBuffered {
+		t.lineBuffer = newLineBufferedWriter(wrappedSock, defaults.LineBufferedFlushPeriod)
+		terminalOutput = t.lineBuffer
+	}
+
+	// If requested, keep a bounded buffer of recent output so a new
+	// connection joining this session (a browser tab reload) can have the
+	// tail replayed instead of coming back to a blank screen.
+	if t.params.ScrollbackBytes > 0 && t.ctx != nil {
+		scrollback := t.ctx.GetScrollback(t.sessionID, t.params.ScrollbackBytes)
+
+		// Replay the buffered tail before any live output. The replay goes
+		// through the wrapped socket so it is framed (and UTF-8 encoded)
+		// exactly like live output, but chunked and tagged as history.
+		// A client that kept its local scrollback names the offset it
+		// already has and gets only the newer part; an offset the buffer
+		// no longer retains falls back to a full replay, flagged in the
+		// metadata frame.
+		tail := scrollback.Bytes()
+		if t.params.ResumeFromSeq > 0 {
+			tail, t.replayFull = scrollback.BytesFrom(int64(t.params.ResumeFromSeq))
+		}
+		if len(tail) > 0 {
+			t.replayScrollback(wrappedSock, tail)
+		}
+
+		// Tee live output into the scrollback buffer for the next joiner.
+		terminalOutput = io.MultiWriter(scrollback, terminalOutput)
+	}
+
+	// If requested, tee output into a local timing annotated transcript
+	// holding exactly what the web client saw.
+	if t.params.RecordToPath != "" {
+		recorder, err := newSessionRecorder(t.params.RecordToPath, defaults.MaxWebRecordingBytes)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		t.recorder = recorder
+		terminalOutput = io.MultiWriter(recorder, terminalOutput)
+	}
+
+	principal, err := selectPrincipal(t.params.Principal, cert.ValidPrincipals)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// Adapt the terminal request to the operating system the resolved node
+	// advertises: a Windows SSH host renders garbage unless it is asked
+	// for a TERM conpty understands, without POSIX terminal modes.
+	negotiator := negotiatorForNode(t.node)
+
+	clientConfig := &client.Config{
+		SkipLocalAuth:    true,
+		ForwardAgent:     t.forwardAgent(),
+		Agent:            userAgent,
+		TLS:              tlsConfig,
+		AuthMethods:      []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		DefaultPrincipal: principal,
+		HostLogin:        t.params.Login,
+		Username:         t.ctx.user,
+		Namespace:        t.params.Namespace,
+		Stdout:           terminalOutput,
+		Stderr:           terminalOutput,
+		Stdin:            wrappedSock,
+		SiteName:         t.params.Cluster,
+		ProxyHostPort:    t.params.ProxyHostPort,
+		Host:             t.hostName,
+		HostPort:         t.hostPort,
+		Env:              t.sessionEnv(),
+		TermType:         negotiator.TermType(t.params.TermType),
+		TermModes:        negotiator.TerminalModes(),
+		Subsystem:        t.params.Subsystem,
+		HostKeyCallback:  t.hostKeyCheck(),
+		ClientAddr:       t.clientAddr(),
+	}
+	if len(t.params.InteractiveCommand) > 0 {
+		clientConfig.Interactive = true
+
+		// In command mode the SSH layer keeps the streams separate, so
+		// stderr can be tagged for the browser to highlight. A PTY merges
+		// the streams and the distinction is moot.
+		clientConfig.Stderr = stderrSocket{wrappedSock}
+	}
+
+	tc, err := client.NewClient(clientConfig)
+	if err != nil {
+		return nil, trace.BadParameter("failed to create client: %v", err)
+	}
+	t.teleportClient = tc
+
+	// If per phase budgets were requested, report the phase that stalled to
+	// the web client and tear the connection down.
+	if len(t.params.PhaseTimeouts) > 0 {
+		t.phaseWatchdog = newPhaseWatchdog(t.params.PhaseTimeouts, func(phase string) {
+			er := t.writeError(trace.ConnectionProblem(nil, "timeout connecting to node in phase %q", phase), ws)
+			if er != nil {
+				t.log().Warnf("Unable to send error to terminal: %v.", er)
+			}
+			t.Close()
+		})
+	}
+
+	// Report connection progress to the web client as the dials happen.
+	// The watchdog, when armed, rides the same callback.
+	tc.OnConnectPhase = func(phase string) {
+		t.sendStatus(ws, statusStateConnecting, statusDetailForPhase(phase))
+		if t.phaseWatchdog != nil {
+			t.phaseWatchdog.enter(phase)
+		}
+	}
+
+	// Save the *ssh.Session after the shell has been created. The session is
+	// used to update all other parties window size to that of the web client and
+	// to allow future window changes.
+	tc.OnShellCreated = func(s *ssh.Session, c *ssh.Client, shell io.ReadWriteCloser) (bool, error) {
+		t.sshSession = s
+		t.sshClient = c
+
+		// Confirm to the web client what it actually connected to, now
+		// that the server name has been resolved and the shell exists.
+		// This goes out before the initial window change so the metadata
+		// frame stays the first structured frame on the wire.
+		er := t.sendMetadata(ws)
+		if er != nil {
+			t.log().Warnf("Unable to send session metadata to web client: %v.", er)
+		}
+
+		// The spinner can come down: whatever follows is session output.
+		t.sendStatus(ws, statusStateReady, "shell ready")
+
+		// A subsystem has no PTY: there is no window to size and no shell
+		// to seed.
+		if t.params.Subsystem == "" {
+			t.windowChange(&t.params.Term)
+
+			// Seed the interactive session with the requested init command.
+			// It is written verbatim, see the InitCommand doc.
+			if t.params.InitCommand != "" {
+				_, er := io.WriteString(shell, t.params.InitCommand)
+				if er != nil {
+					t.log().Warnf("Unable to write init command to shell: %v.", er)
+				}
+			}
+		}
+
+		// The connection made it through all phases, disarm the watchdog.
+		if t.phaseWatchdog != nil {
+			t.phaseWatchdog.stop()
+		}
+
+		return false, nil
+	}
+
+	return tc, nil
+}
+
+// replayScrollback replays the buffered scrollback tail in bounded chunks
+// with a short pause between them, so a large backlog neither exceeds
+// browser frame limits nor stalls rendering. The frames are tagged as
+// replay so the UI can show a history indicator apart from live output.
+func (t *TerminalHandler) replayScrollback(sock *wrappedSocket, tail []byte) {
+	chunkBytes := t.params.ReplayChunkBytes
+	if chunkBytes <= 0 {
+		chunkBytes = defaults.ReplayChunkBytes
+	}
+	delay := t.params.ReplayChunkDelay
+	if delay <= 0 {
+		delay = defaults.ReplayChunkDelay
+	}
+
+	for off := 0; off < len(tail); off += chunkBytes {
+		end := off + chunkBytes
+		if end > len(tail) {
+			end = len(tail)
+		}
+
+		_, err := sock.write(tail[off:end], defaults.ReplayWebsocketPrefix, defaults.ReplayEnvelopeType)
+		if err != nil {
+			t.log().Warnf("Unable to replay scrollback to web client: %v.", err)
+			return
+		}
+
+		// Give the browser a moment to render before the next chunk.
+		if end < len(tail) {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// selectPrincipal picks the certificate principal the client identifies
+// with. An explicitly requested principal has to be one the certificate
+// is valid for, by default the certificate's first principal is used.
+func selectPrincipal(requested string, validPrincipals []string) (string, error) {
+	if requested == "" {
+		if len(validPrincipals) == 0 {
+			return "", trace.BadParameter("certificate carries no valid principals")
+		}
+		return validPrincipals[0], nil
+	}
+	for _, principal := range validPrincipals {
+		if principal == requested {
+			return requested, nil
+		}
+	}
+	return "", trace.BadParameter("principal %q is not among the certificate's valid principals", requested)
+}
+
+// sessionEnv builds the environment for the session: cluster-level defaults
+// (locale settings) at the bottom, the variables the client requested over
+// them, and the reserved session variable laid on top so it can not be
+// overridden by either.
+func (t *TerminalHandler) sessionEnv() map[string]string {
+	env := make(map[string]string, len(t.defaultEnv)+len(t.params.Env)+1)
+	for key, value := range t.defaultEnv {
+		env[key] = value
+	}
+	for key, value := range t.params.Env {
+		env[key] = value
+	}
+	env[sshutils.SessionEnvVar] = string(t.params.SessionID)
+	return env
+}
+
+// terminalTypes is the allowlist of TERM values the web terminal may
+// request, guarding against injection into the SSH terminal modes.
+var terminalTypes = map[string]bool{
+	"xterm":           true,
+	"xterm-color":     true,
+	"xterm-256color":  true,
+	"screen":          true,
+	"screen-256color": true,
+	"vt100":           true,
+	"linux":           true,
+	"ansi":            true,
+	"dumb":            true,
+}
+
+// validateTermType checks the requested terminal type against the
+// allowlist.
+func validateTermType(termType string) error {
+	if !terminalTypes[termType] {
+		return trace.BadParameter("term_type: unsupported terminal type %q", termType)
+	}
+	return nil
+}
+
+// shellNegotiator captures the per operating system differences in how the
+// terminal session is requested from the node: the TERM to ask for and the
+// POSIX terminal modes to include in the PTY request.
+type shellNegotiator interface {
+	// TermType picks the terminal type to request on the node given the
+	// type the web client asked for.
+	TermType(requested string) string
+	// TerminalModes returns the terminal modes for the PTY request, nil
+	// meaning none are requested.
+	TerminalModes() ssh.TerminalModes
+}
+
+// unixNegotiator requests the terminal the way the client asked for it:
+// POSIX hosts understand every TERM on the allowlist.
+type unixNegotiator struct{}
+
+func (unixNegotiator) TermType(requested string) string { return requested }
+
+func (unixNegotiator) TerminalModes() ssh.TerminalModes {
+	return ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+}
+
+// windowsNegotiator adjusts the request for Windows SSH hosts: conpty only
+// renders terminal types from the xterm family properly, and the POSIX
+// terminal modes have no meaning there, so none are ever requested.
+type windowsNegotiator struct{}
+
+func (windowsNegotiator) TermType(requested string) string {
+	if strings.HasPrefix(requested, "xterm") {
+		return requested
+	}
+	return "xterm-256color"
+}
+
+func (windowsNegotiator) TerminalModes() ssh.TerminalModes { return nil }
+
+// negotiatorForNode picks the shell negotiator matching the node's
+// advertised "os" label, defaulting to the POSIX behavior when the label
+// is missing or unknown.
+func negotiatorForNode(node services.Server) shellNegotiator {
+	if node != nil && strings.HasPrefix(strings.ToLower(node.GetAllLabels()["os"]), "windows") {
+		return windowsNegotiator{}
+	}
+	return unixNegotiator{}
+}
+
+// replaceInvalidUTF8 substitutes every invalid byte sequence in data with
+// the Unicode replacement character so output from programs that emit raw
+// binary does not abort the session.
+func replaceInvalidUTF8(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			out = append(out, []byte(string(utf8.RuneError))...)
+		} else {
+			out = append(out, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return out
+}
+
+// maxLoginLength bounds the length of a requested login or principal,
+// matching the 32 character username limit common to Linux systems.
+const maxLoginLength = 32
+
+// validateLogin rejects names that could not be a legitimate Unix
+// username: control characters, shell metacharacters and anything outside
+// a conservative alphanumeric/underscore/dash/dot alphabet. The login ends
+// up as the SSH username and in audit records, so the entry point is kept
+// strict. The field name prefixes the error so the check covers both the
+// login and the principal.
+func validateLogin(field string, login string) error {
+	if len(login) > maxLoginLength {
+		return trace.BadParameter("%v: exceeds %v characters", field, maxLoginLength)
+	}
+	for _, r := range login {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_', r == '-', r == '.':
+		default:
+			return trace.BadParameter("%v: invalid character %q", field, r)
+		}
+	}
+	return nil
+}
+
+// validateEnv checks the environment variable names requested for the
+// session are well formed.
+func validateEnv(env map[string]string) error {
+	for key := range env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return trace.BadParameter("env: invalid variable name %q", key)
+		}
+	}
+	return nil
+}
+
+// phaseWatchdog bounds the time a connection may spend in each connect
+// phase. When a phase exceeds its budget the onTimeout callback is called
+// with the name of the phase so the error can say where the connection
+// stalled.
+type phaseWatchdog struct {
+	sync.Mutex
+
+	// budgets maps a phase name to the time the connection may spend in it.
+	budgets map[string]time.Duration
+
+	// timer fires when the current phase exceeds its budget.
+	timer *time.Timer
+
+	// done is set once the connection is established (or torn down).
+	done bool
+
+	// onTimeout is called with the name of the phase that stalled.
+	onTimeout func(phase string)
+}
+
+func newPhaseWatchdog(budgets map[string]time.Duration, onTimeout func(phase string)) *phaseWatchdog {
+	return &phaseWatchdog{
+		budgets:   budgets,
+		onTimeout: onTimeout,
+	}
+}
+
+// enter moves the watchdog into the given phase: the previous phase
+// deadline is disarmed and a new one is armed with the phase budget.
+func (w *phaseWatchdog) enter(phase string) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.disarmLocked()
+	if w.done {
+		return
+	}
+
+	budget := w.budgets[phase]
+	if budget > 0 {
+		w.timer = time.AfterFunc(budget, func() { w.onTimeout(phase) })
+	}
+}
+
+// stop disarms the watchdog for good, it is called once the connection is
+// established (or torn down).
+func (w *phaseWatchdog) stop() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.done = true
+	w.disarmLocked()
+}
+
+// disarmLocked stops the deadline of the current phase. The caller has to
+// hold the lock.
+func (w *phaseWatchdog) disarmLocked() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// hostKeyCheck returns the host key verification used for the connection:
+// the injected callback when one was provided, the built-in certificate
+// check otherwise.
+func (t *TerminalHandler) hostKeyCheck() ssh.HostKeyCallback {
+	if t.hostKeyCallback != nil {
+		return t.hostKeyCallback
+	}
+	return t.checkHostKey
+}
+
+// checkHostKey verifies the key the node presented. Nodes present host
+// certificates, so the certificate has to be signed by one of the cluster's
+// trusted host authorities. A plain host key (or a certificate from an
+// unknown authority) is rejected unless strict checking was explicitly
+// turned off in the request.
+func (t *TerminalHandler) checkHostKey(host string, addr net.Addr, key ssh.PublicKey) error {
+	// In proxy recording mode the connection terminates at the recording
+	// proxy, which verifies the node's host certificate itself when it
+	// dials onward. The key presented here belongs to the in-path proxy
+	// and checking it against node expectations would reject a healthy
+	// connection.
+	if t.proxyRecording() {
+		return nil
+	}
+
+	strict := t.params.StrictHostKeyChecking == nil || *t.params.StrictHostKeyChecking
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		if strict {
+			return trace.AccessDenied("node %v presented a host key, expected a host certificate", host)
+		}
+		t.log().Warnf("Insecure configuration! Strict host key checking disabled, allowing connection to %v without checking host key.", host)
+		return nil
+	}
+
+	err := t.verifyHostCertificate(cert)
+	if err != nil {
+		if strict {
+			return trace.Wrap(err)
+		}
+		t.log().Warnf("Insecure configuration! Strict host key checking disabled, ignoring host certificate error for %v: %v.", host, err)
+	}
+
+	return nil
+}
+
+// verifyHostCertificate checks the certificate presented by the node was
+// signed by one of the cluster's trusted host authorities.
+func (t *TerminalHandler) verifyHostCertificate(cert *ssh.Certificate) error {
+	clt, err := t.ctx.GetClient()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	certAuthorities, err := clt.GetCertAuthorities(services.HostCA, false)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, ca := range certAuthorities {
+		checkers, err := ca.Checkers()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		for _, checker := range checkers {
+			if sshutils.KeysEqual(checker, cert.SignatureKey) {
+				return nil
+			}
+		}
+	}
+
+	return trace.AccessDenied("node presented a host certificate signed by an unknown authority")
+}
+
+// streamTerminal opens a SSH connection to the remote host and streams
+// events back to the web client.
+func (t *TerminalHandler) streamTerminal(ws *websocket.Conn, tc *client.TeleportClient) {
+	defer t.terminalCancel()
+
+	// Establish SSH connection to the server. This function will block until
+	// either an error occurs or it completes successfully.
+	err := tc.SSH(t.terminalContext, t.params.InteractiveCommand, false)
+
+	// A command exiting non-zero is a result, not a failure: the close
+	// frame carries the code for scripting callers and the session ends
+	// cleanly.
+	if code, ok := exitStatusError(err); ok {
+		t.log().Debugf("Remote command exited with status %v.", code)
+		err = nil
+	}
+
+	if err != nil {
+		// The raw error goes to the server log, the user sees a friendly
+		// classification of what went wrong instead of a wrapped SSH
+		// library message.
+		t.log().Warnf("Unable to stream terminal: %v.", err)
+		t.noteFailure(failureSideServer)
+		friendly := classifySSHError(err)
+		t.sendStatus(ws, statusStateError, friendly)
+		// A broken browser websocket takes the SSH bridge down with it; if
+		// the client side broke first and the session stays resumable, save
+		// the one-shot close callback for the teardown after the resume.
+		if !t.stillResumable() {
+			t.fireClose(friendly, false)
+		}
+		er := t.writeError(trace.Errorf("%v", friendly), ws)
+		if er != nil {
+			t.log().Warnf("Unable to send error to terminal: %v: %v.", err, er)
+		}
+	}
+
+	// Flush buffered output and pending audit events before the close
+	// frame so the last lines of the command are not lost.
+	t.drainOutput()
+
+	// Tell the web client why the session ended and the exit status of the
+	// remote command, so it can distinguish a clean logout from a crash.
+	er := t.sendClose(ws, err)
+	if er != nil {
+		t.log().Warnf("Unable to send close envelope to web client: %v.", er)
+	}
+}
+
+// exitStatusError reports whether the error from the SSH connection just
+// carries the remote command's non-zero exit status rather than a
+// connection failure, and the status it carries.
+func exitStatusError(err error) (int, bool) {
+	if err == nil {
+		return 0, false
+	}
+	exitErr, ok := trace.Unwrap(err).(*ssh.ExitError)
+	if !ok {
+		return 0, false
+	}
+	return exitErr.ExitStatus(), true
+}
+
+// classifySSHError maps common SSH connection failures to friendly,
+// actionable messages for the web terminal. The mapping keys off trace
+// error types and known substrings; anything unrecognized is passed
+// through unchanged.
+func classifySSHError(err error) string {
+	if err == nil {
+		return ""
+	}
+	message := err.Error()
+	lower := strings.ToLower(message)
+	switch {
+	case trace.IsAccessDenied(err):
+		return "access denied to the node, check your permissions and try again"
+	case strings.Contains(lower, "certificate") && strings.Contains(lower, "expired"):
+		return "your certificate has expired, log in again to refresh it"
+	case strings.Contains(lower, "no such user") || strings.Contains(lower, "unknown user") || strings.Contains(lower, "invalid login"):
+		return "the requested login does not exist on the node, try a different login"
+	case trace.IsConnectionProblem(err) || strings.Contains(lower, "connection refused") ||
+		strings.Contains(lower, "no route to host") || strings.Contains(lower, "i/o timeout"):
+		return "the node is unreachable, it may be down or behind a firewall"
+	case strings.Contains(lower, "ssh: handshake failed"):
+		return "unable to authenticate to the node, log in again and retry"
+	default:
+		return message
+	}
+}
+
+// Which side of the connection a failure was observed on, reported in the
+// close and error frames so the user can tell a dropped network from a dead
+// node.
+const (
+	// failureSideClient means the browser websocket broke.
+	failureSideClient = "client"
+	// failureSideServer means the SSH side to the node broke.
+	failureSideServer = "server"
+)
+
+// noteFailure records which side of the connection a goroutine observed
+// failing. The first observation wins: when the browser goes away the SSH
+// side often fails moments later, and the triage signal is who broke first.
+func (t *TerminalHandler) noteFailure(side string) {
+	t.failureMu.Lock()
+	defer t.failureMu.Unlock()
+	if t.failureSide == "" {
+		t.failureSide = side
+	}
+}
+
+// failedSide returns which side of the connection broke first, empty when
+// no failure was observed.
+func (t *TerminalHandler) failedSide() string {
+	t.failureMu.Lock()
+	defer t.failureMu.Unlock()
+	return t.failureSide
+}
+
+// stillResumable reports whether the teardown in progress is a transient
+// client-side disconnect of a resumable session: the browser websocket
+// broke first and a reconnect presenting the token may still re-attach.
+// Sessions that end for any other reason (the remote command exiting, a
+// kill, a deadline) are not resumable.
+func (t *TerminalHandler) stillResumable() bool {
+	return t.resumeToken != "" && t.failedSide() == failureSideClient
+}
+
+// sendClose emits the structured close envelope carrying the reason the
+// session ended and the exit status of the remote command when it is known.
+// Clients that did not declare a protocol version get the bare websocket
+// close they expect instead.
+func (t *TerminalHandler) sendClose(ws *websocket.Conn, sshErr error) error {
+	if t.params.ProtocolVersion < defaults.TerminalProtocolVersion {
+		return nil
+	}
+
+	exitStatus := -1
+	if t.teleportClient != nil {
+		exitStatus = t.teleportClient.ExitStatus
+	}
+	frame := closeFrame(sshErr, exitStatus, t.failedSide())
+
+	if t.binaryOutput() {
+		payload, err := json.Marshal(frame.Payload)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(websocket.Message.Send(ws, encodeBinaryFrame(defaults.CloseWebsocketPrefix, payload)))
+	}
+
+	return trace.Wrap(websocket.JSON.Send(ws, frame))
+}
+
+// sendMetadata emits the resolved connection metadata to the web client so
+// it can display what it actually connected to, even when the user typed a
+// label or a partial server name.
+func (t *TerminalHandler) sendMetadata(ws *websocket.Conn) error {
+	frame := t.metadataFrame()
+
+	if t.binaryOutput() {
+		payload, err := json.Marshal(frame.Payload)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(websocket.Message.Send(ws, encodeBinaryFrame(defaults.SessionMetadataWebsocketPrefix, payload)))
+	}
+
+	return trace.Wrap(websocket.JSON.Send(ws, frame))
+}
+
+// Connection status states reported to the web client while the session is
+// being established, so the UI can show a spinner with context instead of
+// a blank terminal.
+const (
+	// statusStateConnecting means the connection is progressing through
+	// its phases, named in the status detail.
+	statusStateConnecting = "connecting"
+	// statusStateReady means the shell is open and terminal output
+	// follows.
+	statusStateReady = "ready"
+	// statusStateError means the connection failed, the error frame with
+	// the reason follows.
+	statusStateError = "error"
+)
+
+// statusDetailForPhase translates a connect phase into the human readable
+// detail shown next to the spinner.
+func statusDetailForPhase(phase string) string {
+	switch phase {
+	case client.ConnectPhaseProxy:
+		return "dialing proxy"
+	case client.ConnectPhaseNode:
+		return "dialing node"
+	case client.ConnectPhaseShell:
+		return "opening shell"
+	}
+	return phase
+}
+
+// sendStatus reports connection progress to the web client. Delivery is
+// best effort: a client that misses a status frame still learns the
+// outcome from the metadata, error or close frames.
+func (t *TerminalHandler) sendStatus(ws *websocket.Conn, state string, detail string) {
+	frame := statusEnvelope{
+		Type:    defaults.StatusEnvelopeType,
+		Payload: statusPayload{State: state, Detail: detail},
+	}
+
+	t.applyWriteDeadline(ws)
+	var err error
+	if t.binaryOutput() {
+		var payload []byte
+		payload, err = json.Marshal(frame.Payload)
+		if err == nil {
+			err = websocket.Message.Send(ws, encodeBinaryFrame(defaults.StatusWebsocketPrefix, payload))
+		}
+	} else {
+		err = websocket.JSON.Send(ws, frame)
+	}
+	if err != nil {
+		t.log().Warnf("Unable to send status to web client: %v.", err)
+	}
+}
+
+// metadataFrame builds the envelope with the resolved connection metadata.
+func (t *TerminalHandler) metadataFrame() sessionMetadataEnvelope {
+	payload := sessionMetadata{
+		HostName:    t.hostName,
+		HostPort:    t.hostPort,
+		Login:       t.params.Login,
+		Cluster:     t.params.Cluster,
+		SessionID:   string(t.sessionID),
+		RequestID:   t.params.RequestID,
+		ResumeToken: t.resumeToken,
+		Joined:      t.joined,
+		ReplayFull:  t.replayFull,
+	}
+	if t.node != nil {
+		labels := t.node.GetAllLabels()
+		payload.NodeOS = labels["os"]
+		payload.NodeArch = labels["arch"]
+		payload.NodeVersion = labels["version"]
+	}
+	return sessionMetadataEnvelope{
+		Type:    defaults.SessionMetadataEnvelopeType,
+		Payload: payload,
+	}
+}
+
+// closeFrame builds the envelope sent right before the websocket is torn
+// down, describing why the session ended and, on failure, which side of the
+// connection broke.
+func closeFrame(sshErr error, exitStatus int, side string) closeEnvelope {
+	payload := closePayload{
+		Reason:   "session ended",
+		ExitCode: exitStatus,
+		Clean:    true,
+	}
+	if sshErr != nil {
+		payload.Reason = sshErr.Error()
+		payload.Clean = false
+		payload.Side = side
+	}
+	return closeEnvelope{
+		Type:    defaults.CloseEnvelopeType,
+		Payload: payload,
+	}
+}
+
+// applyWriteDeadline arms the websocket write deadline ahead of a send so
+// a client that stops draining its connection cannot block the sender
+// forever. A zero WriteTimeout leaves the socket without a deadline.
+func (t *TerminalHandler) applyWriteDeadline(ws *websocket.Conn) {
+	if t == nil || t.params.WriteTimeout == 0 {
+		return
+	}
+	ws.SetWriteDeadline(time.Now().Add(t.params.WriteTimeout))
+}
+
+// checkWriteError tears the session down when a send failed because the
+// write deadline fired: the client has stopped draining the connection
+// and every further send would block the same way.
+func (t *TerminalHandler) checkWriteError(err error) error {
+	if err == nil || t == nil {
+		return err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.log().Warnf("Websocket write timed out, tearing the session down: %v.", err)
+		t.noteFailure(failureSideClient)
+		if t.terminalCancel != nil {
+			t.terminalCancel()
+		}
+		return trace.ConnectionProblem(err, "websocket write timed out")
+	}
+	return err
+}
+
+// sendEvent delivers one audit event to the web client. Large frames are
+// gzip-compressed and sent as prefixed binary messages when compression
+// was requested, everything else goes out as a plain JSON envelope.
+func (t *TerminalHandler) sendEvent(ws *websocket.Conn, event events.EventFields) error {
+	e := eventEnvelope{
+		Type:    defaults.AuditEnvelopeType,
+		Payload: event,
+		Seq:     int(atomic.AddInt64(&t.eventSeq, 1)),
+	}
+	if !t.params.CompressEvents {
+		t.applyWriteDeadline(ws)
+		return trace.Wrap(t.checkWriteError(websocket.JSON.Send(ws, e)))
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	threshold := t.params.CompressThreshold
+	if threshold == 0 {
+		threshold = defaults.AuditGzipThresholdBytes
+	}
+	if len(payload) <= threshold {
+		t.applyWriteDeadline(ws)
+		return trace.Wrap(t.checkWriteError(websocket.JSON.Send(ws, e)))
+	}
+
+	compressed, err := gzipFrame(payload, t.params.CompressLevel)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	t.applyWriteDeadline(ws)
+	return trace.Wrap(t.checkWriteError(websocket.Message.Send(ws, encodeBinaryFrame(defaults.AuditGzipWebsocketPrefix, compressed))))
+}
+
+// sendEventOrCancel delivers one audit event, treating a failed send as
+// fatal for the event stream: skipping an event would leave an
+// undetectable gap in the sequence, so the stream ends instead.
+func (t *TerminalHandler) sendEventOrCancel(ws *websocket.Conn, event events.EventFields) error {
+	err := t.sendEvent(ws, event)
+	if err != nil {
+		t.log().Warnf("Unable to send %v event to web client, ending event stream: %v.", event.GetType(), err)
+		t.eventCancel()
+	}
+	return trace.Wrap(err)
+}
+
+// gzipFrame compresses a marshaled envelope at the given level, zero
+// meaning gzip.DefaultCompression.
+func gzipFrame(payload []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, err = zw.Write(payload)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// deflateFrame compresses terminal output bytes at the given level, zero
+// meaning flate.DefaultCompression. Unlike gzipFrame there is no header or
+// checksum: the websocket frame already delimits the stream.
+func deflateFrame(payload []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	_, err = fw.Write(payload)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	err = fw.Close()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// streamEventsOnly serves a detached monitoring session: the audit events
+// of the session are polled from the backend and pushed to the web client
+// without an SSH connection behind them. The stream ends when the session
+// end event is seen, a timeout fires, or the client goes away.
+func (t *TerminalHandler) streamEventsOnly(ws *websocket.Conn) {
+	t.sendStatus(ws, statusStateReady, "streaming events")
+
+	go t.streamEvents(ws, nil)
+
+	if t.params.KeepAliveInterval > 0 {
+		go t.streamKeepAlive(ws)
+	}
+
+	// Drain client frames so control envelopes (keepalive pongs, latency
+	// probes) keep working: there is no terminal input pump to consume
+	// them. Any input bytes are discarded, there is no shell to type into.
+	sock := newWrappedSocket(ws, t)
+	t.wrappedSock = sock
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			_, err := sock.Read(buffer)
+			if err != nil {
+				t.terminalCancel()
+				return
+			}
+		}
+	}()
+
+	// The event stream ending is the only server-side teardown condition
+	// in this mode, regardless of the EndOn setting: there is no SSH
+	// connection to wait for.
+	<-t.eventContext.Done()
+	t.sendClose(ws, nil)
+	t.terminalCancel()
+}
+
+// streamEvents receives events over the SSH connection (as well as periodic
+// polling) to update the client with relevant audit events. A nil Teleport
+// client (events-only mode) leaves the push channel out and the stream is
+// fed by polling alone.
+func (t *TerminalHandler) streamEvents(ws *websocket.Conn, tc *client.TeleportClient) {
+	// A cursor are used to keep track of where we are in the event stream. This
+	// is to find "session.end" events. If an earlier connection to this session
+	// already delivered events, resume strictly after the last one so a
+	// reconnect does not replay them.
+	var cursor int = -1
+	if t.ctx != nil {
+		cursor = t.ctx.GetEventCursor(t.sessionID)
+	}
+
+	pollInterval := t.params.EventPollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaults.SessionRefreshPeriod
+	}
+	tickerCh := time.NewTicker(pollInterval)
+	defer tickerCh.Stop()
+
+	// Events the client did not subscribe to are dropped before marshaling.
+	filter := newEventFilter(t.params.EventFilter)
+
+	// Push events are drained into a bounded ring by a separate goroutine
+	// so a slow websocket never backs up the client's event pipeline. The
+	// coalescer is confined to that goroutine, with its own ticker to
+	// flush pending runs.
+	ring := newEventRing(t.params.EventBufferSize)
+	go func() {
+		// Without a Teleport client there is no push channel; a nil
+		// channel never delivers, so only the flush ticker fires.
+		var pushC <-chan events.EventFields
+		if tc != nil {
+			pushC = tc.EventsChannel()
+		}
+
+		coalescer := newEventCoalescer(t.params.CoalesceEvents)
+		flushCh := time.NewTicker(defaults.SessionRefreshPeriod)
+		defer flushCh.Stop()
+
+		for {
+			select {
+			case event := <-pushC:
+				if !filter.allows(event.GetType()) {
+					continue
+				}
+				t.log().Debugf("Buffering audit event %v for web client.", event.GetType())
+
+				for _, readyEvent := range coalescer.add(event) {
+					ring.push(readyEvent)
+				}
+			case <-flushCh.C:
+				for _, readyEvent := range coalescer.flush() {
+					ring.push(readyEvent)
+				}
+			case <-t.eventContext.Done():
+				return
+			}
+		}
+	}()
+
+	// flushRing sends everything buffered to the web client, annotating
+	// the first event after an overflow with the number of events dropped
+	// before it.
+	flushRing := func() error {
+		for {
+			event, dropped, ok := ring.pop()
+			if !ok {
+				return nil
+			}
+			if dropped > 0 {
+				annotated := make(events.EventFields, len(event)+1)
+				for key, value := range event {
+					annotated[key] = value
+				}
+				annotated[events.EventDroppedCount] = dropped
+				event = annotated
+			}
+			err := t.sendEventOrCancel(ws, event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// pump polls the backend once, sending everything new to the web
+	// client. It returns the advanced cursor and whether the session end
+	// event was seen.
+	pump := func(cursor int) (int, bool) {
+		// Fetch all session events from the backend.
+		sessionEvents, cur, err := t.pollEvents(cursor)
+		if err != nil {
+			if !trace.IsNotFound(err) {
+				t.log().Errorf("Unable to poll for events: %v.", err)
+			}
+			return cursor, false
+		}
+
+		// Update the cursor location and persist it across reconnects.
+		cursor = cur
+		if t.ctx != nil {
+			t.ctx.SetEventCursor(t.sessionID, cursor)
+		}
+
+		// Send all events to the web client.
+		ended := false
+		for _, sessionEvent := range sessionEvents {
+			if filter.allows(sessionEvent.GetType()) {
+				err = t.sendEventOrCancel(ws, sessionEvent)
+				if err != nil {
+					return cursor, ended
+				}
+			}
+
+			// The end of the session still closes the websocket, even
+			// when the client did not subscribe to "session.end".
+			if sessionEvent.GetType() == events.SessionEndEvent {
+				ended = true
+			}
+		}
+		return cursor, ended
+	}
+
+	// Replay the events recorded before this client joined ahead of
+	// anything live, so a joiner has the context of what already happened.
+	if t.params.ReplayEventsAfter > 0 {
+		t.replayHistoricalEvents(ws, filter)
+	}
+
+	for {
+		select {
+		// Send buffered push events to the web client.
+		case <-ring.notify:
+			err := flushRing()
+			if err != nil {
+				return
+			}
+		// Poll for events to send to the web client. This is for events that can
+		// not be sent over the events channel (like "session.end" which lingers for
+		// a while after all party members have left).
+		case <-tickerCh.C:
+			var ended bool
+			cursor, ended = pump(cursor)
+			if ended {
+				t.eventCancel()
+				return
+			}
+		// The SSH session has ended: deliver everything that is pending
+		// so the close frame is the last thing the browser sees.
+		case <-t.drainC:
+			err := flushRing()
+			var ended bool
+			cursor, ended = pump(cursor)
+			close(t.eventsDrained)
+			if err != nil || ended {
+				t.eventCancel()
+				return
+			}
+		case <-t.eventContext.Done():
+			return
+		}
+	}
+}
+
+// replayHistoricalEvents streams the audit events already recorded for the
+// session, from the requested index forward, tagged as historical so the
+// UI can render the catch-up apart from the live stream. The range is
+// capped to the most recent MaxReplayEvents so a long running session
+// cannot flood the connection on every join.
+func (t *TerminalHandler) replayHistoricalEvents(ws *websocket.Conn, filter eventFilter) {
+	sessionEvents, err := t.authProvider.GetSessionEvents(t.namespace, t.sessionID, t.params.ReplayEventsAfter, false)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			t.log().Warnf("Unable to fetch historical events: %v.", err)
+		}
+		return
+	}
+	if len(sessionEvents) > defaults.MaxReplayEvents {
+		sessionEvents = sessionEvents[len(sessionEvents)-defaults.MaxReplayEvents:]
+	}
+
+	for _, event := range sessionEvents {
+		if !filter.allows(event.GetType()) {
+			continue
+		}
+		e := eventEnvelope{
+			Type:    defaults.HistoricalEnvelopeType,
+			Payload: event,
+			Seq:     int(atomic.AddInt64(&t.eventSeq, 1)),
+		}
+		t.applyWriteDeadline(ws)
+		if err := t.checkWriteError(websocket.JSON.Send(ws, e)); err != nil {
+			t.log().Warnf("Unable to send historical event to web client: %v.", err)
+			return
+		}
+	}
+}
+
+// drainOutput flushes whatever terminal output is still buffered and gives
+// the event stream a bounded window to deliver the remaining audit events,
+// so the last lines of a command reach the browser before the close frame.
+func (t *TerminalHandler) drainOutput() {
+	if t.lineBuffer != nil {
+		t.lineBuffer.flush()
+	}
+	if t.drainC == nil || t.eventsDrained == nil {
+		return
+	}
+	select {
+	case t.drainC <- struct{}{}:
+	default:
+	}
+	select {
+	case <-t.eventsDrained:
+	case <-t.eventContext.Done():
+		// The event stream already finished on its own.
+	case <-time.After(defaults.CloseDrainTimeout):
+		t.log().Warnf("Timed out draining audit events before close.")
+	}
+}
+
+// jitteredInterval spreads interval by up to the given fraction in either
+// direction, keeping the result inside [interval*(1-jitter), interval*(1+jitter)].
+// It is what keeps a fleet of sessions started at the same moment from
+// pinging in lockstep forever.
+func jitteredInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	spread := (rand.Float64()*2 - 1) * jitter
+	return interval + time.Duration(float64(interval)*spread)
+}
+
+// streamKeepAlive periodically pings the web client. The browser echoes
+// every ping back with a pong envelope, if too many pings in a row go
+// unanswered the websocket is considered dead and the session is torn down.
+// Each wait is jittered around KeepAliveInterval so pings from many
+// sessions spread out instead of arriving in synchronized bursts.
+func (t *TerminalHandler) streamKeepAlive(ws *websocket.Conn) {
+	timer := time.NewTimer(jitteredInterval(t.params.KeepAliveInterval, t.params.KeepAliveJitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(jitteredInterval(t.params.KeepAliveInterval, t.params.KeepAliveJitter))
+			missed := t.keepAlive.pingSent()
+			if t.params.PongTimeout > 0 {
+				// An explicit pong deadline decides liveness on its own,
+				// the missed ping count only applies when none was
+				// configured.
+				if t.keepAlive.sincePong() > t.params.PongTimeout {
+					t.log().Warnf("No pong from web client for over %v, closing session.", t.params.PongTimeout)
+					t.noteFailure(failureSideClient)
+					t.terminalCancel()
+					return
+				}
+			} else if missed > defaults.MaxMissedKeepAlives {
+				t.log().Warnf("Web client missed %v keepalive pings, closing session.", missed-1)
+				t.noteFailure(failureSideClient)
+				t.terminalCancel()
+				return
+			}
+
+			var err error
+			if t.binaryOutput() {
+				err = websocket.Message.Send(ws, []byte{defaults.PingWebsocketPrefix})
+			} else {
+				err = websocket.JSON.Send(ws, envelopeHeader{Type: defaults.PingEnvelopeType})
+			}
+			if err != nil {
+				t.log().Warnf("Unable to send keepalive ping to web client: %v.", err)
+			}
+
+			// Piggyback the measured round trip latency on the keepalive so
+			// the frontend can render a latency badge without a separate
+			// endpoint.
+			err = t.sendLatency(ws)
+			if err != nil {
+				t.log().Warnf("Unable to send latency to web client: %v.", err)
+			}
+		case <-t.terminalContext.Done():
+			return
+		}
+	}
+}
+
+// streamHeartbeat periodically emits a synthetic "session.heartbeat"
+// audit event while the terminal is connected. Unlike the network
+// keepalive this is visible to audit consumers downstream of the web
+// client. It stops when the terminal context is canceled.
+func (t *TerminalHandler) streamHeartbeat(ctx context.Context, clock clockwork.Clock, ws *websocket.Conn) {
+	for {
+		select {
+		case <-clock.After(t.params.HeartbeatInterval):
+			err := t.sendEvent(ws, events.EventFields{
+				events.EventType:      events.SessionHeartbeatEvent,
+				events.SessionEventID: string(t.sessionID),
+				events.EventTime:      clock.Now().UTC(),
+			})
+			if err != nil {
+				t.log().Warnf("Unable to send heartbeat event to web client: %v.", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resumeEntry holds a resumable session and the moment it stops being
+// resumable.
+type resumeEntry struct {
+	handler *TerminalHandler
+	expires time.Time
+}
+
+// resumableSessions maps resume tokens to their handlers. Entries are
+// refreshed whenever a handler serves or transiently disconnects, retired
+// when the handler is torn down for good, and swept periodically once the
+// grace period passes without a reconnect.
+var resumableSessions = struct {
+	sync.Mutex
+	entries map[string]resumeEntry
+}{entries: make(map[string]resumeEntry)}
+
+// resumableSweeper starts the background sweep of expired resume entries
+// the first time a session registers.
+var resumableSweeper sync.Once
+
+// registerResumable makes the handler's session resumable under its
+// token until the grace period passes.
+func registerResumable(t *TerminalHandler, now time.Time) {
+	if t.resumeToken == "" {
+		return
+	}
+	resumableSweeper.Do(func() {
+		go func() {
+			ticker := time.NewTicker(defaults.ResumeGracePeriod)
+			defer ticker.Stop()
+			for tick := range ticker.C {
+				sweepResumable(tick)
+			}
+		}()
+	})
+	resumableSessions.Lock()
+	defer resumableSessions.Unlock()
+	resumableSessions.entries[t.resumeToken] = resumeEntry{
+		handler: t,
+		expires: now.Add(defaults.ResumeGracePeriod),
+	}
+}
+
+// unregisterResumable retires the handler's resume token so the session
+// can no longer be resumed and the handler can be collected. Only the
+// handler's own registration is removed.
+func unregisterResumable(t *TerminalHandler) {
+	if t.resumeToken == "" {
+		return
+	}
+	resumableSessions.Lock()
+	defer resumableSessions.Unlock()
+	if entry, ok := resumableSessions.entries[t.resumeToken]; ok && entry.handler == t {
+		delete(resumableSessions.entries, t.resumeToken)
+	}
+}
+
+// sweepResumable drops the entries whose grace period passed before now
+// and closes their handlers, releasing the session state and scrollback
+// they retain. Lookup deletes expired entries too, but only for tokens
+// that are presented again; the sweep reclaims the ones that never are.
+func sweepResumable(now time.Time) {
+	var expired []*TerminalHandler
+	resumableSessions.Lock()
+	for token, entry := range resumableSessions.entries {
+		if now.After(entry.expires) {
+			delete(resumableSessions.entries, token)
+			expired = append(expired, entry.handler)
+		}
+	}
+	resumableSessions.Unlock()
+	for _, handler := range expired {
+		handler.fireClose("resume grace period expired", false)
+		handler.Close()
+	}
+}
+
+// resumeSession returns the handler registered under the token so a
+// reconnecting browser re-attaches to it. Expired entries are deleted on
+// access.
+func resumeSession(token string, now time.Time) (*TerminalHandler, error) {
+	resumableSessions.Lock()
+	defer resumableSessions.Unlock()
+	entry, ok := resumableSessions.entries[token]
+	if !ok {
+		return nil, trace.NotFound("unknown resume token")
+	}
+	if now.After(entry.expires) {
+		delete(resumableSessions.entries, token)
+		return nil, trace.BadParameter("resume token expired")
+	}
+	return entry.handler, nil
+}
+
+// WebRecordingDir is the directory session transcripts requested via
+// TerminalRequest.RecordToPath are written to. Transcripts are disabled
+// while it is empty. It is a variable so embedders can tune it.
+var WebRecordingDir = ""
+
+// resolveRecordingPath turns the client supplied transcript name into an
+// absolute path under WebRecordingDir. Absolute names and names escaping
+// the directory are rejected.
+func resolveRecordingPath(name string) (string, error) {
+	if WebRecordingDir == "" {
+		return "", trace.AccessDenied("record_to_path: session transcripts are not enabled")
+	}
+	if filepath.IsAbs(name) || name != filepath.Clean(name) || strings.Contains(name, "..") {
+		return "", trace.BadParameter("record_to_path: invalid transcript name %q", name)
+	}
+	return filepath.Join(WebRecordingDir, name), nil
+}
+
+// sessionRecorder tees terminal output into a timing annotated transcript
+// file on the proxy, one JSON record per line: print records carry the
+// output bytes base64-encoded, resize records carry the new geometry, and
+// every record carries a millisecond offset since the recorder started,
+// so the transcript replays at the original pace.
+type sessionRecorder struct {
+	sync.Mutex
+	file  *os.File
+	out   *bufio.Writer
+	start time.Time
+
+	// written is the number of bytes appended so far, truncated is set
+	// once the size cap was hit and recording stopped.
+	written   int64
+	max       int64
+	truncated bool
+}
+
+// newSessionRecorder creates the transcript file, truncating a leftover
+// one from an earlier session.
+func newSessionRecorder(path string, max int64) (*sessionRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	return &sessionRecorder{
+		file:  f,
+		out:   bufio.NewWriter(f),
+		start: time.Now(),
+		max:   max,
+	}, nil
+}
+
+// append marshals one record, stamps it with the time offset and writes
+// it out, respecting the size cap.
+func (r *sessionRecorder) append(fields events.EventFields) {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil || r.truncated {
+		return
+	}
+	fields[events.SessionEventTimestamp] = int(time.Since(r.start) / time.Millisecond)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		log.Warnf("Unable to marshal transcript record: %v.", err)
+		return
+	}
+	if r.written+int64(len(data))+1 > r.max {
+		r.truncated = true
+		log.Warnf("Session transcript reached its size cap of %v bytes, recording stopped.", r.max)
+		return
+	}
+	r.out.Write(data)
+	r.out.WriteByte('\n')
+	r.written += int64(len(data)) + 1
+}
+
+// Write records one chunk of terminal output, so the recorder can be used
+// as a tee target for the output writer. It never fails: a transcript
+// problem must not take the session down.
+func (r *sessionRecorder) Write(p []byte) (int, error) {
+	r.append(events.EventFields{
+		events.EventType: events.SessionPrintEvent,
+		// The output bytes, base64-encoded to keep the record a single
+		// JSON line.
+		"data": base64.StdEncoding.EncodeToString(p),
+	})
+	return len(p), nil
+}
+
+// resize records a window change so a replay can track the geometry the
+// output was rendered at.
+func (r *sessionRecorder) resize(params session.TerminalParams) {
+	r.append(events.EventFields{
+		events.EventType:    events.ResizeEvent,
+		events.TerminalSize: params.Serialize(),
+	})
+}
+
+// flush forces buffered records out to disk without closing the file.
+func (r *sessionRecorder) flush() {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return
+	}
+	if err := r.out.Flush(); err != nil {
+		log.Warnf("Unable to flush session transcript: %v.", err)
+	}
+}
+
+// Close flushes buffered records and closes the transcript file. Safe to
+// call more than once.
+func (r *sessionRecorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.out.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return trace.ConvertSystemError(err)
+}
+
+// activeSessions maps session IDs to the live handlers attached to them,
+// so admin tooling can find and kill a running session by ID and the
+// parties of a shared session can be notified about each other.
+var activeSessions = struct {
+	sync.Mutex
+	handlers map[session.ID][]*TerminalHandler
+}{handlers: make(map[session.ID][]*TerminalHandler)}
+
+// registerSession adds the handler to the registry under its session ID
+// for the lifetime of the connection.
+func registerSession(t *TerminalHandler) {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+	activeSessions.handlers[t.sessionID] = append(activeSessions.handlers[t.sessionID], t)
+}
+
+// unregisterSession removes the handler from the registry, dropping the
+// session entry once its last handler is gone.
+func unregisterSession(t *TerminalHandler) {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+	handlers := activeSessions.handlers[t.sessionID]
+	for i, handler := range handlers {
+		if handler == t {
+			handlers = append(handlers[:i], handlers[i+1:]...)
+			break
+		}
+	}
+	if len(handlers) == 0 {
+		delete(activeSessions.handlers, t.sessionID)
+		return
+	}
+	activeSessions.handlers[t.sessionID] = handlers
+}
+
+// sessionParticipants returns the other live handlers attached to the
+// handler's session.
+func sessionParticipants(t *TerminalHandler) []*TerminalHandler {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+	var others []*TerminalHandler
+	for _, handler := range activeSessions.handlers[t.sessionID] {
+		if handler != t {
+			others = append(others, handler)
+		}
+	}
+	return others
+}
+
+// notifyParticipants sends a notice frame to every other handler attached
+// to the session so their UIs can surface joins and leaves. Delivery is
+// best effort: a party with a dead socket only costs a log line.
+func (t *TerminalHandler) notifyParticipants(message string) {
+	for _, other := range sessionParticipants(t) {
+		sock := other.wrappedSock
+		if sock == nil {
+			continue
+		}
+		if err := sock.writeNotice(message); err != nil {
+			other.log().Warnf("Unable to deliver session notice: %v.", err)
+		}
+	}
+}
+
+// participantName is the name co-participants see in join and leave
+// notices: the Teleport user when known, the requested login otherwise.
+func (t *TerminalHandler) participantName() string {
+	if t.ctx != nil && t.ctx.user != "" {
+		return t.ctx.user
+	}
+	return t.params.Login
+}
+
+// KillSession forcibly terminates a running web terminal session: the
+// reason is shown in the user's terminal and the connection is torn down.
+// Returns NotFound when no session with the ID is running on this proxy.
+func KillSession(id session.ID, reason string) error {
+	activeSessions.Lock()
+	handlers := append([]*TerminalHandler(nil), activeSessions.handlers[id]...)
+	activeSessions.Unlock()
+	if len(handlers) == 0 {
+		return trace.NotFound("no active session %v", id)
+	}
+
+	for _, t := range handlers {
+		t.fireClose(reason, false)
+		// The reason rides the negotiated error path so binary protocol
+		// and legacy clients alike receive a frame they can parse.
+		if t.wrappedSock != nil {
+			err := t.writeError(trace.AccessDenied(reason), t.wrappedSock.ws)
+			if err != nil {
+				t.log().Warnf("Unable to send kill reason to terminal: %v.", err)
+			}
+		}
+		if t.terminalCancel != nil {
+			t.terminalCancel()
+		}
+	}
+	return nil
+}
+
+// SessionInfo describes one live web terminal, enough for a dashboard to
+// render a "you have N open terminals" list.
+type SessionInfo struct {
+	// SessionID is the ID of the session the terminal is attached to.
+	SessionID session.ID `json:"session_id"`
+	// Server is the node the terminal is connected to.
+	Server string `json:"server"`
+	// Login is the OS login the terminal runs under.
+	Login string `json:"login"`
+	// StartTime is when the websocket connection was established.
+	StartTime time.Time `json:"start_time"`
+}
+
+// ActiveSessions returns metadata about the live web terminals belonging to
+// the user on this proxy, one entry per open connection: a user joined to a
+// shared session counts just like a session they started. Read-only, the
+// sessions themselves are not affected.
+func ActiveSessions(user string) []SessionInfo {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+	var infos []SessionInfo
+	for id, handlers := range activeSessions.handlers {
+		for _, t := range handlers {
+			// Match the Teleport user, not participantName: its OS login
+			// fallback would leak a context-less handler into the listing
+			// of whichever user happens to share the login name.
+			if t.ctx == nil || t.ctx.user == "" || t.ctx.user != user {
+				continue
+			}
+			infos = append(infos, SessionInfo{
+				SessionID: id,
+				Server:    t.params.Server,
+				Login:     t.params.Login,
+				StartTime: t.startTime,
+			})
+		}
+	}
+	return infos
+}
+
+// outputThrottle is a token bucket bounding the rate terminal output is
+// written to the websocket. The bucket holds one second worth of tokens
+// and may go into debt for a single oversized write, so the long-run
+// rate converges on the configured limit without splitting writes.
+type outputThrottle struct {
+	sync.Mutex
+
+	// bytesPerSec is the configured rate and the bucket capacity.
+	bytesPerSec int
+
+	// tokens is the current bucket content, possibly negative.
+	tokens float64
+
+	// last is when tokens were last accrued.
+	last time.Time
+}
+
+func newOutputThrottle(bytesPerSec int) *outputThrottle {
+	return &outputThrottle{
+		bytesPerSec: bytesPerSec,
+		tokens:      float64(bytesPerSec),
+		last:        time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent or the context is canceled.
+func (ot *outputThrottle) wait(ctx context.Context, n int) error {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+
+	for {
+		ot.Lock()
+		now := time.Now()
+		ot.tokens += now.Sub(ot.last).Seconds() * float64(ot.bytesPerSec)
+		if max := float64(ot.bytesPerSec); ot.tokens > max {
+			ot.tokens = max
+		}
+		ot.last = now
+		required := float64(n)
+		if cap := float64(ot.bytesPerSec); required > cap {
+			required = cap
+		}
+		if ot.tokens >= required {
+			// Oversized writes push the bucket into debt, paid back by
+			// later accruals.
+			ot.tokens -= float64(n)
+			ot.Unlock()
+			return nil
+		}
+		missing := required - ot.tokens
+		ot.Unlock()
+
+		delay := time.Duration(missing / float64(ot.bytesPerSec) * float64(time.Second))
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return trace.ConnectionProblem(ctx.Err(), "session closed")
+		}
+	}
+}
+
+// idleWatcher closes the session after the configured period without any
+// user input. Only genuine keyboard input counts as activity: resize and
+// other control frames do not push the deadline out.
+type idleWatcher struct {
+	clock      clockwork.Clock
+	timeout    time.Duration
+	activityCh chan struct{}
+	onIdle     func()
+}
+
+func newIdleWatcher(clock clockwork.Clock, timeout time.Duration, onIdle func()) *idleWatcher {
+	return &idleWatcher{
+		clock:      clock,
+		timeout:    timeout,
+		activityCh: make(chan struct{}, 1),
+		onIdle:     onIdle,
+	}
+}
+
+// activity notes user input, pushing the idle deadline out.
+func (w *idleWatcher) activity() {
+	select {
+	case w.activityCh <- struct{}{}:
+	default:
+	}
+}
+
+// watch blocks until the idle timeout expires without activity and then
+// calls onIdle. It returns early when the context is canceled.
+func (w *idleWatcher) watch(ctx context.Context) {
+	for {
+		select {
+		case <-w.clock.After(w.timeout):
+			w.onIdle()
+			return
+		case <-w.activityCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logSessionSummary emits one structured log line when the session ends,
+// summarizing the byte volume, duration and exit status.
+func (t *TerminalHandler) logSessionSummary() {
+	var bytesReceived, bytesSent int64
+	if t.wrappedSock != nil {
+		bytesReceived = t.wrappedSock.bytesRead()
+		bytesSent = t.wrappedSock.bytesWritten()
+	}
+	exitStatus := -1
+	if t.teleportClient != nil {
+		exitStatus = t.teleportClient.ExitStatus
+	}
+	t.log().WithFields(log.Fields{
+		"bytes_received":      bytesReceived,
+		"bytes_sent":          bytesSent,
+		"duration":            time.Since(t.startTime),
+		"exit_status":         exitStatus,
+		"output_backlog_peak": t.outputBacklog(),
+	}).Info("Session ended.")
+}
+
+// log returns the handler's log entry carrying the request ID. Handlers
+// built without NewTerminal fall back to the plain package logger.
+func (t *TerminalHandler) log() *log.Entry {
+	if t.entry != nil {
+		return t.entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// binaryOutput returns whether server to client frames use the binary
+// protocol.
+func (t *TerminalHandler) binaryOutput() bool {
+	if t.params.BinaryOutput != nil {
+		return *t.params.BinaryOutput
+	}
+	return t.params.BinaryProtocol
+}
+
+// binaryInput returns whether client to server frames use the binary
+// protocol.
+func (t *TerminalHandler) binaryInput() bool {
+	if t.params.BinaryInput != nil {
+		return *t.params.BinaryInput
+	}
+	return t.params.BinaryProtocol
+}
+
+// proxyRecording reports whether the cluster records sessions at the proxy,
+// which puts the recording proxy into the connection path.
+func (t *TerminalHandler) proxyRecording() bool {
+	return t.params.RecordingMode == services.RecordAtProxy
+}
+
+// forwardAgent returns whether the user's SSH agent should be forwarded
+// to the remote node, defaulting to forwarding when the request does not
+// say otherwise. In proxy recording mode forwarding is mandatory: the
+// recording proxy dials the node with the user's agent, without it the
+// connection cannot be established at all.
+func (t *TerminalHandler) forwardAgent() bool {
+	if t.proxyRecording() {
+		return true
+	}
+	if t.params.ForwardAgent != nil {
+		return *t.params.ForwardAgent
+	}
+	return true
+}
+
+// outputBacklog returns the high-water mark of output bytes that were stuck
+// in an unfinished websocket send, a measure of how far behind the web
+// client has fallen. Zero for a session whose sends never blocked.
+func (t *TerminalHandler) outputBacklog() int {
+	if t.wrappedSock == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&t.wrappedSock.backlogPeak))
+}
+
+// currentLatency returns the last measured websocket round trip latency,
+// or -1 when no keepalive reply has come back yet.
+func (t *TerminalHandler) currentLatency() time.Duration {
+	return t.keepAlive.currentLatency()
+}
+
+// sendLatency emits the measured round trip latency to the web client in
+// milliseconds, -1 when nothing has been measured yet.
+func (t *TerminalHandler) sendLatency(ws *websocket.Conn) error {
+	milliseconds := int64(-1)
+	if latency := t.currentLatency(); latency >= 0 {
+		milliseconds = int64(latency / time.Millisecond)
+	}
+
+	if t.binaryOutput() {
+		payload, err := json.Marshal(latencyPayload{Milliseconds: milliseconds})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(websocket.Message.Send(ws, encodeBinaryFrame(defaults.LatencyWebsocketPrefix, payload)))
+	}
+
+	return trace.Wrap(websocket.JSON.Send(ws, latencyEnvelope{
+		Type:    defaults.LatencyEnvelopeType,
+		Payload: latencyPayload{Milliseconds: milliseconds},
+	}))
+}
+
+// streamRecordingStatus periodically sends the status of the session
+// recording upload to the web client so it can warn the user when the
+// recording is lagging behind or has failed.
+func (t *TerminalHandler) streamRecordingStatus(ws *websocket.Conn) {
+	tickerCh := time.NewTicker(defaults.SessionRefreshPeriod)
+	defer tickerCh.Stop()
+
+	for {
+		select {
+		case <-tickerCh.C:
+			err := websocket.JSON.Send(ws, recordingStatusFrame(t.recordingStatus))
+			if err != nil {
+				t.log().Warnf("Unable to send recording status to web client: %v.", err)
+			}
+		case <-t.terminalContext.Done():
+			return
+		}
+	}
+}
+
+// recordingStatusFrame builds the envelope with the current status of the
+// session recording upload.
+func recordingStatusFrame(r RecordingStatusReporter) recordingStatusEnvelope {
+	backlog, failed := r.RecordingBacklog()
+	return recordingStatusEnvelope{
+		Type: defaults.RecordingStatusEnvelopeType,
+		Payload: recordingStatus{
+			Backlog: backlog,
+			Failed:  failed,
+		},
+	}
+}
+
+// lifecycleEvents are the audit event types an overflowing event buffer
+// never drops: the client can miss a print event, not a session boundary.
+var lifecycleEvents = map[string]bool{
+	events.SessionStartEvent: true,
+	events.SessionJoinEvent:  true,
+	events.SessionLeaveEvent: true,
+	events.SessionEndEvent:   true,
+}
+
+// eventRing is a bounded buffer between the audit event source and the
+// websocket sender. When full, the oldest droppable event is discarded
+// and counted; lifecycle events are never dropped, the buffer grows past
+// its cap instead when nothing else can go.
+type eventRing struct {
+	sync.Mutex
+
+	// events are the buffered events, oldest first.
+	events []events.EventFields
+
+	// size is the capacity the buffer is held to.
+	size int
+
+	// dropped counts events discarded since the last pop.
+	dropped int
+
+	// notify wakes the sender when an event was pushed. Buffered so a
+	// push never blocks.
+	notify chan struct{}
+}
+
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		size = defaults.EventBufferSize
+	}
+	return &eventRing{
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push buffers an event without ever blocking, discarding the oldest
+// droppable event when the buffer is full.
+func (r *eventRing) push(event events.EventFields) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.events) >= r.size {
+		for i, buffered := range r.events {
+			if !lifecycleEvents[buffered.GetType()] {
+				r.events = append(r.events[:i], r.events[i+1:]...)
+				r.dropped++
+				break
+			}
+		}
+	}
+	r.events = append(r.events, event)
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest buffered event along with the number of events
+// dropped since the last pop, false when the buffer is empty.
+func (r *eventRing) pop() (events.EventFields, int, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.events) == 0 {
+		return nil, 0, false
+	}
+	event := r.events[0]
+	r.events = r.events[1:]
+	dropped := r.dropped
+	r.dropped = 0
+	return event, dropped, true
+}
+
+// eventCoalescer collapses runs of consecutive same-type audit events into
+// a single summary event: the last payload annotated with the number of
+// events it stands for. Only the configured event types are collapsed,
+// everything else passes through untouched.
+type eventCoalescer struct {
+	// types is the set of event types to collapse.
+	types map[string]bool
+
+	// pending is the last event of the run being collapsed.
+	pending events.EventFields
+
+	// count is the length of the run being collapsed.
+	count int
+}
+
+func newEventCoalescer(coalesceTypes []string) *eventCoalescer {
+	types := make(map[string]bool)
+	for _, eventType := range coalesceTypes {
+		types[eventType] = true
+	}
+	return &eventCoalescer{types: types}
+}
+
+// add feeds the next event and returns the events that became ready to
+// send: a pending run is flushed whenever an event of a different type
+// arrives.
+func (ec *eventCoalescer) add(event events.EventFields) []events.EventFields {
+	if !ec.types[event.GetType()] {
+		return append(ec.flush(), event)
+	}
+
+	if ec.pending != nil && ec.pending.GetType() == event.GetType() {
+		ec.pending = event
+		ec.count++
+		return nil
+	}
+
+	out := ec.flush()
+	ec.pending = event
+	ec.count = 1
+	return out
+}
+
+// flush returns the summary event for a pending run, if any.
+func (ec *eventCoalescer) flush() []events.EventFields {
+	if ec.pending == nil {
+		return nil
+	}
+
+	summary := ec.pending
+	if ec.count > 1 {
+		summary = make(events.EventFields, len(ec.pending)+1)
+		for key, value := range ec.pending {
+			summary[key] = value
+		}
+		summary[events.EventCoalescedCount] = ec.count
+	}
+
+	ec.pending = nil
+	ec.count = 0
+	return []events.EventFields{summary}
+}
+
+// eventFilter decides which audit event types are forwarded to the web
+// client. An empty filter forwards everything.
+type eventFilter map[string]bool
+
+func newEventFilter(eventTypes []string) eventFilter {
+	filter := make(eventFilter)
+	for _, eventType := range eventTypes {
+		filter[eventType] = true
+	}
+	return filter
+}
+
+// allows reports whether an event of the given type should be sent.
+func (f eventFilter) allows(eventType string) bool {
+	return len(f) == 0 || f[eventType]
+}
+
+// pollEvents polls the backend for events that don't get pushed over the
+// SSH events channel. Eventually this function will be removed completely.
+func (t *TerminalHandler) pollEvents(cursor int) ([]events.EventFields, int, error) {
+	// Poll for events since the last call (cursor location).
+	sessionEvents, err := t.authProvider.GetSessionEvents(t.namespace, t.sessionID, cursor+1, false)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return nil, 0, trace.Wrap(err)
+		}
+		return nil, 0, trace.NotFound("no events from cursor: %v", cursor)
+	}
+
+	// Get the batch size to see if any events were returned.
+	batchLen := len(sessionEvents)
+	if batchLen == 0 {
+		return nil, 0, trace.NotFound("no events from cursor: %v", cursor)
+	}
+
+	// Bound the batch if requested. The cursor below only advances past
+	// what is actually delivered, the rest follows on the next poll.
+	if t.params.EventBatchSize > 0 && batchLen > t.params.EventBatchSize {
+		batchLen = t.params.EventBatchSize
+		sessionEvents = sessionEvents[:batchLen]
+	}
+
+	// Advance the cursor.
+	newCursor := sessionEvents[batchLen-1].GetInt(events.EventCursor)
+
+	// Filter out any resize events as we get them over push notifications.
+	var filteredEvents []events.EventFields
+	for _, event := range sessionEvents {
+		if event.GetType() == events.ResizeEvent ||
+			event.GetType() == events.SessionJoinEvent ||
+			event.GetType() == events.SessionLeaveEvent ||
+			event.GetType() == events.SessionPrintEvent {
+			continue
+		}
+		filteredEvents = append(filteredEvents, event)
+	}
+
+	return filteredEvents, newCursor, nil
+}
+
+// resizeDebouncer collapses storms of window-change requests: the most
+// recent requested size is stored and at most one window-change is sent per
+// period by a single long-lived goroutine. The final size always wins, even
+// when it arrives in the middle of a debounce window.
+type resizeDebouncer struct {
+	// period is how often at most a window-change is sent.
+	period time.Duration
+
+	// send forwards the size to the node.
+	send func(*session.TerminalParams)
+
+	// updateCh holds the most recent size waiting to be sent.
+	updateCh chan session.TerminalParams
+}
+
+func newResizeDebouncer(period time.Duration, send func(*session.TerminalParams)) *resizeDebouncer {
+	return &resizeDebouncer{
+		period:   period,
+		send:     send,
+		updateCh: make(chan session.TerminalParams, 1),
+	}
+}
+
+// push stores the requested size, replacing any size still waiting to be
+// sent. It never blocks so reads from the websocket are not held up.
+func (d *resizeDebouncer) push(params session.TerminalParams) {
+	for {
+		select {
+		case d.updateCh <- params:
+			return
+		default:
+		}
+		// Drop the stale pending size and try again.
+		select {
+		case <-d.updateCh:
+		default:
+		}
+	}
+}
+
+// run sends at most one window-change per period until the context is
+// canceled.
+func (d *resizeDebouncer) run(ctx context.Context) {
+	tickerCh := time.NewTicker(d.period)
+	defer tickerCh.Stop()
+
+	for {
+		select {
+		case <-tickerCh.C:
+			select {
+			case params := <-d.updateCh:
+				d.send(&params)
+			default:
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// queueWindowChange routes a resize request through the debouncer when one
+// is running, falling back to a direct send otherwise.
+func (t *TerminalHandler) queueWindowChange(params *session.TerminalParams) {
+	t.clampTerminalParams(params)
+	if t.resizeDebouncer != nil {
+		t.resizeDebouncer.push(*params)
+		return
+	}
+
+	// Send the window change request in a goroutine so reads are not
+	// blocked by network connectivity issues.
+	go t.windowChange(params)
+}
+
+// clampTerminalParams bounds requested PTY dimensions to the configured
+// maxima so absurd resize requests are never forwarded to the node.
+func (t *TerminalHandler) clampTerminalParams(params *session.TerminalParams) {
+	maxWidth := t.params.MaxTermWidth
+	if maxWidth == 0 {
+		maxWidth = defaults.MaxTerminalWidth
+	}
+	maxHeight := t.params.MaxTermHeight
+	if maxHeight == 0 {
+		maxHeight = defaults.MaxTerminalHeight
+	}
+	if params.W > maxWidth {
+		t.log().Warnf("Clamping oversized terminal width %v to %v.", params.W, maxWidth)
+		params.W = maxWidth
+	}
+	if params.H > maxHeight {
+		t.log().Warnf("Clamping oversized terminal height %v to %v.", params.H, maxHeight)
+		params.H = maxHeight
+	}
+}
+
+// windowChange is called when the browser window is resized. It sends a
+// "window-change" channel request to the server.
+func (t *TerminalHandler) windowChange(params *session.TerminalParams) error {
+	if t.sshSession == nil {
+		return nil
+	}
+
+	_, err := t.sshSession.SendRequest(
+		sshutils.WindowChangeRequest,
+		false,
+		ssh.Marshal(sshutils.WinChangeReqParams{
+			W: uint32(params.W),
+			H: uint32(params.H),
+		}))
+	if err != nil {
+		t.log().Error(err)
+	}
+
+	// Tell the browser whether the size was applied so it can reconcile
+	// its local state when the node rejects a resize.
+	if er := t.sendResizeAck(params, err); er != nil {
+		t.log().Warnf("Unable to send resize ack to web client: %v.", er)
+	}
+
+	// A transcript needs the geometry changes to replay the output the
+	// way it was rendered.
+	if err == nil && t.recorder != nil {
+		t.recorder.resize(*params)
+	}
+
+	return trace.Wrap(err)
+}
+
+// emitResizeEvent mirrors a processed browser resize into the audit event
+// stream. The node only pushes resize events to the other parties, so
+// without this the originator's recording and event log would miss the
+// geometry changes the user actually made.
+func (t *TerminalHandler) emitResizeEvent(ws *websocket.Conn, params *session.TerminalParams) {
+	err := t.sendEvent(ws, events.EventFields{
+		events.EventType:      events.ResizeEvent,
+		events.EventNamespace: t.namespace,
+		events.SessionEventID: string(t.sessionID),
+		events.EventLogin:     t.params.Login,
+		events.EventUser:      t.participantName(),
+		events.TerminalSize:   params.Serialize(),
+	})
+	if err != nil {
+		t.log().Warnf("Unable to send resize event to web client: %v.", err)
+	}
+}
+
+// sshSignals are the signal names deliverable over an SSH session
+// (RFC 4254 section 6.9).
+var sshSignals = map[ssh.Signal]bool{
+	ssh.SIGABRT: true,
+	ssh.SIGALRM: true,
+	ssh.SIGFPE:  true,
+	ssh.SIGHUP:  true,
+	ssh.SIGILL:  true,
+	ssh.SIGINT:  true,
+	ssh.SIGKILL: true,
+	ssh.SIGPIPE: true,
+	ssh.SIGQUIT: true,
+	ssh.SIGSEGV: true,
+	ssh.SIGTERM: true,
+	ssh.SIGUSR1: true,
+	ssh.SIGUSR2: true,
+}
+
+// parseSignal normalizes a client supplied signal name ("SIGINT", "int",
+// "INT") to the SSH signal name, rejecting signals SSH can not deliver.
+func parseSignal(name string) (ssh.Signal, error) {
+	sig := ssh.Signal(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG"))
+	if !sshSignals[sig] {
+		return "", trace.BadParameter("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// signal delivers a signal to the remote process, for the cases where the
+// PTY is in a state Ctrl-C does not get through. Analogous to the
+// window-change request path.
+func (t *TerminalHandler) signal(name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if t.sshSession == nil {
+		return nil
+	}
+
+	return trace.Wrap(t.sshSession.Signal(sig))
+}
+
+// sendResizeAck confirms (or rejects) a window change back to the web
+// client, carrying the dimensions that were sent to the node.
+func (t *TerminalHandler) sendResizeAck(params *session.TerminalParams, sendErr error) error {
+	if t.wrappedSock == nil {
+		return nil
+	}
+
+	payload := resizeAckPayload{
+		W:  params.W,
+		H:  params.H,
+		OK: sendErr == nil,
+	}
+	if sendErr != nil {
+		payload.Error = sendErr.Error()
+	}
+
+	if t.binaryOutput() {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(t.wrappedSock.conn.Send(encodeBinaryFrame(defaults.ResizeAckWebsocketPrefix, data)))
+	}
+
+	return trace.Wrap(t.wrappedSock.conn.Send(resizeAckEnvelope{
+		Type:    defaults.ResizeAckEnvelopeType,
+		Payload: payload,
+	}))
+}
+
+// writeError surfaces an error to the web client. Clients that declared
+// the protocol version get a structured error frame they can style apart
+// from program output (color it red, show a dialog); older clients get
+// the raw fallback that prints into the terminal.
+func (t *TerminalHandler) writeError(err error, ws *websocket.Conn) error {
+	if t.params.ProtocolVersion < defaults.TerminalProtocolVersion {
+		return trace.Wrap(errToTerm(err, ws))
+	}
+
+	payload := errorPayload{
+		Code:    errorCode(err),
+		Message: err.Error(),
+		Side:    t.failedSide(),
+	}
+	if t.binaryOutput() {
+		data, er := json.Marshal(payload)
+		if er != nil {
+			return trace.Wrap(er)
+		}
+		return trace.Wrap(websocket.Message.Send(ws, encodeBinaryFrame(defaults.ErrorWebsocketPrefix, data)))
+	}
+
+	return trace.Wrap(websocket.JSON.Send(ws, errorEnvelope{
+		Type:    defaults.ErrorEnvelopeType,
+		Payload: payload,
+	}))
+}
+
+// errorCode maps an error to a short machine readable code the frontend
+// can key styling and behavior off.
+func errorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case trace.IsAccessDenied(err):
+		return "access_denied"
+	case trace.IsNotFound(err):
+		return "not_found"
+	case trace.IsLimitExceeded(err):
+		return "limit_exceeded"
+	case trace.IsConnectionProblem(err):
+		return "connection_problem"
+	case trace.IsBadParameter(err):
+		return "bad_parameter"
+	default:
+		return "internal"
+	}
+}
+
+// errToTerm displays an error in the terminal window.
+func errToTerm(err error, w io.Writer) error {
+	// Replace \n with \r\n so the message correctly aligned.
+	r := strings.NewReplacer("\r\n", "\r\n", "\n", "\r\n")
+	errMessage := []byte(r.Replace(err.Error()))
+
+	// Create an envelope that contains the error message.
+	re := rawEnvelope{
+		Type:    defaults.RawEnvelopeType,
+		Payload: errMessage,
+	}
+	b, err := json.Marshal(re)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// Write the error to the websocket.
+	_, err = w.Write(b)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return nil
+}
+
+// labelSelectorPrefix marks a server name as a label expression, for
+// example "labels:env=prod,role=db".
+const labelSelectorPrefix = "labels:"
+
+// resolveServerWithRetry resolves the requested server against the node
+// list from the backend. When that fails it re-queries GetNodes with a
+// doubling backoff until the requested timeout expires, so a node that
+// only just joined (or a momentarily stale cache read) still resolves.
+// The happy path returns after a single query without sleeping.
+func resolveServerWithRetry(req TerminalRequest, authProvider AuthProvider) (services.Server, []services.Server, string, int, error) {
+	deadline := time.Now().Add(req.NodeResolutionTimeout)
+	backoff := defaults.NodeResolutionBackoff
+	for {
+		// A node ID or label lookup against a capable backend avoids
+		// pulling the whole node list. Any miss falls through to the list
+		// scan so the other resolution forms keep working.
+		if node, ok := resolveNodeDirect(req, authProvider); ok {
+			return node, []services.Server{node}, node.GetHostname(), 0, nil
+		}
+		if node, ok := resolveNodeByLabelsDirect(req, authProvider); ok {
+			return node, []services.Server{node}, node.GetHostname(), 0, nil
+		}
+
+		servers, err := authProvider.GetNodes(req.Namespace)
+		if err == nil {
+			node, hostName, hostPort, resolveErr := resolveServer(req.Server, servers)
+			if resolveErr == nil {
+				return node, servers, hostName, hostPort, nil
+			}
+			err = trace.BadParameter("invalid server name %q: %v", req.Server, resolveErr)
+		} else {
+			err = trace.Wrap(err)
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, nil, "", 0, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// resolveNodeDirect fetches the requested node by ID when the provider
+// supports single node lookups and the server name is a UUID. False means
+// the caller has to resolve against the full node list.
+func resolveNodeDirect(req TerminalRequest, authProvider AuthProvider) (services.Server, bool) {
+	single, ok := authProvider.(SingleNodeProvider)
+	if !ok || uuid.Parse(req.Server) == nil {
+		return nil, false
+	}
+	node, err := single.GetNode(req.Namespace, req.Server)
+	if err != nil || node == nil {
+		return nil, false
+	}
+	return node, true
+}
+
+// resolveNodeByLabelsDirect matches a "labels:" target server-side when
+// the provider supports it. False means the caller has to resolve against
+// the full node list; a selector that does not parse also falls through so
+// the scan path reports the error the same way it always has.
+func resolveNodeByLabelsDirect(req TerminalRequest, authProvider AuthProvider) (services.Server, bool) {
+	byLabels, ok := authProvider.(LabelNodeProvider)
+	if !ok || !strings.HasPrefix(req.Server, labelSelectorPrefix) {
+		return nil, false
+	}
+	labels, err := parseLabelExpression(strings.TrimPrefix(req.Server, labelSelectorPrefix))
+	if err != nil {
+		return nil, false
+	}
+	node, err := byLabels.GetNodeByLabels(req.Namespace, labels)
+	if err != nil || node == nil {
+		return nil, false
+	}
+	return node, true
+}
+
+// resolveServerHostPort parses server name and attempts to resolve hostname
+// and port, for callers that do not need the matched node.
+func resolveServerHostPort(servername string, existingServers []services.Server) (string, int, error) {
+	_, hostName, hostPort, err := resolveServer(servername, existingServers)
+	return hostName, hostPort, trace.Wrap(err)
+}
+
+// resolveServer parses the server name and resolves the hostname and port
+// to dial. When the name matched a registered node the node is returned
+// alongside, so the handler can surface its metadata (platform labels and
+// the like) without a second lookup. A plain address that matched nothing
+// resolves with a nil node.
+func resolveServer(servername string, existingServers []services.Server) (services.Server, string, int, error) {
+	// If port is 0, client wants us to figure out which port to use.
+	var defaultPort = 0
+
+	if servername == "" {
+		return nil, "", defaultPort, trace.BadParameter("empty server name")
+	}
+
+	// A label expression selects a node by its labels instead of its name.
+	if strings.HasPrefix(servername, labelSelectorPrefix) {
+		node, err := resolveServerByLabels(strings.TrimPrefix(servername, labelSelectorPrefix), existingServers)
+		if err != nil {
+			return nil, "", defaultPort, trace.Wrap(err)
 		}
+		return node, node.GetHostname(), defaultPort, nil
+	}
 
-		log.Debugf("Closing websocket stream to web client.")
-		return
+	// Check if servername is UUID.
+	for i := range existingServers {
+		node := existingServers[i]
+		if node.GetName() == servername {
+			return node, node.GetHostname(), defaultPort, nil
+		}
 	}
-}
 
-// makeClient builds a *client.TeleportClient for the connection.
-func (t *TerminalHandler) makeClient(ws *websocket.Conn) (*client.TeleportClient, error) {
-	agent, cert, err := t.ctx.GetAgent()
-	if err != nil {
-		return nil, trace.BadParameter("failed to get user credentials: %v", err)
+	if !strings.Contains(servername, ":") {
+		// When several registered nodes share the hostname the target is
+		// ambiguous: refuse and name the candidate node IDs so the UI can
+		// prompt for a choice instead of connecting to the wrong box.
+		var hostnameMatches []services.Server
+		for i := range existingServers {
+			if existingServers[i].GetHostname() == servername {
+				hostnameMatches = append(hostnameMatches, existingServers[i])
+			}
+		}
+		if len(hostnameMatches) > 1 {
+			var names []string
+			for _, node := range hostnameMatches {
+				names = append(names, node.GetName())
+			}
+			return nil, "", defaultPort, trace.BadParameter(
+				"ambiguous hostname %q: %v nodes match, connect by node ID instead (%v)",
+				servername, len(hostnameMatches), strings.Join(names, ", "))
+		}
+		if len(hostnameMatches) == 1 {
+			return hostnameMatches[0], servername, defaultPort, nil
+		}
+		return nil, servername, defaultPort, nil
+	}
+
+	// An unbracketed IPv6 literal has colons but carries no port.
+	if strings.Count(servername, ":") > 1 && !strings.HasPrefix(servername, "[") {
+		return nil, servername, defaultPort, nil
+	}
+
+	// A bracketed IPv6 literal without a port, e.g. "[2001:db8::1]". The
+	// brackets are stripped so the SSH client dials correctly.
+	if strings.HasPrefix(servername, "[") && strings.HasSuffix(servername, "]") {
+		return nil, strings.TrimSuffix(strings.TrimPrefix(servername, "["), "]"), defaultPort, nil
 	}
 
-	signers, err := agent.Signers()
+	// Check for explicitly specified port.
+	host, portString, err := utils.SplitHostPort(servername)
 	if err != nil {
-		return nil, trace.BadParameter("failed to get user credentials: %v", err)
+		return nil, "", defaultPort, trace.Wrap(err)
 	}
 
-	tlsConfig, err := t.ctx.ClientTLSConfig()
+	port, err := strconv.Atoi(portString)
 	if err != nil {
-		return nil, trace.BadParameter("failed to get client TLS config: %v", err)
+		return nil, "", defaultPort, trace.BadParameter("invalid port: %v", err)
 	}
 
-	// Create a wrapped websocket to wrap/unwrap the envelope used to
-	// communicate over the websocket.
-	wrappedSock := newWrappedSocket(ws, t)
+	return nil, host, port, nil
+}
 
-	clientConfig := &client.Config{
-		SkipLocalAuth:    true,
-		ForwardAgent:     true,
-		Agent:            agent,
-		TLS:              tlsConfig,
-		AuthMethods:      []ssh.AuthMethod{ssh.PublicKeys(signers...)},
-		DefaultPrincipal: cert.ValidPrincipals[0],
-		HostLogin:        t.params.Login,
-		Username:         t.ctx.user,
-		Namespace:        t.params.Namespace,
-		Stdout:           wrappedSock,
-		Stderr:           wrappedSock,
-		Stdin:            wrappedSock,
-		SiteName:         t.params.Cluster,
-		ProxyHostPort:    t.params.ProxyHostPort,
-		Host:             t.hostName,
-		HostPort:         t.hostPort,
-		Env:              map[string]string{sshutils.SessionEnvVar: string(t.params.SessionID)},
-		HostKeyCallback:  func(string, net.Addr, ssh.PublicKey) error { return nil },
-		ClientAddr:       t.request.RemoteAddr,
+// lineBufferedWriter coalesces terminal output for clients that can not
+// handle high frequency frames. Output is held back until a newline is seen
+// or the flush interval expires, whichever comes first.
+type lineBufferedWriter struct {
+	sync.Mutex
+
+	// writer is where buffered output is flushed to.
+	writer io.Writer
+
+	// buffer holds output that has not been flushed yet.
+	buffer []byte
+
+	// timer flushes the buffer when the flush interval expires.
+	timer *time.Timer
+
+	// flushInterval is how long output is held back at most.
+	flushInterval time.Duration
+}
+
+func newLineBufferedWriter(w io.Writer, flushInterval time.Duration) *lineBufferedWriter {
+	return &lineBufferedWriter{
+		writer:        w,
+		flushInterval: flushInterval,
 	}
-	if len(t.params.InteractiveCommand) > 0 {
-		clientConfig.Interactive = true
+}
+
+// Write buffers data and flushes it when a newline is seen. Otherwise a
+// timer is armed to flush the buffer when the flush interval expires.
+func (l *lineBufferedWriter) Write(data []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.buffer = append(l.buffer, data...)
+
+	if bytes.Contains(data, []byte("\n")) {
+		return len(data), l.flushLocked()
 	}
 
-	tc, err := client.NewClient(clientConfig)
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.flushInterval, l.flush)
+	}
+
+	return len(data), nil
+}
+
+// flush is called by the timer when the flush interval expires.
+func (l *lineBufferedWriter) flush() {
+	l.Lock()
+	defer l.Unlock()
+
+	err := l.flushLocked()
 	if err != nil {
-		return nil, trace.BadParameter("failed to create client: %v", err)
+		log.Warnf("Unable to flush terminal output to web client: %v.", err)
 	}
+}
 
-	// Save the *ssh.Session after the shell has been created. The session is
-	// used to update all other parties window size to that of the web client and
-	// to allow future window changes.
-	tc.OnShellCreated = func(s *ssh.Session, c *ssh.Client, _ io.ReadWriteCloser) (bool, error) {
-		t.sshSession = s
-		t.windowChange(&t.params.Term)
-		return false, nil
+// flushLocked writes out any buffered output and disarms the flush timer.
+// The caller has to hold the lock.
+func (l *lineBufferedWriter) flushLocked() error {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
 	}
 
-	return tc, nil
+	if len(l.buffer) == 0 {
+		return nil
+	}
+
+	_, err := l.writer.Write(l.buffer)
+	l.buffer = nil
+	return trace.Wrap(err)
 }
 
-// streamTerminal opens a SSH connection to the remote host and streams
-// events back to the web client.
-func (t *TerminalHandler) streamTerminal(ws *websocket.Conn, tc *client.TeleportClient) {
-	defer t.terminalCancel()
+// scrollbackBuffer is a bounded buffer of the most recent terminal output.
+// It is shared between the terminal connections of a session so a new
+// connection can have the recent output replayed.
+type scrollbackBuffer struct {
+	sync.Mutex
 
-	// Establish SSH connection to the server. This function will block until
-	// either an error occurs or it completes successfully.
-	err := tc.SSH(t.terminalContext, t.params.InteractiveCommand, false)
+	// buf holds the most recent output, at most max bytes.
+	buf []byte
+
+	// max is the capacity of the buffer.
+	max int
+
+	// seq counts the total bytes ever written, so a reconnecting client
+	// can name the absolute position it already holds.
+	seq int64
+}
+
+func newScrollbackBuffer(max int) *scrollbackBuffer {
+	return &scrollbackBuffer{max: max}
+}
+
+// Write appends data, discarding the oldest bytes once the capacity is
+// exceeded. It never fails so terminal output can be teed through it.
+func (s *scrollbackBuffer) Write(data []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.seq += int64(len(data))
+
+	if len(data) >= s.max {
+		s.buf = append(s.buf[:0], data[len(data)-s.max:]...)
+		return len(data), nil
+	}
+
+	s.buf = append(s.buf, data...)
+	if overflow := len(s.buf) - s.max; overflow > 0 {
+		// Copy down instead of re-slicing so the backing array stays
+		// bounded by the capacity.
+		s.buf = s.buf[:copy(s.buf, s.buf[overflow:])]
+	}
+
+	return len(data), nil
+}
+
+// Bytes returns a copy of the buffered output.
+func (s *scrollbackBuffer) Bytes() []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	out := make([]byte, len(s.buf))
+	copy(out, s.buf)
+	return out
+}
+
+// BytesFrom returns a copy of the buffered output newer than the given
+// absolute byte offset. When the offset is older than the earliest retained
+// byte (or names a position that was never written), the whole buffer is
+// returned and full is true so the caller can flag the fallback.
+func (s *scrollbackBuffer) BytesFrom(seq int64) (out []byte, full bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	earliest := s.seq - int64(len(s.buf))
+	if seq < earliest || seq > s.seq {
+		out = make([]byte, len(s.buf))
+		copy(out, s.buf)
+		return out, true
+	}
+
+	out = make([]byte, s.seq-seq)
+	copy(out, s.buf[int64(len(s.buf))-int64(len(out)):])
+	return out, false
+}
+
+// resolveServerByLabels finds the single node carrying all the labels in
+// the expression. Zero or multiple matches are an error so the user is
+// never connected to an unexpected node.
+func resolveServerByLabels(expression string, existingServers []services.Server) (services.Server, error) {
+	labels, err := parseLabelExpression(expression)
 	if err != nil {
-		log.Warnf("Unable to stream terminal: %v.", err)
-		er := errToTerm(err, ws)
-		if er != nil {
-			log.Warnf("Unable to send error to terminal: %v: %v.", err, er)
+		return nil, trace.Wrap(err)
+	}
+
+	var matches []services.Server
+	for i := range existingServers {
+		if existingServers[i].MatchAgainst(labels) {
+			matches = append(matches, existingServers[i])
+		}
+	}
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return nil, trace.BadParameter("no nodes match labels %q", expression)
+	default:
+		hostnames := make([]string, 0, len(matches))
+		for _, node := range matches {
+			hostnames = append(hostnames, node.GetHostname())
 		}
+		return nil, trace.BadParameter("ambiguous labels %q: %v nodes match (%v)",
+			expression, len(matches), strings.Join(hostnames, ", "))
 	}
 }
 
-// streamEvents receives events over the SSH connection (as well as periodic
-// polling) to update the client with relevant audit events.
-func (t *TerminalHandler) streamEvents(ws *websocket.Conn, tc *client.TeleportClient) {
-	// A cursor are used to keep track of where we are in the event stream. This
-	// is to find "session.end" events.
-	var cursor int = -1
+// parseLabelExpression parses a comma separated list of key=value pairs.
+func parseLabelExpression(expression string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(expression, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, trace.BadParameter("invalid label expression %q", expression)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
 
-	tickerCh := time.NewTicker(defaults.SessionRefreshPeriod)
-	defer tickerCh.Stop()
+// validateServerLogin checks the requested login against the principals the
+// node advertises. If the node does not advertise any principals (or the
+// server can not be found in the list of nodes), validation is deferred to
+// the node itself.
+func validateServerLogin(login string, servername string, existingServers []services.Server) error {
+	for i := range existingServers {
+		node := existingServers[i]
+		if node.GetName() != servername && node.GetHostname() != servername {
+			continue
+		}
 
-	for {
-		select {
-		// Send push events that come over the events channel to the web client.
-		case event := <-tc.EventsChannel():
-			e := eventEnvelope{
-				Type:    defaults.AuditEnvelopeType,
-				Payload: event,
-			}
-			log.Debugf("Sending audit event %v to web client.", event.GetType())
+		allowedLogins := serverLogins(node)
+		if len(allowedLogins) == 0 {
+			return nil
+		}
 
-			err := websocket.JSON.Send(ws, e)
-			if err != nil {
-				log.Errorf("Unable to %v event to web client: %v.", event.GetType(), err)
-				continue
-			}
-		// Poll for events to send to the web client. This is for events that can
-		// not be sent over the events channel (like "session.end" which lingers for
-		// a while after all party members have left).
-		case <-tickerCh.C:
-			// Fetch all session events from the backend.
-			sessionEvents, cur, err := t.pollEvents(cursor)
-			if err != nil {
-				if !trace.IsNotFound(err) {
-					log.Errorf("Unable to poll for events: %v.", err)
-					continue
-				}
-				continue
+		for _, allowedLogin := range allowedLogins {
+			if login == allowedLogin {
+				return nil
 			}
+		}
 
-			// Update the cursor location.
-			cursor = cur
+		return trace.AccessDenied("login: %q is not a valid principal for node %q, valid logins: %v",
+			login, servername, strings.Join(allowedLogins, ", "))
+	}
 
-			// Send all events to the web client.
-			for _, sessionEvent := range sessionEvents {
-				ee := eventEnvelope{
-					Type:    defaults.AuditEnvelopeType,
-					Payload: sessionEvent,
-				}
-				err = websocket.JSON.Send(ws, ee)
-				if err != nil {
-					log.Warnf("Unable to send %v events to web client: %v.", len(sessionEvents), err)
-					continue
-				}
+	return nil
+}
 
-				// The session end event was sent over the websocket, we can now close the
-				// websocket.
-				if sessionEvent.GetType() == events.SessionEndEvent {
-					t.eventCancel()
-					return
-				}
-			}
-		case <-t.eventContext.Done():
-			return
+// validateCertLogin checks the requested login against the principals of
+// the user's session certificate, which encode the logins RBAC granted.
+// Failing here saves the dial to the node and produces a clearer message
+// than the SSH-level authentication error. An empty principal list means
+// no login information is available, the check is skipped.
+func validateCertLogin(login string, principals []string) error {
+	if len(principals) == 0 {
+		return nil
+	}
+	for _, principal := range principals {
+		if principal == login || principal == services.Wildcard {
+			return nil
 		}
 	}
+	return trace.AccessDenied("login: %q is not among the logins granted to the user, valid logins: %v",
+		login, strings.Join(principals, ", "))
 }
 
-// pollEvents polls the backend for events that don't get pushed over the
-// SSH events channel. Eventually this function will be removed completely.
-func (t *TerminalHandler) pollEvents(cursor int) ([]events.EventFields, int, error) {
-	// Poll for events since the last call (cursor location).
-	sessionEvents, err := t.authProvider.GetSessionEvents(t.namespace, t.sessionID, cursor+1, false)
-	if err != nil {
-		if !trace.IsNotFound(err) {
-			return nil, 0, trace.Wrap(err)
+// serverLogins returns the list of principals a node advertises via its
+// "logins" label. Not all nodes advertise their principals, in that case an
+// empty list is returned.
+func serverLogins(node services.Server) []string {
+	labelValue, ok := node.GetAllLabels()[teleport.TraitLogins]
+	if !ok {
+		return nil
+	}
+
+	var logins []string
+	for _, login := range strings.Split(labelValue, ",") {
+		login = strings.TrimSpace(login)
+		if login != "" {
+			logins = append(logins, login)
 		}
-		return nil, 0, trace.NotFound("no events from cursor: %v", cursor)
 	}
+	return logins
+}
 
-	// Get the batch size to see if any events were returned.
-	batchLen := len(sessionEvents)
-	if batchLen == 0 {
-		return nil, 0, trace.NotFound("no events from cursor: %v", cursor)
+// messageConn is the part of the websocket transport the framing layer
+// depends on: message exchange, read deadlines and teardown. The
+// production implementation is websocketConn; tests and fuzzers can
+// substitute an in-memory one to drive the framing logic without a real
+// websocket.
+type messageConn interface {
+	// Send writes one message to the client: a single binary frame for a
+	// []byte value, a JSON text frame for everything else.
+	Send(v interface{}) error
+
+	// Receive reads the next message into v, with the same encoding rules
+	// as Send (v is *[]byte for binary frames).
+	Receive(v interface{}) error
+
+	// SetReadDeadline bounds how long Receive may block.
+	SetReadDeadline(t time.Time) error
+
+	// Close tears the transport down.
+	Close() error
+}
+
+// websocketConn adapts *websocket.Conn to messageConn, dispatching between
+// the binary and the JSON codec on the message type.
+type websocketConn struct {
+	ws *websocket.Conn
+}
+
+func (c websocketConn) Send(v interface{}) error {
+	if data, ok := v.([]byte); ok {
+		return websocket.Message.Send(c.ws, data)
 	}
+	return websocket.JSON.Send(c.ws, v)
+}
 
-	// Advance the cursor.
-	newCursor := sessionEvents[batchLen-1].GetInt(events.EventCursor)
+func (c websocketConn) Receive(v interface{}) error {
+	if data, ok := v.(*[]byte); ok {
+		return websocket.Message.Receive(c.ws, data)
+	}
+	return websocket.JSON.Receive(c.ws, v)
+}
 
-	// Filter out any resize events as we get them over push notifications.
-	var filteredEvents []events.EventFields
-	for _, event := range sessionEvents {
-		if event.GetType() == events.ResizeEvent ||
-			event.GetType() == events.SessionJoinEvent ||
-			event.GetType() == events.SessionLeaveEvent ||
-			event.GetType() == events.SessionPrintEvent {
-			continue
+func (c websocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c websocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// wrappedSocket wraps and unwraps the envelope that is used to send events
+// over the websocket.
+type wrappedSocket struct {
+	ws       *websocket.Conn
+	conn     messageConn
+	terminal *TerminalHandler
+
+	// encoder converts browser input from UTF-8 to the session charset
+	// before it reaches the node.
+	encoder *encoding.Encoder
+
+	// decoder converts terminal output from the session charset to the
+	// UTF-8 the browser renders.
+	decoder *encoding.Decoder
+
+	// binaryWrite indicates server to client terminal bytes travel in
+	// prefixed binary frames instead of UTF-8 text envelopes.
+	binaryWrite bool
+
+	// binaryRead indicates client to server frames are prefixed binary
+	// frames instead of UTF-8 text envelopes.
+	binaryRead bool
+
+	// readBuf holds the remainder of a frame that did not fit into the
+	// buffer passed to Read. It is drained before the next frame is
+	// received so no terminal output is lost.
+	readBuf []byte
+
+	// pasteChunk is the active chunk size while an oversized input frame
+	// (a clipboard paste) is being drained, zero otherwise. See copyInput.
+	pasteChunk int
+
+	// written counts the terminal bytes sent to the web client. Accessed
+	// atomically.
+	written int64
+
+	// pending counts output bytes handed to a send that has not returned
+	// yet: a client that stops draining the connection blocks the send and
+	// the stuck bytes pile up here. Accessed atomically.
+	pending int64
+
+	// backlogPeak is the high-water mark pending has reached over the life
+	// of the connection. Accessed atomically.
+	backlogPeak int64
+
+	// backlogWarnMu guards lastBacklogWarn, rate limiting the slow client
+	// warning.
+	backlogWarnMu sync.Mutex
+
+	// lastBacklogWarn is when the slow client warning last fired.
+	lastBacklogWarn time.Time
+
+	// bomSkip is how many bytes of a byte order mark at the start of the
+	// output stream have been matched (and withheld) so far, in case the
+	// mark arrives split across frames. See stripBOM.
+	bomSkip int
+
+	// bomDone is true once the start of the output stream has been
+	// settled: any later BOM-looking bytes pass through untouched.
+	bomDone bool
+
+	// read counts the terminal bytes received from the web client.
+	// Accessed atomically.
+	read int64
+}
+
+// copyInput hands the bytes of one input frame to the caller, keeping what
+// does not fit for the next Read. A frame above the configured paste
+// threshold is handed out in PasteChunkBytes sized chunks with a short gap
+// between them (see Read), so a huge clipboard paste does not hit the
+// shell's line buffer as one giant write. Keystroke-sized input passes
+// through untouched.
+func (w *wrappedSocket) copyInput(out []byte, data []byte) int {
+	chunk := 0
+	if w.terminal != nil {
+		chunk = w.terminal.params.PasteChunkBytes
+	}
+	if chunk > 0 && len(data) > chunk {
+		w.pasteChunk = chunk
+		if len(out) > chunk {
+			out = out[:chunk]
 		}
-		filteredEvents = append(filteredEvents, event)
+	}
+	n := copy(out, data)
+	if n < len(data) {
+		w.readBuf = data[n:]
+	} else {
+		w.pasteChunk = 0
+	}
+	return n
+}
+
+const (
+	// bracketedPasteStart and bracketedPasteEnd are the xterm bracketed
+	// paste markers pasted content is wrapped in when BracketedPaste is
+	// enabled.
+	bracketedPasteStart = "\x1b[200~"
+	bracketedPasteEnd   = "\x1b[201~"
+)
+
+// bracketPaste wraps pasted bytes in the bracketed paste markers when the
+// session asked for it, so terminal applications can tell a paste apart
+// from typed input. The markers are raw escape sequences, they bypass the
+// charset conversion the payload went through.
+func (w *wrappedSocket) bracketPaste(data []byte) []byte {
+	if w.terminal == nil || !w.terminal.params.BracketedPaste {
+		return data
+	}
+	wrapped := make([]byte, 0, len(data)+len(bracketedPasteStart)+len(bracketedPasteEnd))
+	wrapped = append(wrapped, bracketedPasteStart...)
+	wrapped = append(wrapped, data...)
+	return append(wrapped, bracketedPasteEnd...)
+}
+
+// noteBacklog updates the backlog high-water mark and emits a rate limited
+// warning when the backlog crosses the slow client threshold, so operators
+// can spot struggling sessions before their write deadline fires.
+func (w *wrappedSocket) noteBacklog(pending int64) {
+	for {
+		peak := atomic.LoadInt64(&w.backlogPeak)
+		if pending <= peak || atomic.CompareAndSwapInt64(&w.backlogPeak, peak, pending) {
+			break
+		}
+	}
+	if pending <= defaults.OutputBacklogWarnBytes {
+		return
+	}
+
+	w.backlogWarnMu.Lock()
+	defer w.backlogWarnMu.Unlock()
+	if !w.lastBacklogWarn.IsZero() && time.Since(w.lastBacklogWarn) < defaults.OutputBacklogWarnInterval {
+		return
+	}
+	w.lastBacklogWarn = time.Now()
+	webTerminalSlowClientWarnings.Inc()
+	if w.terminal != nil {
+		w.terminal.log().Warnf("Web client is not draining its connection, %v bytes of output stuck in flight.", pending)
+	}
+}
+
+// bytesWritten returns the number of terminal bytes sent to the web client.
+func (w *wrappedSocket) bytesWritten() int64 {
+	return atomic.LoadInt64(&w.written)
+}
+
+// bytesRead returns the number of terminal bytes received from the web
+// client.
+func (w *wrappedSocket) bytesRead() int64 {
+	return atomic.LoadInt64(&w.read)
+}
+
+func newWrappedSocket(ws *websocket.Conn, terminal *TerminalHandler) *wrappedSocket {
+	if ws == nil {
+		return nil
 	}
 
-	return filteredEvents, newCursor, nil
+	sock := newWrappedSocketConn(websocketConn{ws}, terminal)
+	sock.ws = ws
+	return sock
 }
 
-// windowChange is called when the browser window is resized. It sends a
-// "window-change" channel request to the server.
-func (t *TerminalHandler) windowChange(params *session.TerminalParams) error {
-	if t.sshSession == nil {
-		return nil
+// newWrappedSocketConn is newWrappedSocket over an arbitrary transport. It
+// is the seam tests and fuzzers use to drive the framing logic without a
+// real websocket; such a socket has no underlying *websocket.Conn, so the
+// side channels that need one (file transfers) stay disabled.
+func newWrappedSocketConn(conn messageConn, terminal *TerminalHandler) *wrappedSocket {
+	// NewTerminal resolved and stored the session encoding; a handler
+	// built without going through it falls back to UTF-8.
+	charset := encoding.Encoding(unicode.UTF8)
+	if terminal != nil && terminal.charset != nil {
+		charset = terminal.charset
 	}
 
-	_, err := t.sshSession.SendRequest(
-		sshutils.WindowChangeRequest,
-		false,
-		ssh.Marshal(sshutils.WinChangeReqParams{
-			W: uint32(params.W),
-			H: uint32(params.H),
-		}))
-	if err != nil {
-		log.Error(err)
+	return &wrappedSocket{
+		conn:        conn,
+		terminal:    terminal,
+		encoder:     charset.NewEncoder(),
+		decoder:     charset.NewDecoder(),
+		binaryWrite: terminal != nil && terminal.binaryOutput(),
+		binaryRead:  terminal != nil && terminal.binaryInput(),
 	}
+}
 
-	return trace.Wrap(err)
+// encodeBinaryFrame prepends the prefix byte to the payload. The payload
+// bytes are passed through untouched.
+func encodeBinaryFrame(prefix byte, payload []byte) []byte {
+	frame := make([]byte, 0, len(payload)+1)
+	frame = append(frame, prefix)
+	return append(frame, payload...)
 }
 
-// errToTerm displays an error in the terminal window.
-func errToTerm(err error, w io.Writer) error {
-	// Replace \n with \r\n so the message correctly aligned.
-	r := strings.NewReplacer("\r\n", "\r\n", "\n", "\r\n")
-	errMessage := []byte(r.Replace(err.Error()))
+// decodeBinaryFrame splits a binary frame into the prefix byte and the
+// payload.
+func decodeBinaryFrame(frame []byte) (byte, []byte, error) {
+	if len(frame) == 0 {
+		return 0, nil, trace.BadParameter("empty websocket frame")
+	}
+	return frame[0], frame[1:], nil
+}
 
-	// Create an envelope that contains the error message.
-	re := rawEnvelope{
-		Type:    defaults.RawEnvelopeType,
-		Payload: errMessage,
+// utf8BOM is the UTF-8 byte order mark some programs (notably on Windows)
+// emit before their output.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripBOM removes a UTF-8 byte order mark from the very start of the
+// output stream when the session asked for it. The mark may arrive split
+// across frames, so a partial match is withheld until the next bytes settle
+// it; a sequence that merely looks like a BOM but is not (or appears later
+// in the stream) passes through untouched.
+func (w *wrappedSocket) stripBOM(data []byte) []byte {
+	if w.terminal == nil || !w.terminal.params.StripBOM || w.bomDone {
+		return data
 	}
-	b, err := json.Marshal(re)
-	if err != nil {
-		return trace.Wrap(err)
+	for len(data) > 0 && w.bomSkip < len(utf8BOM) && data[0] == utf8BOM[w.bomSkip] {
+		data = data[1:]
+		w.bomSkip++
 	}
-
-	// Write the error to the websocket.
-	_, err = w.Write(b)
-	if err != nil {
-		return trace.Wrap(err)
+	if w.bomSkip == len(utf8BOM) {
+		w.bomDone = true
+		return data
+	}
+	if len(data) == 0 {
+		// Ran out of bytes mid-match: hold judgment until the next frame.
+		return nil
 	}
 
-	return nil
+	// Not a BOM after all: put the withheld bytes back in front.
+	withheld := append([]byte{}, utf8BOM[:w.bomSkip]...)
+	w.bomSkip = 0
+	w.bomDone = true
+	return append(withheld, data...)
 }
 
-// resolveServerHostPort parses server name and attempts to resolve hostname
-// and port.
-func resolveServerHostPort(servername string, existingServers []services.Server) (string, int, error) {
-	// If port is 0, client wants us to figure out which port to use.
-	var defaultPort = 0
-
-	if servername == "" {
-		return "", defaultPort, trace.BadParameter("empty server name")
+// Write wraps the data bytes in a raw envelope and sends.
+func (w *wrappedSocket) Write(data []byte) (n int, err error) {
+	received := len(data)
+	data = w.stripBOM(data)
+	if len(data) == 0 && received > 0 {
+		// The whole frame was (part of) a byte order mark, nothing to send
+		// yet. The bytes still count as consumed for the caller.
+		return received, nil
 	}
 
-	// Check if servername is UUID.
-	for i := range existingServers {
-		node := existingServers[i]
-		if node.GetName() == servername {
-			return node.GetHostname(), defaultPort, nil
-		}
+	_, err = w.write(data, defaults.RawWebsocketPrefix, defaults.RawEnvelopeType)
+	if err != nil {
+		return 0, err
 	}
 
-	if !strings.Contains(servername, ":") {
-		return servername, defaultPort, nil
+	// If requested, tell the client the output rang the terminal bell.
+	// The BEL byte is not stripped, the notification rides alongside it.
+	if w.terminal != nil && w.terminal.params.DetectBell && bytes.IndexByte(data, '\a') >= 0 {
+		if _, er := w.write(nil, defaults.BellWebsocketPrefix, defaults.BellEnvelopeType); er != nil {
+			w.terminal.log().Warnf("Unable to send bell notification: %v.", er)
+		}
 	}
+	return received, nil
+}
 
-	// Check for explicitly specified port.
-	host, portString, err := utils.SplitHostPort(servername)
-	if err != nil {
-		return "", defaultPort, trace.Wrap(err)
+// write sends terminal output to the web client under the given frame
+// prefix and envelope type, so variants of output (stderr, scrollback
+// replay) can be tagged apart from live stdout.
+func (w *wrappedSocket) write(data []byte, prefix byte, envelopeType string) (n int, err error) {
+	// Apply the output rate limit before sending anything: blocking here
+	// backpressures the SSH channel instead of dropping output.
+	if w.terminal != nil && w.terminal.outputThrottle != nil {
+		err = w.terminal.outputThrottle.wait(w.terminal.terminalContext, len(data))
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
 	}
 
-	port, err := strconv.Atoi(portString)
-	if err != nil {
-		return "", defaultPort, trace.BadParameter("invalid port: %v", err)
+	// Flowing output keeps the session alive: a silent user watching a
+	// long-running command is not idle. Network liveness is judged
+	// separately by the keepalive loop.
+	if w.terminal != nil && w.terminal.idleWatcher != nil {
+		w.terminal.idleWatcher.activity()
 	}
 
-	return host, port, nil
-}
-
-// wrappedSocket wraps and unwraps the envelope that is used to send events
-// over the websocket.
-type wrappedSocket struct {
-	ws       *websocket.Conn
-	terminal *TerminalHandler
-
-	encoder *encoding.Encoder
-	decoder *encoding.Decoder
-}
+	// Track the output backlog: bytes handed to a send that has not
+	// returned yet. A client that stops draining the connection shows up
+	// here before its write deadline fires.
+	pending := atomic.AddInt64(&w.pending, int64(len(data)))
+	defer atomic.AddInt64(&w.pending, -int64(len(data)))
+	w.noteBacklog(pending)
 
-func newWrappedSocket(ws *websocket.Conn, terminal *TerminalHandler) *wrappedSocket {
-	if ws == nil {
-		return nil
+	// If requested, deflate large output frames. Compressed frames always
+	// travel as prefixed binary messages, even for JSON protocol clients,
+	// the same way compressed audit events do. Only live stdout is
+	// compressed: the other frame kinds are small or rare.
+	if w.terminal != nil && w.terminal.params.Compress && prefix == defaults.RawWebsocketPrefix {
+		threshold := w.terminal.params.CompressThreshold
+		if threshold == 0 {
+			threshold = defaults.RawDeflateThresholdBytes
+		}
+		if len(data) > threshold {
+			// A JSON protocol client gets uncompressed output decoded to
+			// the UTF-8 the browser renders; compressed frames have to
+			// carry the same bytes or the client cannot make sense of a
+			// mixed stream. Binary protocol clients get raw node bytes on
+			// both paths.
+			payload := data
+			if !w.binaryWrite {
+				payload, err = w.decoder.Bytes(data)
+				if err != nil {
+					if w.terminal.params.InvalidUTF8 == invalidUTF8Fail {
+						return 0, trace.Wrap(err)
+					}
+					payload = replaceInvalidUTF8(data)
+				}
+			}
+			compressed, err := deflateFrame(payload, w.terminal.params.CompressLevel)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+			w.terminal.applyWriteDeadline(w.ws)
+			err = w.conn.Send(encodeBinaryFrame(defaults.CompressedRawWebsocketPrefix, compressed))
+			if err != nil {
+				return 0, trace.Wrap(w.terminal.checkWriteError(err))
+			}
+			atomic.AddInt64(&w.written, int64(len(data)))
+			webTerminalBytesSent.Add(float64(len(data)))
+			return len(data), nil
+		}
 	}
-	return &wrappedSocket{
-		ws:       ws,
-		terminal: terminal,
-		encoder:  unicode.UTF8.NewEncoder(),
-		decoder:  unicode.UTF8.NewDecoder(),
+
+	if w.binaryWrite {
+		w.terminal.applyWriteDeadline(w.ws)
+		err = w.conn.Send(encodeBinaryFrame(prefix, data))
+		if err != nil {
+			return 0, trace.Wrap(w.terminal.checkWriteError(err))
+		}
+		atomic.AddInt64(&w.written, int64(len(data)))
+		webTerminalBytesSent.Add(float64(len(data)))
+		return len(data), nil
 	}
-}
 
-// Write wraps the data bytes in a raw envelope and sends.
-func (w *wrappedSocket) Write(data []byte) (n int, err error) {
-	encodedBytes, err := w.encoder.Bytes(data)
+	encodedBytes, err := w.decoder.Bytes(data)
 	if err != nil {
-		return 0, trace.Wrap(err)
+		if w.terminal != nil && w.terminal.params.InvalidUTF8 == invalidUTF8Fail {
+			return 0, trace.Wrap(err)
+		}
+		encodedBytes = replaceInvalidUTF8(data)
 	}
 
 	e := rawEnvelope{
-		Type:    defaults.RawEnvelopeType,
+		Type:    envelopeType,
 		Payload: encodedBytes,
 	}
 
-	err = websocket.JSON.Send(w.ws, e)
+	w.terminal.applyWriteDeadline(w.ws)
+	err = w.conn.Send(e)
 	if err != nil {
-		return 0, trace.Wrap(err)
+		return 0, trace.Wrap(w.terminal.checkWriteError(err))
 	}
 
+	atomic.AddInt64(&w.written, int64(len(data)))
+	webTerminalBytesSent.Add(float64(len(data)))
 	return len(data), nil
 }
 
+// stderrSocket is a view of a wrapped socket that tags everything written
+// through it as stderr output. It shares the underlying socket, so counters
+// and deadlines stay in one place.
+type stderrSocket struct {
+	*wrappedSocket
+}
+
+// Write sends the data tagged as stderr.
+func (s stderrSocket) Write(data []byte) (int, error) {
+	return s.write(data, defaults.StderrWebsocketPrefix, defaults.StderrEnvelopeType)
+}
+
+// writeNotice sends an out-of-band human readable notice (a participant
+// joining or leaving the session) to the web client, tagged apart from
+// terminal output.
+func (w *wrappedSocket) writeNotice(message string) error {
+	_, err := w.write([]byte(message), defaults.NoticeWebsocketPrefix, defaults.NoticeEnvelopeType)
+	return trace.Wrap(err)
+}
+
 // Read unwraps the envelope and either fills out the passed in bytes or
 // performs an action on the connection (sending window-change request).
 func (w *wrappedSocket) Read(out []byte) (n int, err error) {
-	var ue unknownEnvelope
-	err = websocket.JSON.Receive(w.ws, &ue)
-	if err != nil {
-		if err == io.EOF {
-			return 0, io.EOF
+	// Drain any leftover bytes from a previous frame before receiving the
+	// next one.
+	if len(w.readBuf) > 0 {
+		if w.pasteChunk > 0 {
+			// A short gap between the chunks of an oversized paste gives
+			// the terminal application time to drain its input buffer.
+			time.Sleep(defaults.PasteFlushGap)
+			if len(out) > w.pasteChunk {
+				out = out[:w.pasteChunk]
+			}
+		}
+		n = copy(out, w.readBuf)
+		w.readBuf = w.readBuf[n:]
+		if len(w.readBuf) == 0 {
+			w.pasteChunk = 0
 		}
-		return 0, trace.Wrap(err)
+		return n, nil
 	}
 
-	switch ue.Type {
-	case defaults.RawEnvelopeType:
-		var re rawEnvelope
-		err := json.Unmarshal(ue.Raw, &re)
-		if err != nil {
-			return 0, trace.Wrap(err)
-		}
+	if w.binaryRead {
+		return w.readBinary(out)
+	}
 
-		var data []byte
-		data, err = w.decoder.Bytes(re.Payload)
+	// Frames that yield no input (discarded read-only keystrokes, payloads
+	// that decode to zero bytes) are skipped by looping to the next frame,
+	// not by recursing: a client streaming such frames could otherwise grow
+	// this goroutine's stack without bound.
+	for {
+		var ue unknownEnvelope
+		err = w.conn.Receive(&ue)
 		if err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			if w.terminal != nil {
+				w.terminal.noteFailure(failureSideClient)
+			}
 			return 0, trace.Wrap(err)
 		}
 
-		if len(out) < len(data) {
-			log.Warningf("websocket failed to receive everything: %d vs %d", len(out), len(data))
+		// Reject oversized frames before decoding anything: the error takes
+		// the read loop (and with it the connection) down.
+		if len(ue.Raw) > w.maxFrameBytes() {
+			return 0, trace.LimitExceeded("frame of %v bytes exceeds the %v byte limit",
+				len(ue.Raw), w.maxFrameBytes())
 		}
 
-		return copy(out, data), nil
-	case defaults.ResizeRequestEnvelopeType:
-		if w.terminal == nil {
+		switch ue.Type {
+		case defaults.RawEnvelopeType, defaults.ReplayEnvelopeType:
+			// Replayed history reads exactly like raw output, the tag only
+			// matters to UIs that want to render it differently.
+			//
+			// In a read-only session typed input is discarded before it
+			// reaches the node, only control frames are honored.
+			if w.terminal != nil && w.terminal.params.ReadOnly {
+				continue
+			}
+
+			var re rawEnvelope
+			err := json.Unmarshal(ue.Raw, &re)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			var data []byte
+			data, err = w.encoder.Bytes(re.Payload)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			// The encoder can produce zero bytes (for example an envelope that
+			// only carried an incomplete multi-byte sequence). Receive the next
+			// frame instead of reporting a zero byte read which callers would
+			// mistake for EOF.
+			if len(data) == 0 {
+				continue
+			}
+
+			// Genuine keyboard input pushes the idle deadline out.
+			if w.terminal != nil && w.terminal.idleWatcher != nil {
+				w.terminal.idleWatcher.activity()
+			}
+
+			// Keep whatever does not fit into the passed in buffer for the next
+			// Read call.
+			webTerminalBytesReceived.Add(float64(len(data)))
+			atomic.AddInt64(&w.read, int64(len(data)))
+			return w.copyInput(out, data), nil
+		case defaults.PasteEnvelopeType:
+			// Pasted content follows the raw input path, optionally wrapped
+			// in the bracketed paste markers.
+			if w.terminal != nil && w.terminal.params.ReadOnly {
+				continue
+			}
+
+			var re rawEnvelope
+			err := json.Unmarshal(ue.Raw, &re)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			var data []byte
+			data, err = w.encoder.Bytes(re.Payload)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+			if len(data) == 0 {
+				continue
+			}
+
+			if w.terminal != nil && w.terminal.idleWatcher != nil {
+				w.terminal.idleWatcher.activity()
+			}
+
+			webTerminalBytesReceived.Add(float64(len(data)))
+			atomic.AddInt64(&w.read, int64(len(data)))
+			return w.copyInput(out, w.bracketPaste(data)), nil
+		case defaults.ResizeRequestEnvelopeType:
+			if w.terminal == nil {
+				return 0, nil
+			}
+
+			var ee eventEnvelope
+			err := json.Unmarshal(ue.Raw, &ee)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			params, err := session.UnmarshalTerminalParams(ee.Payload.GetString("size"))
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			// Hand the size to the debouncer so resize storms are collapsed.
+			w.terminal.queueWindowChange(params)
+
+			return 0, nil
+		case defaults.SignalEnvelopeType:
+			// Read-only parties may watch but not signal the process.
+			if w.terminal == nil || w.terminal.params.ReadOnly {
+				return 0, nil
+			}
+
+			var se signalEnvelope
+			err := json.Unmarshal(ue.Raw, &se)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			// A bad or undeliverable signal must not take the read loop (and
+			// with it the session) down.
+			if err := w.terminal.signal(se.Payload); err != nil {
+				w.terminal.log().Warnf("Unable to deliver signal: %v.", err)
+			}
+
+			return 0, nil
+		case defaults.PongEnvelopeType:
+			if w.terminal != nil {
+				w.terminal.keepAlive.pongReceived()
+			}
+			return 0, nil
+		case defaults.FileTransferEnvelopeType:
+			// File transfers need the real websocket for their side channel,
+			// a socket over a substituted transport leaves them disabled.
+			if w.terminal == nil || w.ws == nil {
+				return 0, nil
+			}
+
+			var fe fileTransferEnvelope
+			err := json.Unmarshal(ue.Raw, &fe)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			w.terminal.beginFileTransfer(w.ws, fe.Payload)
+			return 0, nil
+		case defaults.FileChunkEnvelopeType:
+			// Read-only parties cannot have a transfer in flight, drop the
+			// chunk.
+			if w.terminal == nil || w.terminal.params.ReadOnly {
+				return 0, nil
+			}
+
+			var ce fileChunkEnvelope
+			err := json.Unmarshal(ue.Raw, &ce)
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			w.terminal.deliverFileChunk(ce.Payload)
+			return 0, nil
+		case defaults.CapabilitiesEnvelopeType, defaults.RecordingStatusEnvelopeType,
+			defaults.PingEnvelopeType, defaults.CloseEnvelopeType,
+			defaults.FileProgressEnvelopeType, defaults.SessionMetadataEnvelopeType,
+			defaults.ErrorEnvelopeType, defaults.ResizeAckEnvelopeType,
+			defaults.StderrEnvelopeType, defaults.NoticeEnvelopeType,
+			defaults.BellEnvelopeType, defaults.StatusEnvelopeType:
+			// Informational envelopes carry no terminal data.
 			return 0, nil
+		default:
+			return 0, trace.BadParameter("unknown envelope type")
 		}
+	}
+}
 
-		var ee eventEnvelope
-		err := json.Unmarshal(ue.Raw, &ee)
+// readBinary reads a prefixed binary frame and either fills out the passed
+// in bytes or performs an action on the connection (sending window-change
+// request).
+func (w *wrappedSocket) readBinary(out []byte) (n int, err error) {
+	// As in Read, frames that yield no input are skipped by looping to the
+	// next frame rather than recursing, keeping the stack flat no matter
+	// how many such frames a client streams.
+	for {
+		var frame []byte
+		err = w.conn.Receive(&frame)
 		if err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			if w.terminal != nil {
+				w.terminal.noteFailure(failureSideClient)
+			}
 			return 0, trace.Wrap(err)
 		}
 
-		params, err := session.UnmarshalTerminalParams(ee.Payload.GetString("size"))
+		// Reject oversized frames before decoding anything: the error takes
+		// the read loop (and with it the connection) down. The prefix byte
+		// does not count against the cap, so a payload of exactly the limit
+		// still fits.
+		if len(frame) > w.maxFrameBytes()+1 {
+			return 0, trace.LimitExceeded("frame of %v bytes exceeds the %v byte limit",
+				len(frame)-1, w.maxFrameBytes())
+		}
+
+		prefix, payload, err := decodeBinaryFrame(frame)
 		if err != nil {
 			return 0, trace.Wrap(err)
 		}
 
-		// Send the window change request in a goroutine so reads are not blocked
-		// by network connectivity issues.
-		go w.terminal.windowChange(params)
+		switch prefix {
+		case defaults.RawWebsocketPrefix, defaults.ReplayWebsocketPrefix:
+			// Replayed history reads exactly like raw output, the tag only
+			// matters to UIs that want to render it differently.
+			//
+			// In a read-only session typed input is discarded before it
+			// reaches the node, only control frames are honored.
+			if w.terminal != nil && w.terminal.params.ReadOnly {
+				continue
+			}
+
+			// A frame without payload carries no terminal data, receive the
+			// next one instead of reporting a zero byte read.
+			if len(payload) == 0 {
+				continue
+			}
+
+			// Genuine keyboard input pushes the idle deadline out.
+			if w.terminal != nil && w.terminal.idleWatcher != nil {
+				w.terminal.idleWatcher.activity()
+			}
 
-		return 0, nil
-	default:
-		return 0, trace.BadParameter("unknown envelope type")
+			// Keep whatever does not fit into the passed in buffer for the next
+			// Read call.
+			webTerminalBytesReceived.Add(float64(len(payload)))
+			atomic.AddInt64(&w.read, int64(len(payload)))
+			return w.copyInput(out, payload), nil
+		case defaults.PasteWebsocketPrefix:
+			// Pasted content follows the raw input path, optionally wrapped
+			// in the bracketed paste markers.
+			if w.terminal != nil && w.terminal.params.ReadOnly {
+				continue
+			}
+
+			if len(payload) == 0 {
+				continue
+			}
+
+			if w.terminal != nil && w.terminal.idleWatcher != nil {
+				w.terminal.idleWatcher.activity()
+			}
+
+			webTerminalBytesReceived.Add(float64(len(payload)))
+			atomic.AddInt64(&w.read, int64(len(payload)))
+			return w.copyInput(out, w.bracketPaste(payload)), nil
+		case defaults.ResizeWebsocketPrefix:
+			if w.terminal == nil {
+				return 0, nil
+			}
+
+			params, err := session.UnmarshalTerminalParams(string(payload))
+			if err != nil {
+				return 0, trace.Wrap(err)
+			}
+
+			// Hand the size to the debouncer so resize storms are collapsed.
+			w.terminal.queueWindowChange(params)
+
+			return 0, nil
+		case defaults.SignalWebsocketPrefix:
+			// Read-only parties may watch but not signal the process.
+			if w.terminal == nil || w.terminal.params.ReadOnly {
+				return 0, nil
+			}
+
+			// A bad or undeliverable signal must not take the read loop (and
+			// with it the session) down.
+			if err := w.terminal.signal(string(payload)); err != nil {
+				w.terminal.log().Warnf("Unable to deliver signal: %v.", err)
+			}
+
+			return 0, nil
+		case defaults.PongWebsocketPrefix:
+			if w.terminal != nil {
+				w.terminal.keepAlive.pongReceived()
+			}
+			return 0, nil
+		case defaults.FileTransferWebsocketPrefix:
+			// Read-only parties cannot have a transfer in flight, drop the
+			// chunk.
+			if w.terminal != nil && !w.terminal.params.ReadOnly {
+				w.terminal.deliverFileChunk(payload)
+			}
+			return 0, nil
+		default:
+			return 0, trace.BadParameter("unknown frame prefix")
+		}
 	}
 }
 
+// maxFrameBytes is the cap on the size of a single inbound frame, the
+// requested limit or the generous but finite default.
+func (w *wrappedSocket) maxFrameBytes() int {
+	if w.terminal != nil && w.terminal.params.MaxFrameBytes > 0 {
+		return w.terminal.params.MaxFrameBytes
+	}
+	return defaults.MaxTerminalFrameBytes
+}
+
 // SetReadDeadline sets the network read deadline on the underlying websocket.
 func (w *wrappedSocket) SetReadDeadline(t time.Time) error {
-	return w.ws.SetReadDeadline(t)
+	return w.conn.SetReadDeadline(t)
 }
 
 // Close the websocket.
 func (w *wrappedSocket) Close() error {
-	return w.ws.Close()
+	return w.conn.Close()
 }
 
 // eventEnvelope is used to send/receive audit events.
 type eventEnvelope struct {
 	Type    string             `json:"t"`
 	Payload events.EventFields `json:"p"`
+
+	// Seq is a server assigned, monotonically increasing sequence number,
+	// letting the client detect dropped or reordered events. Zero on
+	// envelopes the client sends.
+	Seq int `json:"seq,omitempty"`
+}
+
+// recordingStatusEnvelope is used to send the status of the session
+// recording upload.
+type recordingStatusEnvelope struct {
+	Type    string          `json:"t"`
+	Payload recordingStatus `json:"p"`
+}
+
+// recordingStatus describes the state of the session recording upload.
+type recordingStatus struct {
+	// Backlog is the number of recording chunks waiting to be uploaded.
+	Backlog int `json:"backlog"`
+	// Failed indicates the recording upload has failed.
+	Failed bool `json:"failed"`
+}
+
+// sessionMetadataEnvelope is used to send the resolved connection
+// metadata.
+type sessionMetadataEnvelope struct {
+	Type    string          `json:"t"`
+	Payload sessionMetadata `json:"p"`
+}
+
+// sessionMetadata describes what the terminal actually connected to.
+type sessionMetadata struct {
+	// HostName is the resolved hostname of the node.
+	HostName string `json:"hostname"`
+	// HostPort is the resolved port of the node, 0 when the server picks.
+	HostPort int `json:"port"`
+	// Login is the OS login the session runs as.
+	Login string `json:"login"`
+	// Cluster is the name of the cluster the node belongs to.
+	Cluster string `json:"cluster,omitempty"`
+	// SessionID is the ID of the session.
+	SessionID string `json:"sid"`
+	// RequestID echoes the tracing ID the request carried (or the one
+	// generated for it) so the browser can log it.
+	RequestID string `json:"request_id,omitempty"`
+	// ResumeToken lets the browser re-attach to this session after a
+	// transient websocket drop.
+	ResumeToken string `json:"resume_token,omitempty"`
+	// NodeOS and NodeArch describe the host platform, taken from the
+	// node's "os" and "arch" labels when it advertises them. The UI uses
+	// them for display and command hints.
+	NodeOS   string `json:"os,omitempty"`
+	NodeArch string `json:"arch,omitempty"`
+	// NodeVersion is the Teleport version the node advertises via its
+	// "version" label, empty when not set.
+	NodeVersion string `json:"teleport_version,omitempty"`
+	// Joined is true when the connection joined a session that already
+	// existed instead of creating a new one.
+	Joined bool `json:"joined"`
+	// ReplayFull is true when the client asked to resume the scrollback
+	// from an offset the buffer no longer retains, so the full tail was
+	// replayed instead of just the missed part.
+	ReplayFull bool `json:"replay_full,omitempty"`
+}
+
+// errorEnvelope is used to send a structured error the web client can
+// style apart from ordinary terminal output.
+type errorEnvelope struct {
+	Type    string       `json:"t"`
+	Payload errorPayload `json:"p"`
+}
+
+// errorPayload carries the error shown to the user.
+type errorPayload struct {
+	// Code is a short machine readable classification of the error.
+	Code string `json:"code"`
+	// Message is the human readable error message.
+	Message string `json:"message"`
+	// Side is which side of the connection the failure was observed on,
+	// "client" or "server", when it is known.
+	Side string `json:"side,omitempty"`
+}
+
+// statusEnvelope reports connection progress while the session is being
+// established.
+type statusEnvelope struct {
+	Type    string        `json:"t"`
+	Payload statusPayload `json:"p"`
+}
+
+// statusPayload names the connection state (see the statusState*
+// constants) and the step it is on.
+type statusPayload struct {
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// closeEnvelope is used to send the reason the session ended.
+type closeEnvelope struct {
+	Type    string       `json:"t"`
+	Payload closePayload `json:"p"`
+}
+
+// closePayload describes why the session ended.
+type closePayload struct {
+	// Reason is why the session ended.
+	Reason string `json:"reason"`
+	// ExitCode is the exit status of the remote command, -1 when it is not
+	// known.
+	ExitCode int `json:"exit_code"`
+	// Clean indicates the session ended normally.
+	Clean bool `json:"clean"`
+	// Side is which side of the connection the failure was observed on,
+	// "client" or "server", when the session ended on a failure.
+	Side string `json:"side,omitempty"`
+}
+
+// latencyEnvelope is used to send the measured round trip latency.
+type latencyEnvelope struct {
+	Type    string         `json:"t"`
+	Payload latencyPayload `json:"p"`
+}
+
+// latencyPayload carries the measured round trip latency.
+type latencyPayload struct {
+	// Milliseconds is the round trip latency, -1 when no reply has been
+	// measured yet.
+	Milliseconds int64 `json:"ms"`
+}
+
+// resizeAckEnvelope is used to confirm (or reject) a resize request back
+// to the web client.
+type resizeAckEnvelope struct {
+	Type    string           `json:"t"`
+	Payload resizeAckPayload `json:"p"`
+}
+
+// resizeAckPayload carries the outcome of a window change request.
+type resizeAckPayload struct {
+	// W and H are the dimensions sent to the node, after clamping.
+	W int `json:"w"`
+	H int `json:"h"`
+	// OK is false when the window change request failed.
+	OK bool `json:"ok"`
+	// Error is the failure reason when OK is false.
+	Error string `json:"error,omitempty"`
+}
+
+// signalEnvelope is used to receive a signal name to deliver to the
+// remote process.
+type signalEnvelope struct {
+	Type    string `json:"t"`
+	Payload string `json:"p"`
+}
+
+// capabilitiesEnvelope is used to send the capabilities of the terminal
+// protocol right after the websocket upgrade.
+type capabilitiesEnvelope struct {
+	Type    string               `json:"t"`
+	Payload terminalCapabilities `json:"p"`
+}
+
+// terminalCapabilities describes what the server supports for this
+// connection so web clients can feature detect.
+type terminalCapabilities struct {
+	// ProtocolVersion is the version of the websocket terminal protocol.
+	ProtocolVersion int `json:"protocol_version"`
+	// EnvelopeTypes lists the envelope types the server understands.
+	EnvelopeTypes []string `json:"envelope_types"`
+	// LineBuffered indicates terminal output is line buffered.
+	LineBuffered bool `json:"line_buffered,omitempty"`
+	// RecordingStatus indicates recording status frames will be emitted.
+	RecordingStatus bool `json:"recording_status,omitempty"`
 }
 
 // rawEnvelope is used to send/receive terminal bytes.